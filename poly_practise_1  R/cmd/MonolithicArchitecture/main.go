@@ -5,12 +5,13 @@ import (
 	"log"
 	"os/signal"
 	"poly_practice_1/config"
+	"poly_practice_1/internal/aggregator"
 	"poly_practice_1/internal/consumer"
 	"poly_practice_1/internal/producer"
+	"poly_practice_1/internal/redisclient"
 	"poly_practice_1/pkg/metrics"
 	"syscall"
 
-	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
@@ -39,18 +40,24 @@ func run(ctx context.Context, cfg *config.Config) error {
 	metrics.InitStatsCollector(logger)
 	go metrics.StartStatsLoop(ctx)
 
-	redis := redis.NewClient(&redis.Options{
-		Addr: cfg.RedisDB.Address, Password: cfg.RedisDB.Password, DB: cfg.RedisDB.DB,
-	})
+	redis := redisclient.New(cfg.RedisDB)
 	defer redis.Close()
 
+	// один writer на все агрегаторы: общий размыкатель и один журнал на процесс
+	writer, err := aggregator.NewWriter(redis, cfg.Aggregator)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	grp.Go(func() error { return writer.Run(ctx) })
+
 	for i := 0; i < cfg.Instances.ProducerCount; i++ {
 		producer := producer.New(*cfg.Producer, cfg.Producer.Brokers)
 		grp.Go(func() error { return producer.Run(ctx) })
 	}
 
 	for i := 0; i < cfg.Instances.ConsumerCount; i++ {
-		consumer := consumer.New(*cfg.Kafka, redis)
+		consumer := consumer.New(*cfg.Kafka, cfg.Aggregator, writer)
 		grp.Go(func() error { return consumer.Run(ctx) })
 	}
 
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -35,13 +36,88 @@ type Kafka struct {
 
 type AggregatorConfig struct {
 	FlushInterval time.Duration `yaml:"flush-interval" env-default:"5s"`
-	BatchSize     int           `yaml:"batch-size" env-default:"100"`
+	BatchSize     int           `yaml:"batch-size" env-default:"100"`  // flush по числу элементов, 0 - выключен
+	MergeMode     string        `yaml:"merge-mode" env-default:"list"` // list, hash, window
+	ListCap       int           `yaml:"list-cap" env-default:"1000"`   // для merge-mode: list
+	TTL           time.Duration `yaml:"ttl"`                           // 0 - ключи не истекают
+	Shards        int           `yaml:"shards" env-default:"32"`       // шарды состояния по хешу uid
+	MaxKeys       int           `yaml:"max-keys"`                      // flush по числу пользователей, 0 - выключен
+	MaxBytes      int64         `yaml:"max-bytes"`                     // flush по оценке размера буфера, 0 - выключен
+
+	WriteTimeout time.Duration  `yaml:"write-timeout" env-default:"10s"` // на запись одного батча вместе с повторами
+	Retry        *RetryConfig   `yaml:"retry"`
+	Breaker      *BreakerConfig `yaml:"breaker"`
+	WAL          string         `yaml:"wal" env-default:"aggregator.wal"` // журнал батчей, не записанных в Redis
+}
+
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts" env-default:"3"` // всего попыток, включая первую
+	Backoff    time.Duration `yaml:"backoff" env-default:"200ms"`
+	MaxBackoff time.Duration `yaml:"max-backoff" env-default:"2s"`
+}
+
+// BreakerConfig - после failures неудачных записей подряд Redis не вызывается cooldown,
+// батчи сразу уходят в журнал; с тем же периодом журнал воспроизводится в фоне
+type BreakerConfig struct {
+	Failures int           `yaml:"failures" env-default:"3"`
+	Cooldown time.Duration `yaml:"cooldown" env-default:"10s"`
 }
 
+const (
+	MergeList   = "list"   // RPUSH в список, обрезанный до ListCap
+	MergeHash   = "hash"   // HINCRBY счётчика на каждый item
+	MergeWindow = "window" // отдельный ключ на каждое окно flush-interval
+)
+
+func (c *AggregatorConfig) Validate() error {
+	switch c.MergeMode {
+	case MergeList, MergeHash, MergeWindow:
+	default:
+		return fmt.Errorf("aggregator: unknown merge-mode %q", c.MergeMode)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("aggregator: negative ttl %s", c.TTL)
+	}
+	return nil
+}
+
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
 type RedisСonfig struct {
-	Address  string `yaml:"address" env-required:"true"`
-	Password string `yaml:"password" env-required:"true"`
-	DB       int    `yaml:"db" env-required:"true"`
+	Mode             string   `yaml:"mode" env-default:"standalone"` // standalone, sentinel, cluster
+	Address          string   `yaml:"address"`                       // standalone
+	Addresses        []string `yaml:"addresses"`                     // sentinel: адреса sentinel, cluster: seed-узлы
+	MasterName       string   `yaml:"master-name"`                   // sentinel
+	SentinelPassword string   `yaml:"sentinel-password"`
+	Password         string   `yaml:"password" env-required:"true"`
+	DB               int      `yaml:"db" env-required:"true"` // в cluster есть только 0
+}
+
+func (c *RedisСonfig) Validate() error {
+	switch c.Mode {
+	case RedisStandalone:
+		if c.Address == "" {
+			return fmt.Errorf("redis_database: standalone mode requires address")
+		}
+	case RedisSentinel:
+		if c.MasterName == "" || len(c.Addresses) == 0 {
+			return fmt.Errorf("redis_database: sentinel mode requires master-name and addresses")
+		}
+	case RedisCluster:
+		if len(c.Addresses) == 0 {
+			return fmt.Errorf("redis_database: cluster mode requires addresses")
+		}
+		if c.DB != 0 {
+			return fmt.Errorf("redis_database: cluster mode supports only db 0")
+		}
+	default:
+		return fmt.Errorf("redis_database: unknown mode %q", c.Mode)
+	}
+	return nil
 }
 
 type LoggingConfig struct {
@@ -76,5 +152,61 @@ func Load(path string) (*Config, error) {
 	if err := decoder.Decode(&cfg); err != nil {
 		return nil, err
 	}
+
+	if cfg.RedisDB == nil {
+		cfg.RedisDB = &RedisСonfig{}
+	}
+	if cfg.RedisDB.Mode == "" {
+		cfg.RedisDB.Mode = RedisStandalone
+	}
+	if err := cfg.RedisDB.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Aggregator == nil {
+		cfg.Aggregator = &AggregatorConfig{}
+	}
+	if cfg.Aggregator.FlushInterval <= 0 {
+		cfg.Aggregator.FlushInterval = 5 * time.Second
+	}
+	if cfg.Aggregator.MergeMode == "" {
+		cfg.Aggregator.MergeMode = MergeList
+	}
+	if cfg.Aggregator.ListCap <= 0 {
+		cfg.Aggregator.ListCap = 1000
+	}
+	if cfg.Aggregator.Shards <= 0 {
+		cfg.Aggregator.Shards = 32
+	}
+	if cfg.Aggregator.WriteTimeout <= 0 {
+		cfg.Aggregator.WriteTimeout = 10 * time.Second
+	}
+	if cfg.Aggregator.Retry == nil {
+		cfg.Aggregator.Retry = &RetryConfig{}
+	}
+	if cfg.Aggregator.Retry.Attempts <= 0 {
+		cfg.Aggregator.Retry.Attempts = 3
+	}
+	if cfg.Aggregator.Retry.Backoff <= 0 {
+		cfg.Aggregator.Retry.Backoff = 200 * time.Millisecond
+	}
+	if cfg.Aggregator.Retry.MaxBackoff <= 0 {
+		cfg.Aggregator.Retry.MaxBackoff = 2 * time.Second
+	}
+	if cfg.Aggregator.Breaker == nil {
+		cfg.Aggregator.Breaker = &BreakerConfig{}
+	}
+	if cfg.Aggregator.Breaker.Failures <= 0 {
+		cfg.Aggregator.Breaker.Failures = 3
+	}
+	if cfg.Aggregator.Breaker.Cooldown <= 0 {
+		cfg.Aggregator.Breaker.Cooldown = 10 * time.Second
+	}
+	if cfg.Aggregator.WAL == "" {
+		cfg.Aggregator.WAL = "aggregator.wal"
+	}
+	if err := cfg.Aggregator.Validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
@@ -2,28 +2,76 @@ package aggregator
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"hash/fnv"
+	"poly_practice_1/config"
+	"poly_practice_1/internal/redisclient"
+	"poly_practice_1/pkg/metrics"
 	"sync"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
-	"go.uber.org/zap"
 )
 
-type Aggregator struct {
-	redis *redis.Client
-	batch map[string][]string
+// shard - часть состояния со своим локом; воркеры с разными uid не мешают друг другу.
+// Счётчики порогов у шарда свои и меняются под его локом, общих счётчиков на процесс нет
+type shard struct {
 	mu    sync.Mutex
+	batch map[string][]string
+	items int64
+	bytes int64
 }
 
-func New(rdb *redis.Client) *Aggregator {
-	return &Aggregator{redis: rdb, batch: map[string][]string{}}
+// причины flush для метрики aggregator_flushes_total
+const (
+	ReasonInterval = "interval"
+	ReasonItems    = "items"
+	ReasonKeys     = "keys"
+	ReasonBytes    = "bytes"
+	ReasonShutdown = "shutdown"
+)
+
+type Aggregator struct {
+	writer *Writer
+	cfg    *config.AggregatorConfig
+	shards []*shard
+
+	// пороги одного шарда: uid раскладываются по шардам хешем равномерно, поэтому общий
+	// порог делится поровну и весь буфер сбрасывается около него
+	maxItems int64
+	maxKeys  int
+	maxBytes int64
+
+	flushCh chan string
+}
+
+func New(writer *Writer, cfg *config.AggregatorConfig) *Aggregator {
+	n := cfg.Shards
+	if n <= 0 {
+		n = 1
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{batch: map[string][]string{}}
+	}
+	return &Aggregator{
+		writer:   writer,
+		cfg:      cfg,
+		shards:   shards,
+		maxItems: int64((cfg.BatchSize + n - 1) / n),
+		maxKeys:  (cfg.MaxKeys + n - 1) / n,
+		maxBytes: (cfg.MaxBytes + int64(n) - 1) / int64(n),
+		flushCh:  make(chan string, 1),
+	}
+}
+
+func (a *Aggregator) shardFor(uid string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(uid))
+	return a.shards[h.Sum32()%uint32(len(a.shards))]
 }
 
 func (a *Aggregator) Run(ctx context.Context, in <-chan kafka.Message) error {
-	flush := time.NewTicker(5 * time.Second)
+	flush := time.NewTicker(a.cfg.FlushInterval)
 	defer flush.Stop()
 
 	for {
@@ -31,10 +79,12 @@ func (a *Aggregator) Run(ctx context.Context, in <-chan kafka.Message) error {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-flush.C:
-			a.flush(ctx)
+			a.flush(ctx, ReasonInterval)
+		case reason := <-a.flushCh:
+			a.flush(ctx, reason)
 		case m, ok := <-in:
 			if !ok {
-				a.flush(ctx)
+				a.flush(ctx, ReasonShutdown)
 				return nil
 			}
 			a.append(m)
@@ -47,24 +97,68 @@ func (a *Aggregator) append(m kafka.Message) {
 	if uid == "" {
 		return
 	}
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.batch[uid] = append(a.batch[uid], string(m.Key))
+	size := int64(len(uid) + len(m.Key))
+
+	s := a.shardFor(uid)
+	s.mu.Lock()
+	s.batch[uid] = append(s.batch[uid], string(m.Key))
+	s.items++
+	s.bytes += size
+	reason := a.limitReached(s.items, len(s.batch), s.bytes)
+	s.mu.Unlock()
+
+	if reason != "" {
+		select {
+		case a.flushCh <- reason:
+		default: // flush уже запрошен
+		}
+	}
+}
+
+// limitReached возвращает первый сработавший порог шарда; 0 в конфиге - порог выключен
+func (a *Aggregator) limitReached(items int64, keys int, bytes int64) string {
+	switch {
+	case a.maxItems > 0 && items >= a.maxItems:
+		return ReasonItems
+	case a.maxKeys > 0 && keys >= a.maxKeys:
+		return ReasonKeys
+	case a.maxBytes > 0 && bytes >= a.maxBytes:
+		return ReasonBytes
+	}
+	return ""
 }
 
-func (a *Aggregator) flush(ctx context.Context) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// swap подменяет карты всех шардов пустыми и возвращает старые; лок шарда держится
+// только на время подмены, запись в Redis идёт уже без локов
+func (a *Aggregator) swap() []map[string][]string {
+	out := make([]map[string][]string, 0, len(a.shards))
+	for _, s := range a.shards {
+		s.mu.Lock()
+		if len(s.batch) > 0 {
+			out = append(out, s.batch)
+			s.batch = map[string][]string{}
+			s.items, s.bytes = 0, 0
+		}
+		s.mu.Unlock()
+	}
+	return out
+}
 
-	pipe := a.redis.Pipeline()
-	for uid, items := range a.batch {
-		data, _ := json.Marshal(items)
-		pipe.Set(ctx, "agg:"+uid, data, 0)
+func (a *Aggregator) flush(ctx context.Context, reason string) {
+	batches := a.swap()
+	if len(batches) == 0 {
+		return
 	}
-	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		zap.L().Error("redis pipeline", zap.Error(err))
+	metrics.AggregatorFlushes.WithLabelValues(reason).Inc()
+
+	// uid всегда попадает в один шард, поэтому батчи шардов не пересекаются
+	b := Batch{Time: time.Now(), Token: redisclient.NewToken(), Items: batches[0]}
+	for _, batch := range batches[1:] {
+		for uid, items := range batch {
+			b.Items[uid] = items
+		}
 	}
-	a.batch = map[string][]string{}
+	a.writer.Write(ctx, b)
 }
 
 func header(m kafka.Message, key string) string {
@@ -91,7 +185,7 @@ func (a *Aggregator) Consume(ctx context.Context, msgCh <-chan kafka.Message) {
 }
 
 func (a *Aggregator) FlushLoop(ctx context.Context, cfg interface{}) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(a.cfg.FlushInterval)
 	defer ticker.Stop()
 
 	for {
@@ -99,19 +193,32 @@ func (a *Aggregator) FlushLoop(ctx context.Context, cfg interface{}) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			a.flush(ctx)
+			a.flush(ctx, ReasonInterval)
+		case reason := <-a.flushCh:
+			a.flush(ctx, reason)
 		}
 	}
 }
 
+// GetData возвращает копию текущего состояния всех шардов
 func (a *Aggregator) GetData() map[string][]string {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	return a.batch
+	out := map[string][]string{}
+	for _, s := range a.shards {
+		s.mu.Lock()
+		for uid, items := range s.batch {
+			out[uid] = append([]string(nil), items...)
+		}
+		s.mu.Unlock()
+	}
+	return out
 }
 
 func (a *Aggregator) GetUsersCount() int {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	return len(a.batch)
+	n := 0
+	for _, s := range a.shards {
+		s.mu.Lock()
+		n += len(s.batch)
+		s.mu.Unlock()
+	}
+	return n
 }
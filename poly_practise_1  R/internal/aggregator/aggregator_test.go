@@ -0,0 +1,76 @@
+package aggregator
+
+import (
+	"fmt"
+	"poly_practice_1/config"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// BenchmarkAppend меряет конкуренцию воркеров за состояние: shards=1 - один общий лок, как
+// было до шардирования, shards=32 - значение по умолчанию. Фоновый flush каждые 10ms
+// подменяет карты, как FlushLoop. Число ядер задаётся флагом -cpu:
+//
+//	go test -run '^$' -bench Append -cpu 1,4,8,16 ./internal/aggregator
+func BenchmarkAppend(b *testing.B) {
+	msgs := benchMessages(10000)
+	for _, shards := range []int{1, 32} {
+		for _, workers := range []int{8, 50} {
+			b.Run(fmt.Sprintf("shards=%d/workers=%d", shards, workers), func(b *testing.B) {
+				a := New(nil, &config.AggregatorConfig{Shards: shards})
+				stop := backgroundSwap(a)
+				defer stop()
+
+				var next atomic.Int64
+				// RunParallel запускает parallelism*GOMAXPROCS горутин
+				b.SetParallelism(max(1, workers/runtime.GOMAXPROCS(0)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := int(next.Add(1)) * 7919
+					for pb.Next() {
+						a.append(msgs[i%len(msgs)])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+func benchMessages(users int) []kafka.Message {
+	msgs := make([]kafka.Message, users)
+	for i := range msgs {
+		msgs[i] = kafka.Message{
+			Key:     []byte(fmt.Sprintf("item-%d", i%500)),
+			Headers: []kafka.Header{{Key: "auth_user_id", Value: []byte(fmt.Sprintf("user-%d", i))}},
+		}
+	}
+	return msgs
+}
+
+func backgroundSwap(a *Aggregator) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(10 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				a.swap()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
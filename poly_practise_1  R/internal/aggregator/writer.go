@@ -0,0 +1,230 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"poly_practice_1/config"
+	"poly_practice_1/internal/redisclient"
+	"poly_practice_1/internal/resilience"
+	"poly_practice_1/pkg/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Batch - содержимое одного flush. Time - момент flush: по нему считается окно в merge-mode: window,
+// поэтому батч, воспроизведённый из журнала, попадает в своё окно, а не в текущее.
+// Token - идентификатор flush: скрипты слияния применяют батч к ключу не больше одного раза,
+// так что повтор после таймаута или из журнала не удваивает данные
+type Batch struct {
+	Time  time.Time           `json:"time"`
+	Token string              `json:"token"`
+	Items map[string][]string `json:"items"`
+}
+
+var errBreakerOpen = errors.New("redis circuit breaker is open")
+
+// Writer пишет батчи всех агрегаторов процесса в Redis с повторами и размыкателем. Батч, который
+// не удалось записать, дописывается в локальный журнал и воспроизводится по порядку, когда Redis
+// снова отвечает; пока журнал не пуст, новые батчи встают в его конец
+type Writer struct {
+	redis   redis.UniversalClient
+	cfg     *config.AggregatorConfig
+	breaker *resilience.Breaker
+	wal     *resilience.WAL // nil - журнал выключен, батч при ошибке теряется
+
+	mu     sync.Mutex
+	loaded bool // скрипты слияния загружены в Redis
+}
+
+func NewWriter(rdb redis.UniversalClient, cfg *config.AggregatorConfig) (*Writer, error) {
+	w := &Writer{
+		redis: rdb,
+		cfg:   cfg,
+		breaker: resilience.NewBreaker(cfg.Breaker.Failures, cfg.Breaker.Cooldown, func(s resilience.State) {
+			metrics.RedisBreakerState.Set(float64(s))
+			zap.L().Warn("redis circuit breaker state changed", zap.Stringer("state", s))
+		}),
+	}
+	if cfg.WAL != "" {
+		wal, err := resilience.OpenWAL(cfg.WAL)
+		if err != nil {
+			return nil, err
+		}
+		w.wal = wal
+		metrics.WALPending.Set(float64(wal.Pending()))
+	}
+	return w, nil
+}
+
+// Write не возвращает ошибку: батч либо записан, либо в журнале, либо (без журнала) залогирован как потерянный.
+// Отмена ctx не прерывает запись, иначе батч финального flush при остановке пропал бы
+func (w *Writer) Write(ctx context.Context, b Batch) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), w.cfg.WriteTimeout)
+	defer cancel()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.wal != nil && w.wal.Pending() > 0 {
+		w.replay(ctx)
+		if w.wal.Pending() > 0 {
+			w.buffer(b)
+			return
+		}
+	}
+
+	err := errBreakerOpen
+	if w.breaker.Allow() {
+		policy := resilience.Policy{
+			Attempts:   w.cfg.Retry.Attempts,
+			Backoff:    w.cfg.Retry.Backoff,
+			MaxBackoff: w.cfg.Retry.MaxBackoff,
+		}
+		err = resilience.Retry(ctx, policy, func(ctx context.Context) error {
+			return w.exec(ctx, b)
+		}, func(attempt int, err error) {
+			metrics.RedisWriteRetries.Inc()
+			zap.L().Warn("redis pipeline failed, retrying", zap.Int("attempt", attempt), zap.Error(err))
+		})
+		if err == nil {
+			w.breaker.Success()
+			return
+		}
+		w.breaker.Failure()
+	}
+
+	if w.wal == nil {
+		zap.L().Error("redis pipeline", zap.Int("users", len(b.Items)), zap.Error(err))
+		return
+	}
+	zap.L().Warn("redis unavailable, buffering batch to write-ahead log", zap.Int("users", len(b.Items)), zap.Error(err))
+	w.buffer(b)
+}
+
+func (w *Writer) buffer(b Batch) {
+	line, err := json.Marshal(b)
+	if err == nil {
+		err = w.wal.Append(line)
+	}
+	if err != nil {
+		zap.L().Error("write-ahead log append failed, batch lost", zap.Int("users", len(b.Items)), zap.Error(err))
+		return
+	}
+	metrics.WALBuffered.Inc()
+	metrics.WALPending.Set(float64(w.wal.Pending()))
+}
+
+// replay воспроизводит журнал, пока Redis отвечает; вызывается под w.mu
+func (w *Writer) replay(ctx context.Context) {
+	if w.wal.Pending() == 0 || !w.breaker.Allow() {
+		return
+	}
+
+	started, pending := time.Now(), w.wal.Pending()
+	n, err := w.wal.Replay(func(line []byte) error {
+		var b Batch
+		if err := json.Unmarshal(line, &b); err != nil {
+			// битую строку не доставить никогда, она не должна держать остальной журнал
+			zap.L().Error("dropping undecodable write-ahead log entry", zap.Error(err))
+			return nil
+		}
+		if err := w.exec(ctx, b); err != nil {
+			return err
+		}
+		pending--
+		metrics.WALReplayed.Inc()
+		metrics.WALPending.Set(float64(pending))
+		return nil
+	})
+	metrics.WALPending.Set(float64(w.wal.Pending()))
+	if err != nil {
+		w.breaker.Failure()
+		zap.L().Warn("write-ahead log replay interrupted",
+			zap.Int("replayed", n), zap.Int("pending", w.wal.Pending()), zap.Error(err))
+		return
+	}
+	w.breaker.Success()
+	if n > 0 {
+		zap.L().Info("write-ahead log replayed", zap.Int("replayed", n), zap.Duration("took", time.Since(started)))
+	}
+}
+
+// Run догоняет журнал без новых flush, раз в cooldown размыкателя
+func (w *Writer) Run(ctx context.Context) error {
+	if w.wal == nil {
+		return nil
+	}
+	ticker := time.NewTicker(w.cfg.Breaker.Cooldown)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			replayCtx, cancel := context.WithTimeout(ctx, w.cfg.WriteTimeout)
+			w.mu.Lock()
+			w.replay(replayCtx)
+			w.mu.Unlock()
+			cancel()
+		}
+	}
+}
+
+// Close закрывает журнал; недоставленное остаётся на диске до следующего запуска
+func (w *Writer) Close() error {
+	if w.wal == nil {
+		return nil
+	}
+	if err := w.wal.Close(); err != nil {
+		return fmt.Errorf("close wal: %w", err)
+	}
+	return nil
+}
+
+// exec вызывается под w.mu
+func (w *Writer) exec(ctx context.Context, b Batch) error {
+	if !w.loaded {
+		if err := redisclient.LoadScripts(ctx, w.redis); err != nil {
+			return err
+		}
+		w.loaded = true
+	}
+
+	pipe := w.redis.Pipeline()
+	for uid, items := range b.Items {
+		w.merge(ctx, pipe, uid, items, b)
+	}
+	_, err := pipe.Exec(ctx)
+	if redisclient.IsNoScript(err) {
+		// кеш скриптов потерян; часть команд могла пройти, но повтор с тем же токеном их пропустит
+		w.loaded = false
+	}
+	return err
+}
+
+// merge сливает батч пользователя с тем, что уже лежит в Redis, скриптом на стороне сервера
+func (w *Writer) merge(ctx context.Context, pipe redis.Pipeliner, uid string, items []string, b Batch) {
+	switch w.cfg.MergeMode {
+	case config.MergeHash:
+		var counts redisclient.Counters
+		for _, item := range items {
+			counts.AddInt(item, 1)
+		}
+		redisclient.IncrBy(ctx, pipe, "agg:hash:"+uid, b.Token, w.cfg.TTL, counts)
+	case config.MergeWindow:
+		// несколько воркеров пишут в одно окно, поэтому окно - тоже список, а не SET;
+		// окна пользователя ищутся по индексу agg:window_index:<uid> без SCAN
+		window := b.Time.Truncate(w.cfg.FlushInterval).Unix()
+		key := "agg:window:" + uid + ":" + strconv.FormatInt(window, 10)
+		redisclient.Append(ctx, pipe, key, b.Token, 0, w.cfg.TTL, items)
+		redisclient.IndexWindows(ctx, pipe, "agg:window_index:"+uid, w.cfg.TTL, map[string]int64{key: window})
+	default:
+		redisclient.Append(ctx, pipe, "agg:list:"+uid, b.Token, w.cfg.ListCap, w.cfg.TTL, items)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"poly_practice_1/pkg/metrics"
 	"strconv"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
@@ -21,7 +20,7 @@ type Consumer struct {
 	workers int
 }
 
-func New(cfg config.KafkaConfig, redis *redis.Client) *Consumer {
+func New(cfg config.KafkaConfig, aggCfg *config.AggregatorConfig, writer *aggregator.Writer) *Consumer {
 
 	workers := cfg.Workers
 
@@ -33,7 +32,7 @@ func New(cfg config.KafkaConfig, redis *redis.Client) *Consumer {
 	})
 	return &Consumer{
 		kafka:   r,
-		agg:     aggregator.New(redis),
+		agg:     aggregator.New(writer, aggCfg),
 		workers: workers,
 	}
 }
@@ -0,0 +1,33 @@
+package redisclient
+
+import (
+	"poly_practice_1/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// New создаёт клиент под режим из конфига. В cluster Pipeline сам раскладывает команды
+// по узлам согласно hash slot ключей, поэтому пайплайн flush не нужно делить вручную;
+// ключи merge - по одному на команду, CROSSSLOT не возникает
+func New(cfg *config.RedisСonfig) redis.UniversalClient {
+	switch cfg.Mode {
+	case config.RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addresses,
+			SentinelPassword: cfg.SentinelPassword,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+		})
+	case config.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.Addresses,
+			Password: cfg.Password,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+}
@@ -0,0 +1,98 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+// Пакет построчно совпадает с processor/internal/resilience в poly_practise_2: монолит -
+// отдельный модуль и shared не подключает. Исправление одной копии переносится в другую
+
+type State int
+
+const (
+	Closed   State = iota // вызовы проходят
+	Open                  // вызовы не проходят до конца cooldown
+	HalfOpen              // пропущен один пробный вызов, ждём его результат
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker размыкается после failures ошибок подряд и раз в cooldown пропускает один
+// пробный вызов: успех замыкает его, ошибка снова размыкает
+type Breaker struct {
+	mu       sync.Mutex
+	failures int
+	cooldown time.Duration
+	onChange func(State)
+
+	state    State
+	fails    int
+	openedAt time.Time
+}
+
+// NewBreaker; onChange вызывается под локом при каждой смене состояния, может быть nil
+func NewBreaker(failures int, cooldown time.Duration, onChange func(State)) *Breaker {
+	if failures <= 0 {
+		failures = 1
+	}
+	return &Breaker{failures: failures, cooldown: cooldown, onChange: onChange}
+}
+
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.set(HalfOpen)
+		return true
+	case HalfOpen:
+		return false
+	}
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails = 0
+	if b.state != Closed {
+		b.set(Closed)
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.state == HalfOpen || b.fails >= b.failures {
+		b.openedAt = time.Now()
+		if b.state != Open {
+			b.set(Open)
+		}
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) set(s State) {
+	b.state = s
+	if b.onChange != nil {
+		b.onChange(s)
+	}
+}
@@ -0,0 +1,146 @@
+package resilience
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// WAL - локальный журнал записей, которые не удалось доставить. Записи дописываются
+// в конец файла построчно и воспроизводятся в том же порядке; позиция воспроизведения
+// хранится в <path>.pos, так что после рестарта уже доставленное не повторяется.
+// Повтор возможен только для строки, на которой процесс упал между доставкой и сохранением позиции
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	pos     int64 // начало первой недоставленной строки
+	size    int64
+	pending int // недоставленных строк
+}
+
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal %s: %w", path, err)
+	}
+	w := &WAL{path: path, f: f}
+
+	if data, err := os.ReadFile(w.posPath()); err == nil {
+		w.pos, _ = strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("stat wal %s: %w", path, err)
+	}
+	w.size = st.Size()
+	if w.pos > w.size {
+		w.pos = 0
+	}
+
+	end := w.pos
+	err = w.scan(func(line []byte) error {
+		w.pending++
+		end += int64(len(line)) + 1
+		return nil
+	})
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	// хвост без перевода строки - запись, оборванная падением процесса; она отбрасывается
+	if end < w.size {
+		if err := f.Truncate(end); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("truncate wal tail: %w", err)
+		}
+		w.size = end
+	}
+	return w, nil
+}
+
+func (w *WAL) posPath() string {
+	return w.path + ".pos"
+}
+
+// Append дописывает строку (без перевода строки внутри) и синхронизирует файл с диском
+func (w *WAL) Append(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := make([]byte, 0, len(line)+1)
+	buf = append(append(buf, line...), '\n')
+	if _, err := w.f.WriteAt(buf, w.size); err != nil {
+		return fmt.Errorf("append wal: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	w.size += int64(len(buf))
+	w.pending++
+	return nil
+}
+
+// Pending - сколько строк ещё не доставлено
+func (w *WAL) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending
+}
+
+// Replay отдаёт недоставленные строки в fn по порядку и останавливается на первой ошибке.
+// Возвращает число доставленных строк; когда доставлено всё, файл обрезается
+func (w *WAL) Replay(fn func(line []byte) error) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	done := 0
+	err := w.scan(func(line []byte) error {
+		if err := fn(line); err != nil {
+			return err
+		}
+		w.pos += int64(len(line)) + 1
+		w.pending--
+		done++
+		return os.WriteFile(w.posPath(), []byte(strconv.FormatInt(w.pos, 10)), 0o644)
+	})
+	if err != nil {
+		return done, err
+	}
+	if w.pending == 0 && w.size > 0 {
+		if err := w.f.Truncate(0); err != nil {
+			return done, fmt.Errorf("truncate wal: %w", err)
+		}
+		w.pos, w.size = 0, 0
+		_ = os.Remove(w.posPath())
+	}
+	return done, nil
+}
+
+// scan читает полные строки от pos до size
+func (w *WAL) scan(fn func(line []byte) error) error {
+	r := bufio.NewReader(io.NewSectionReader(w.f, w.pos, w.size-w.pos))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read wal: %w", err)
+		}
+		if err := fn(line[:len(line)-1]); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
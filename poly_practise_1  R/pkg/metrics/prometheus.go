@@ -87,6 +87,49 @@ var (
 		},
 	)
 
+	AggregatorFlushes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "aggregator_flushes_total",
+			Help: "Total number of aggregator flushes by trigger",
+		},
+		[]string{"reason"},
+	)
+
+	RedisWriteRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "aggregator_redis_retries_total",
+			Help: "Total number of retried Redis batch writes",
+		},
+	)
+
+	RedisBreakerState = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "aggregator_redis_circuit_breaker_state",
+			Help: "Redis circuit breaker state: 0 closed, 1 open, 2 half-open",
+		},
+	)
+
+	WALBuffered = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "aggregator_wal_buffered_total",
+			Help: "Total number of batches appended to the write-ahead log while Redis was unavailable",
+		},
+	)
+
+	WALReplayed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "aggregator_wal_replayed_total",
+			Help: "Total number of batches replayed from the write-ahead log to Redis",
+		},
+	)
+
+	WALPending = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "aggregator_wal_pending",
+			Help: "Number of batches in the write-ahead log not yet replayed",
+		},
+	)
+
 	GCCycles = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "app_gc_cycles_total",
@@ -3,12 +3,21 @@ package main
 import (
 	"collector/config"
 	"collector/internal/app"
+	"flag"
 	"log"
 	"os"
+	"time"
 )
 
 // CONFIG_PATH=D:\GOlangProject\poly_practice_2\collector\config\local.yaml
 func main() {
+	startFrom := flag.String("start-from", "",
+		"start position for partitions without committed offsets (with -reset for all): committed, earliest, latest, offset, timestamp")
+	startOffsets := flag.String("start-offsets", "", "offsets for -start-from=offset: topic:partition=offset,...")
+	startTime := flag.String("start-time", "", "RFC3339 time for -start-from=timestamp")
+	reset := flag.Bool("reset", false, "rewrite committed group offsets to the start position; startup fails if the reset fails")
+	flag.Parse()
+
 	configPath := os.Getenv("CONFIG_PATH")
 	if configPath == "" {
 		configPath = "/etc/myapp/local.yaml"
@@ -19,5 +28,23 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *startFrom != "" {
+		start := &config.StartConfig{From: *startFrom, Reset: *reset}
+		if *startOffsets != "" {
+			if start.Offsets, err = config.ParseOffsets(*startOffsets); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *startTime != "" {
+			if start.Time, err = time.Parse(time.RFC3339, *startTime); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := start.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		cfg.Kafka.Start = start
+	}
+
 	app.MustRun(cfg)
 }
@@ -5,6 +5,9 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"gopkg.in/yaml.v3"
 	"os"
+	"shared/dedup"
+	"shared/filter"
+	"shared/startpos"
 	"time"
 )
 
@@ -13,6 +16,11 @@ type Config struct {
 	Logger     *LoggerConfig   `yaml:"logging"`
 	Kafka      *KafkaConfig    `yaml:"kafka"`
 	Producer   *ProducerConfig `yaml:"producer"`
+	Filter     *FilterConfig   `yaml:"filter"`
+	Dedup      *DedupConfig    `yaml:"dedup"`
+	Redis      *RedisConfig    `yaml:"redis"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout" env-default:"30s"`
 }
 
 type HttpServer struct {
@@ -33,9 +41,28 @@ type KafkaConfig struct {
 	GroupID           string   `yaml:"groupid" env-required:"true"`
 	ClientID          string   `yaml:"clientid"`
 	WorkerCount       int      `yaml:"worker-count" env-default:"1"`
-	ReaderInstance    int      `yaml:"reader-instance" env-default:"1"`
 	BufferChannelSize int      `yaml:"buffer-channel-size" env-default:"100"`
+
+	SessionTimeout   time.Duration `yaml:"session-timeout" env-default:"30s"`
+	RebalanceTimeout time.Duration `yaml:"rebalance-timeout" env-default:"30s"`
+	RevokeTimeout    time.Duration `yaml:"revoke-timeout" env-default:"10s"` // сколько ждём flush и commit при отзыве партиций
+
+	Start *StartConfig `yaml:"start"`
 }
+
+// StartConfig общий с processor: shared/startpos
+type StartConfig = startpos.Config
+
+const (
+	StartCommitted = startpos.Committed
+	StartEarliest  = startpos.Earliest
+	StartLatest    = startpos.Latest
+	StartOffset    = startpos.Offset
+	StartTimestamp = startpos.Timestamp
+)
+
+var ParseOffsets = startpos.ParseOffsets
+
 type ProducerConfig struct {
 	Brokers          []string      `yaml:"brokers" env-required:"true"`
 	Topics           []string      `yaml:"topics"`
@@ -45,8 +72,84 @@ type ProducerConfig struct {
 	Workers          int           `yaml:"workers" env-default:"1"` // Worker pool size
 	ProducerInstance int           `yaml:"producer-instance" env-default:"1"`
 	FlushSec         time.Duration `yaml:"interval" env-default:"4s"`
+	// ранний flush, если буфер агрегатора дорос до порога раньше interval; 0 - порог выключен
+	MaxItems int   `yaml:"max-items"`
+	MaxKeys  int   `yaml:"max-keys"`
+	MaxBytes int64 `yaml:"max-bytes"`
+
+	SendBatchSize    int           `yaml:"send-batch-size" env-default:"500"`     // сообщений на один WriteMessages
+	SendBatchTimeout time.Duration `yaml:"send-batch-timeout" env-default:"10ms"` // kafka.Writer.BatchTimeout
+	SendAttempts     int           `yaml:"send-attempts" env-default:"3"`         // попыток на пользователя за flush
+
+	Format        string `yaml:"format" env-default:"envelope"`        // envelope | batch (голый массив событий)
+	EnvelopeItems string `yaml:"envelope-items" env-default:"payload"` // payload | reference (topic/partition/offset)
+
+	// выходной топик пользователя: route | user-hash | content-type (content_type формата -> топик,
+	// формат один на конфиг, так что топик тоже один на продюсер)
+	TopicStrategy     string            `yaml:"topic-strategy" env-default:"route"`
+	ContentTypeTopics map[string]string `yaml:"content-type-topics"`
+
+	Retry *RetryConfig `yaml:"retry"`
+
+	Sinks  []SinkConfig  `yaml:"sinks"`  // по умолчанию - только kafka в topics
+	Routes []RouteConfig `yaml:"routes"` // входной топик -> выходной, без правила - первый из topics
+}
+
+// RouteConfig - состояние входных топиков, подходящих под input (glob, path.Match),
+// сбрасывает flusher топика output. Правило с lane переназначает только сообщения этой
+// полосы (заголовок lane от правила route фильтра)
+type RouteConfig struct {
+	Input  string `yaml:"input"`
+	Lane   string `yaml:"lane"`
+	Output string `yaml:"output"`
+}
+
+// RetryConfig - очередь повторов для пользователей, которых приёмники не приняли за send-attempts
+type RetryConfig struct {
+	MaxEntries      int           `yaml:"max-entries" env-default:"10000"` // переполнение уходит в dead-letter
+	MaxAttempts     int           `yaml:"max-attempts" env-default:"5"`    // циклов отправки, включая первый flush
+	Backoff         time.Duration `yaml:"backoff" env-default:"5s"`
+	MaxBackoff      time.Duration `yaml:"max-backoff" env-default:"5m"`
+	Path            string        `yaml:"path" env-default:"collector.retry.json"`
+	DeadLetterTopic string        `yaml:"dead-letter-topic"` // пусто - исчерпавшие попытки теряются
+}
+
+// SinkConfig - приёмник батчей; все приёмники получают каждый батч параллельно
+type SinkConfig struct {
+	Name     string        `yaml:"name"`                      // для логов и метрик, по умолчанию type
+	Type     string        `yaml:"type"`                      // kafka | redis | file | stdout | sql
+	Required bool          `yaml:"required"`                  // ошибка приёмника считается ошибкой отправки
+	Timeout  time.Duration `yaml:"timeout" env-default:"10s"` // на одну отправку
+
+	Topics []string `yaml:"topics"` // kafka, по умолчанию producer.topics
+
+	KeyPrefix string        `yaml:"key-prefix" env-default:"collector:"` // redis
+	TTL       time.Duration `yaml:"ttl"`                                 // redis, 0 - без TTL
+
+	Path   string `yaml:"path"`                       // file
+	Format string `yaml:"format" env-default:"jsonl"` // file, stdout: jsonl | csv
+
+	Driver      string `yaml:"driver"` // sql: имя драйвера database/sql
+	DSN         string `yaml:"dsn"`
+	Table       string `yaml:"table" env-default:"batches"`
+	Placeholder string `yaml:"placeholder" env-default:"?"` // sql: ? | $ (postgres)
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
 }
 
+// FilterConfig и RuleConfig общие с processor: shared/filter
+type (
+	FilterConfig = filter.Config
+	RuleConfig   = filter.Rule
+)
+
+// DedupConfig общий с processor: shared/dedup
+type DedupConfig = dedup.Config
+
 func Load(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -63,5 +166,81 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("read env: %w", err)
 	}
 
+	if cfg.Kafka.Start == nil {
+		cfg.Kafka.Start = &StartConfig{}
+	}
+	if err := cfg.Kafka.Start.Validate(); err != nil {
+		return nil, fmt.Errorf("kafka start: %w", err)
+	}
+
+	if cfg.Producer.SendBatchSize <= 0 {
+		cfg.Producer.SendBatchSize = 500
+	}
+	if cfg.Producer.SendBatchTimeout <= 0 {
+		cfg.Producer.SendBatchTimeout = 10 * time.Millisecond
+	}
+	if cfg.Producer.SendAttempts <= 0 {
+		cfg.Producer.SendAttempts = 3
+	}
+	if cfg.Producer.Retry == nil {
+		cfg.Producer.Retry = &RetryConfig{}
+	}
+	if cfg.Producer.Retry.MaxEntries <= 0 {
+		cfg.Producer.Retry.MaxEntries = 10000
+	}
+	if cfg.Producer.Retry.MaxAttempts <= 0 {
+		cfg.Producer.Retry.MaxAttempts = 5
+	}
+	if cfg.Producer.Retry.Backoff <= 0 {
+		cfg.Producer.Retry.Backoff = 5 * time.Second
+	}
+	if cfg.Producer.Retry.MaxBackoff <= 0 {
+		cfg.Producer.Retry.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.Producer.Retry.Path == "" {
+		cfg.Producer.Retry.Path = "collector.retry.json"
+	}
+	if cfg.Producer.Format == "" {
+		cfg.Producer.Format = "envelope"
+	}
+	if cfg.Producer.EnvelopeItems == "" {
+		cfg.Producer.EnvelopeItems = "payload"
+	}
+	if cfg.Producer.TopicStrategy == "" {
+		cfg.Producer.TopicStrategy = "route"
+	}
+
+	if len(cfg.Producer.Sinks) == 0 {
+		cfg.Producer.Sinks = []SinkConfig{{Type: "kafka", Required: true}}
+	}
+	for i := range cfg.Producer.Sinks {
+		s := &cfg.Producer.Sinks[i]
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = 10 * time.Second
+		}
+		if s.KeyPrefix == "" {
+			s.KeyPrefix = "collector:"
+		}
+		if s.Format == "" {
+			s.Format = "jsonl"
+		}
+		if s.Table == "" {
+			s.Table = "batches"
+		}
+		if s.Placeholder == "" {
+			s.Placeholder = "?"
+		}
+	}
+
+	if cfg.HTTPServer.Timeout <= 0 {
+		cfg.HTTPServer.Timeout = 5 * time.Second
+	}
+	if cfg.HTTPServer.IdleTimeout <= 0 {
+		cfg.HTTPServer.IdleTimeout = 60 * time.Second
+	}
+
 	return &cfg, nil
 }
@@ -1,68 +1,369 @@
 package aggregator
 
 import (
+	"collector/internal/route"
 	"collector/pkg/mymetrics"
 	"context"
 	"github.com/segmentio/kafka-go"
+	"hash/fnv"
+	"shared/envelope"
+	"shared/filter"
 	"sync"
+	"time"
 )
 
+// Batch - слитое состояние: сообщения по пользователям и оффсеты, которые оно покрывает.
+// Routed - сообщения тех же партиций, которые правило route фильтра отправило в другой
+// выходной топик: топик -> пользователь -> сообщения.
+// [Start, End) - окно накопления: от создания самого старого забранного состояния партиции до drain
+type Batch struct {
+	Items   map[string][]envelope.Item
+	Routed  map[string]map[string][]envelope.Item
+	Offsets map[string]map[int]int64
+	Start   time.Time
+	End     time.Time
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// partitionState - сообщения пользователей одного шарда из одной партиции
+type partitionState struct {
+	batch  map[string][]envelope.Item
+	offset int64     // следующий оффсет для коммита
+	output string    // выходной топик по таблице маршрутов
+	since  time.Time // начало накопления после прошлого drain
+
+	// сообщения, которые правило route фильтра переназначило в другой выходной топик
+	routed map[string]map[string][]envelope.Item
+
+	items int // счётчики порогов, считаются так же, как в шарде
+	keys  int
+	bytes int64
+}
+
+const shardCount = 16
+
+// shard - пользователи с одним хешем uid: Pending по пользователю берёт лок одного шарда,
+// а не всего агрегатора. Счётчики порогов у шарда свои и меняются под его локом, общий
+// буфер - их сумма, которую считает только drain
+type shard struct {
+	mu    sync.Mutex
+	parts map[partitionKey]*partitionState
+	items int
+	keys  int // пары партиция/пользователь
+	bytes int64
+}
+
+// причины flush для метрики collector_flushes_total
+const (
+	ReasonInterval = "interval"
+	ReasonItems    = "items"
+	ReasonKeys     = "keys"
+	ReasonBytes    = "bytes"
+	ReasonRevoke   = "revoke"
+	ReasonShutdown = "shutdown"
+)
+
+// Limits - пороги раннего flush; нулевое значение выключает порог
+type Limits struct {
+	Items int
+	Keys  int // пары партиция/пользователь
+	Bytes int64
+}
+
+// Aggregator держит состояние по партициям входных топиков; каждая партиция принадлежит
+// выходному топику из таблицы маршрутов, и flusher выходного топика забирает только свои
 type Aggregator struct {
-	mu    sync.RWMutex
-	batch map[string][]string
+	shards []*shard
+	syncCh chan chan struct{}
+	routes *route.Table
+
+	limits  Limits                 // порог одного шарда: общий порог, поделённый между шардами
+	flushCh map[string]chan string // по выходным топикам
+}
+
+func New(limits Limits, routes *route.Table) *Aggregator {
+	return newSharded(limits, routes, shardCount)
+}
+
+// newSharded - New с заданным числом шардов; 1 - один общий лок, для сравнения в бенчмарках.
+// uid раскладываются по шардам хешем равномерно, поэтому порог делится поровну: весь буфер
+// сбрасывается около общего порога и никогда не превышает его больше чем на одно сообщение на шард
+func newSharded(limits Limits, routes *route.Table, shards int) *Aggregator {
+	a := &Aggregator{
+		shards: make([]*shard, shards),
+		syncCh: make(chan chan struct{}),
+		routes: routes,
+		limits: Limits{
+			Items: (limits.Items + shards - 1) / shards,
+			Keys:  (limits.Keys + shards - 1) / shards,
+			Bytes: (limits.Bytes + int64(shards) - 1) / int64(shards),
+		},
+		flushCh: make(map[string]chan string),
+	}
+	for _, output := range routes.Outputs() {
+		a.flushCh[output] = make(chan string, 1)
+	}
+	for i := range a.shards {
+		a.shards[i] = &shard{parts: make(map[partitionKey]*partitionState)}
+	}
+	return a
+}
+
+func (a *Aggregator) shardFor(userID string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return a.shards[h.Sum32()%uint32(len(a.shards))]
 }
 
-func New() *Aggregator {
-	return &Aggregator{
-		batch: make(map[string][]string),
+// StartAggregatorLoop работает до закрытия msgCh: консьюмер закрывает канал только
+// после того, как отозвал партиции, поэтому сообщения в буфере не теряются
+func StartAggregatorLoop(msgCh <-chan kafka.Message, agg *Aggregator) {
+	for {
+		select {
+		case done := <-agg.syncCh:
+			drainChannel(msgCh, agg)
+			close(done)
+		case msg, ok := <-msgCh:
+			if !ok {
+				return
+			}
+			agg.Add(msg, getHeader(msg, "auth_user_id"))
+		}
 	}
 }
 
-func StartAggregatorLoop(ctx context.Context, msgCh <-chan kafka.Message, agg *Aggregator,
-) {
+func drainChannel(msgCh <-chan kafka.Message, agg *Aggregator) {
 	for {
 		select {
-		case <-ctx.Done():
-			return
 		case msg, ok := <-msgCh:
 			if !ok {
 				return
 			}
+			agg.Add(msg, getHeader(msg, "auth_user_id"))
+		default:
+			return
+		}
+	}
+}
+
+// Sync ждёт, пока цикл агрегатора разберёт всё, что уже лежит в канале
+func (a *Aggregator) Sync(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case a.syncCh <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Add сдвигает оффсет партиции даже для сообщений без пользователя, чтобы их тоже закоммитить;
+// такие сообщения попадают в шард пустого uid
+func (a *Aggregator) Add(msg kafka.Message, userID string) {
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	s := a.shardFor(userID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			userID := getHeader(msg, "auth_user_id")
-			if userID == "" {
-				continue
+	st, ok := s.parts[key]
+	if !ok {
+		st = &partitionState{
+			batch:  make(map[string][]envelope.Item),
+			routed: make(map[string]map[string][]envelope.Item),
+			output: a.routes.Output(msg.Topic),
+			since:  time.Now(),
+		}
+		s.parts[key] = st
+	}
+	st.offset = msg.Offset + 1
+
+	if userID == "" {
+		return
+	}
+	users := st.batch
+	if target := a.routes.Target(msg.Topic, getHeader(msg, filter.LaneHeader), getHeader(msg, filter.TopicHeader)); target != st.output {
+		if st.routed[target] == nil {
+			st.routed[target] = make(map[string][]envelope.Item)
+		}
+		users = st.routed[target]
+	}
+	_, exists := users[userID]
+	users[userID] = append(users[userID], envelope.Item{
+		Value:     string(msg.Value),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		TraceID:   getHeader(msg, "trace_id"),
+		Time:      envelope.EventTime(msg),
+	})
+
+	size := int64(len(userID) + len(msg.Value))
+	st.items++
+	st.bytes += size
+	s.items++
+	s.bytes += size
+	if !exists {
+		st.keys++
+		s.keys++
+	}
+	if reason := a.limitReached(s.items, s.keys, s.bytes); reason != "" {
+		// пороги общие на процесс, поэтому сбрасываются все выходные топики, а не только этот
+		for _, ch := range a.flushCh {
+			select {
+			case ch <- reason:
+			default: // flush уже запрошен
 			}
-			agg.Add(msg.Topic, userID, string(msg.Value))
 		}
 	}
 }
 
-func (a *Aggregator) Add(topic, userID, item string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// FlushRequests отдаёт причину, когда буфер превысил один из порогов Limits
+func (a *Aggregator) FlushRequests(output string) <-chan string {
+	return a.flushCh[output]
+}
 
-	a.batch[userID] = append(a.batch[userID], item)
-	mymetrics.InFlightMessages.WithLabelValues(topic).Inc()
+func (a *Aggregator) limitReached(items, keys int, bytes int64) string {
+	switch {
+	case a.limits.Items > 0 && items >= a.limits.Items:
+		return ReasonItems
+	case a.limits.Keys > 0 && keys >= a.limits.Keys:
+		return ReasonKeys
+	case a.limits.Bytes > 0 && bytes >= a.limits.Bytes:
+		return ReasonBytes
+	}
+	return ""
 }
-func countMessages(data map[string][]string) float64 {
-	var total float64
-	for _, items := range data {
-		total += float64(len(items))
+
+// Pending - копия ещё не отправленных сообщений пользователя по всем партициям
+func (a *Aggregator) Pending(userID string) []string {
+	s := a.shardFor(userID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []string
+	for _, st := range s.parts {
+		out = append(out, envelope.Values(st.batch[userID])...)
+		for _, users := range st.routed {
+			out = append(out, envelope.Values(users[userID])...)
+		}
+	}
+	return out
+}
+
+// PendingCounts - число ещё не отправленных сообщений по пользователям
+func (a *Aggregator) PendingCounts() map[string]int {
+	out := make(map[string]int)
+	for _, s := range a.shards {
+		s.mu.Lock()
+		for _, st := range s.parts {
+			for uid, items := range st.batch {
+				out[uid] += len(items)
+			}
+			for _, users := range st.routed {
+				for uid, items := range users {
+					out[uid] += len(items)
+				}
+			}
+		}
+		s.mu.Unlock()
 	}
-	return total
+	return out
+}
+
+// DrainOutput забирает состояние всех партиций, которые маршрутизируются в output
+func (a *Aggregator) DrainOutput(output string) Batch {
+	return a.drain(func(_ partitionKey, st *partitionState) bool { return st.output == output })
 }
-func (a *Aggregator) DrainAndReset(topic string) map[string][]string {
-	a.mu.Lock()
-	defer a.mu.Unlock()
 
-	data := a.batch
-	a.batch = make(map[string][]string)
+// DrainPartitions забирает состояние только указанных партиций (topic -> partitions) из тех,
+// что маршрутизируются в output
+func (a *Aggregator) DrainPartitions(output string, partitions map[string][]int) Batch {
+	return a.drain(func(k partitionKey, st *partitionState) bool {
+		if st.output != output {
+			return false
+		}
+		for _, p := range partitions[k.topic] {
+			if p == k.partition {
+				return true
+			}
+		}
+		return false
+	})
+}
 
-	totalMessages := countMessages(data)
+// drain забирает подходящие партиции из всех шардов под локами всех шардов сразу: партиция
+// лежит в нескольких шардах, и оффсет, забранный из одного, не должен обогнать сообщения,
+// которые Add успел положить в другой. Под локами состояние только переносится, слияние идёт без них.
+// Метрика in_flight_messages - сколько сообщений топика ждали отправки к этому drain
+func (a *Aggregator) drain(match func(partitionKey, *partitionState) bool) Batch {
+	var taken []*partitionState
+	var keys []partitionKey
+	pending := make(map[string]int)
+	for _, s := range a.shards {
+		s.mu.Lock()
+	}
+	for _, s := range a.shards {
+		for key, st := range s.parts {
+			pending[key.topic] += st.items
+			if match(key, st) {
+				taken = append(taken, st)
+				keys = append(keys, key)
+				delete(s.parts, key)
+				s.items -= st.items
+				s.keys -= st.keys
+				s.bytes -= st.bytes
+			}
+		}
+	}
+	for _, s := range a.shards {
+		s.mu.Unlock()
+	}
+	for topic, n := range pending {
+		mymetrics.InFlightMessages.WithLabelValues(topic).Set(float64(n))
+	}
 
-	mymetrics.InFlightMessages.WithLabelValues(topic).Add(-totalMessages)
-	return data
+	out := Batch{
+		Items:   make(map[string][]envelope.Item),
+		Routed:  make(map[string]map[string][]envelope.Item),
+		Offsets: make(map[string]map[int]int64),
+		Start:   time.Now(),
+	}
+	out.End = out.Start
+	for i, st := range taken {
+		key := keys[i]
+		if st.since.Before(out.Start) {
+			out.Start = st.since
+		}
+		merge(out.Items, st.batch)
+		for target, users := range st.routed {
+			if out.Routed[target] == nil {
+				out.Routed[target] = make(map[string][]envelope.Item)
+			}
+			merge(out.Routed[target], users)
+		}
+		if out.Offsets[key.topic] == nil {
+			out.Offsets[key.topic] = make(map[int]int64)
+		}
+		if off, ok := out.Offsets[key.topic][key.partition]; !ok || st.offset > off {
+			out.Offsets[key.topic][key.partition] = st.offset
+		}
+	}
+	return out
+}
+
+func merge(dst, src map[string][]envelope.Item) {
+	for uid, items := range src {
+		dst[uid] = append(dst[uid], items...)
+	}
 }
 
 func getHeader(msg kafka.Message, key string) string {
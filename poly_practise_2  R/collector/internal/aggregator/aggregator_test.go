@@ -0,0 +1,96 @@
+package aggregator
+
+import (
+	"collector/internal/route"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkAdd меряет Add так, как его вызывает StartAggregatorLoop, - из одной горутины, -
+// пока фоновый drain каждые 10ms забирает состояние, как flusher, а readers горутин API
+// читают Pending пользователей. shards=1 - один общий лок, shards=16 - как в New: Pending
+// берёт лок только шарда пользователя. Сообщения идут из 10 топиков по 6 партиций.
+// Выигрыш шардов виден только на нескольких ядрах, число ядер - флаг -cpu:
+//
+//	go test -run '^$' -bench Add -cpu 1,4,8 ./internal/aggregator
+func BenchmarkAdd(b *testing.B) {
+	routes, err := route.New(nil, []string{"out"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs, users := benchMessages(10, 6, 10000)
+
+	for _, shards := range []int{1, shardCount} {
+		for _, readers := range []int{0, 4} {
+			b.Run(fmt.Sprintf("shards=%d/readers=%d", shards, readers), func(b *testing.B) {
+				a := newSharded(Limits{}, routes, shards)
+				stop := background(a, "out", users, readers)
+				defer stop()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					n := i % len(msgs)
+					a.Add(msgs[n], users[n])
+				}
+			})
+		}
+	}
+}
+
+func benchMessages(topics, partitions, users int) ([]kafka.Message, []string) {
+	n := topics * partitions * 100
+	msgs := make([]kafka.Message, n)
+	uids := make([]string, n)
+	for i := range msgs {
+		msgs[i] = kafka.Message{
+			Topic:     fmt.Sprintf("topic-%d", i%topics),
+			Partition: i / topics % partitions,
+			Offset:    int64(i),
+			Value:     []byte(`{"event":"view","item":"item-1"}`),
+		}
+		uids[i] = fmt.Sprintf("user-%d", i*31%users)
+	}
+	return msgs, uids
+}
+
+// background запускает drain раз в 10ms и readers горутин, читающих Pending по кругу
+func background(a *Aggregator, output string, users []string, readers int) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(10 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				a.DrainOutput(output)
+			}
+		}
+	}()
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i += readers {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				a.Pending(users[i%len(users)])
+			}
+		}(r)
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
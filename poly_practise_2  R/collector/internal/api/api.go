@@ -0,0 +1,207 @@
+package api
+
+import (
+	"collector/config"
+	"collector/internal/aggregator"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Server - HTTP API только для чтения: батчи пользователя, записанные redis-приёмником, и
+// состояние, накопленное агрегатором и ещё не отправленное. У collector нет окон: окна,
+// их список по времени и top по окну отдаёт API processor
+type Server struct {
+	srv    *http.Server
+	agg    *aggregator.Aggregator
+	rdb    *redis.Client // nil - redis-приёмника нет
+	prefix string
+	logger *zap.Logger
+}
+
+// New; /users/{uid} регистрируется, только если среди sinks есть redis: читать больше негде
+func New(cfg *config.HttpServer, agg *aggregator.Aggregator, sinks []config.SinkConfig, redisCfg *config.RedisConfig, logger *zap.Logger) *Server {
+	s := &Server{agg: agg, logger: logger}
+
+	mux := http.NewServeMux()
+	for _, sc := range sinks {
+		if sc.Type == "redis" {
+			s.rdb = redis.NewClient(&redis.Options{
+				Addr:     redisCfg.Addr,
+				Password: redisCfg.Password,
+				DB:       redisCfg.DB,
+			})
+			s.prefix = sc.KeyPrefix
+			mux.HandleFunc("GET /api/v1/users/{uid}", s.handleUser)
+			break
+		}
+	}
+	mux.HandleFunc("GET /api/v1/pending/users/{uid}", s.handlePending)
+	mux.HandleFunc("GET /api/v1/pending/top", s.handleTop)
+
+	s.srv = &http.Server{
+		Addr:         cfg.Address,
+		Handler:      mux,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	return s
+}
+
+func (s *Server) Run() {
+	s.logger.Info("starting query API", zap.String("address", s.srv.Addr))
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("query API stopped", zap.Error(err))
+	}
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if s.rdb != nil {
+		if cerr := s.rdb.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type page struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// handleUser - сообщения пользователя из списка <key-prefix><uid> redis-приёмника, от старых
+// к новым; страница читается LRANGE, pending - сколько ещё ждёт отправки
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	uid := r.PathValue("uid")
+	key := s.prefix + uid
+
+	pipe := s.rdb.Pipeline()
+	total := pipe.LLen(r.Context(), key)
+	values := pipe.LRange(r.Context(), key, int64(offset), int64(offset+limit-1))
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := page{Offset: offset, Limit: limit, Total: int(total.Val())}
+	if next := offset + limit; next < p.Total {
+		p.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":    uid,
+		"items":   values.Val(),
+		"pending": len(s.agg.Pending(uid)),
+		"page":    p,
+	})
+}
+
+// handlePending - сообщения пользователя, ожидающие отправки
+func (s *Server) handlePending(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	uid := r.PathValue("uid")
+	items, p := paginate(s.agg.Pending(uid), offset, limit)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":  uid,
+		"items": items,
+		"page":  p,
+	})
+}
+
+// handleTop - пользователи по убыванию числа ожидающих отправки сообщений
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	type entry struct {
+		User  string `json:"user"`
+		Count int    `json:"count"`
+	}
+	counts := s.agg.PendingCounts()
+	entries := make([]entry, 0, len(counts))
+	for uid, n := range counts {
+		entries = append(entries, entry{User: uid, Count: n})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].User < entries[j].User
+	})
+
+	entries, p := paginate(entries, offset, limit)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"top":  entries,
+		"page": p,
+	})
+}
+
+func pagination(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	offset, limit := 0, defaultLimit
+	var err error
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad offset %q", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("bad limit %q", v)
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return offset, limit, nil
+}
+
+func paginate[T any](items []T, offset, limit int) ([]T, page) {
+	p := page{Offset: offset, Limit: limit, Total: len(items)}
+	if offset >= len(items) {
+		return []T{}, p
+	}
+	end := offset + limit
+	if end < len(items) {
+		p.NextOffset = &end
+	} else {
+		end = len(items)
+	}
+	return items[offset:end], p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -3,21 +3,28 @@ package app
 import (
 	"collector/config"
 	"collector/internal/aggregator"
+	"collector/internal/api"
 	"collector/internal/consumer"
 	"collector/internal/flusher"
-	"collector/internal/producer"
+	"collector/internal/retry"
+	"collector/internal/route"
+	"collector/internal/sink"
 	"collector/pkg/logging"
 	"collector/pkg/mymetrics"
 	"context"
+	"errors"
 	"go.uber.org/zap"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func MustRun(cfg *config.Config) {
 	logger, err := logging.NewLogger(*cfg.Logger)
 	if err != nil {
@@ -27,43 +34,158 @@ func MustRun(cfg *config.Config) {
 
 	rand.Seed(time.Now().UnixNano())
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	consumeCtx, stopConsuming := context.WithCancel(context.Background())
+	defer stopConsuming()
+	flushCtx, stopFlushers := context.WithCancel(context.Background())
+	defer stopFlushers()
 
 	go serveMetrics(logger)
 
-	agg := aggregator.New()
+	routes, err := route.New(cfg.Producer.Routes, cfg.Producer.Topics)
+	if err != nil {
+		logger.Fatal("failed to init routes", zap.Error(err))
+	}
+	if cfg.Filter != nil {
+		if err := routes.Check(cfg.Filter.Rules); err != nil {
+			logger.Fatal("failed to init routes", zap.Error(err))
+		}
+	}
+
+	agg := aggregator.New(aggregator.Limits{
+		Items: cfg.Producer.MaxItems,
+		Keys:  cfg.Producer.MaxKeys,
+		Bytes: cfg.Producer.MaxBytes,
+	}, routes)
+
+	var queryAPI *api.Server
+	if cfg.HTTPServer.Address != "" {
+		queryAPI = api.New(cfg.HTTPServer, agg, cfg.Producer.Sinks, cfg.Redis, logger)
+		go queryAPI.Run()
+	}
 
 	cons, err := consumer.New(cfg, logger)
 	if err != nil {
 		logger.Fatal("failed to init consumer", zap.Error(err))
 	}
-	defer func() {
-		if err := cons.Close(); err != nil {
-			logger.Error("failed to close consumer", zap.Error(err))
-		}
-	}()
-	msgCh := cons.StartConsuming(ctx)
-	go aggregator.StartAggregatorLoop(ctx, msgCh, agg)
 
-	prod, err := producer.New(cfg.Producer, logger)
+	sinks, err := sink.NewFanout(cfg.Producer.Sinks, cfg.Producer, cfg.Redis, logger)
+	if err != nil {
+		logger.Fatal("failed to init sinks", zap.Error(err))
+	}
+
+	retries, err := retry.Open(cfg.Producer.Retry, cfg.Producer.Brokers, logger)
 	if err != nil {
-		logger.Fatal("failed to init producer", zap.Error(err))
+		logger.Fatal("failed to open retry queue", zap.Error(err))
 	}
-	defer func() {
-		if err := prod.Close(); err != nil {
-			logger.Error("failed to close producer", zap.Error(err))
+
+	flushers := make([]*flusher.Flusher, 0, len(routes.Outputs()))
+	for _, topic := range routes.Outputs() {
+		flushers = append(flushers, flusher.New(agg, logger, sinks, cons, cfg.Producer.FlushSec, topic,
+			cfg.Producer.SendAttempts, retries))
+	}
+
+	cons.OnRevoke(func(ctx context.Context, partitions map[string][]int) map[string]map[int]int64 {
+		if err := agg.Sync(ctx); err != nil {
+			logger.Error("aggregator sync before revoke failed", zap.Error(err))
+		}
+		offsets := make(map[string]map[int]int64)
+		for _, f := range flushers {
+			for topic, parts := range f.FlushPartitions(ctx, partitions) {
+				if offsets[topic] == nil {
+					offsets[topic] = make(map[int]int64)
+				}
+				for p, off := range parts {
+					offsets[topic][p] = off
+				}
+			}
 		}
+		return offsets
+	})
+
+	msgCh := cons.StartConsuming(consumeCtx)
+	aggDone := make(chan struct{})
+	go func() {
+		defer close(aggDone)
+		aggregator.StartAggregatorLoop(msgCh, agg)
 	}()
 
-	for _, topic := range cfg.Producer.Topics {
-		flush := flusher.New(agg, logger, prod, cfg.Producer.FlushSec, topic)
-		go flush.Run(ctx)
+	var flushWg sync.WaitGroup
+	for _, f := range flushers {
+		flushWg.Add(1)
+		go func(f *flusher.Flusher) {
+			defer flushWg.Done()
+			f.Run(flushCtx)
+		}(f)
 	}
 
 	waitForSignal(logger)
-	cancel()
-	logger.Info("Shutdown complete")
+
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	started := time.Now()
+
+	if queryAPI != nil {
+		shutdownPhase(logger, "stop query API", func() error {
+			return queryAPI.Shutdown(shutdownCtx)
+		})
+	}
+	shutdownPhase(logger, "stop flushers", func() error {
+		stopFlushers()
+		return waitGroup(shutdownCtx, &flushWg)
+	})
+	// отзыв партиций внутри консьюмера сам делает Sync, flush и commit по ним
+	shutdownPhase(logger, "stop fetching", func() error {
+		stopConsuming()
+		return waitChan(shutdownCtx, cons.Done())
+	})
+	shutdownPhase(logger, "drain channels", func() error {
+		return waitChan(shutdownCtx, aggDone)
+	})
+	shutdownPhase(logger, "final flush and commit", func() error {
+		var errs []error
+		for _, f := range flushers {
+			if err := f.Flush(shutdownCtx, aggregator.ReasonShutdown); err != nil && !errors.Is(err, consumer.ErrNoGeneration) {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+	shutdownPhase(logger, "close consumer", cons.Close)
+	shutdownPhase(logger, "close retry queue", retries.Close)
+	shutdownPhase(logger, "close sinks", sinks.Close)
+
+	logger.Info("Shutdown complete", zap.Duration("took", time.Since(started)))
+}
+
+func shutdownPhase(logger *zap.Logger, name string, fn func() error) {
+	started := time.Now()
+	if err := fn(); err != nil {
+		logger.Error("shutdown phase failed", zap.String("phase", name), zap.Duration("took", time.Since(started)), zap.Error(err))
+		return
+	}
+	logger.Info("shutdown phase complete", zap.String("phase", name), zap.Duration("took", time.Since(started)))
+}
+
+func waitChan(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return waitChan(ctx, done)
 }
 
 func serveMetrics(logger *zap.Logger) {
@@ -2,96 +2,363 @@ package consumer
 
 import (
 	"collector/config"
+	"collector/pkg/mymetrics"
 	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
+	"shared/dedup"
+	"shared/filter"
+	"shared/startpos"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const defaultRevokeTimeout = 10 * time.Second
+
+// пауза после ошибки чтения или вступления в группу: удваивается до maxReadBackoff, чтобы
+// при недоступном брокере цикл не крутил ядро и не заваливал лог
+const (
+	readBackoff    = 100 * time.Millisecond
+	maxReadBackoff = 5 * time.Second
+)
+
+// ErrNoGeneration - коммит вне поколения группы: партиции уже отозваны
+var ErrNoGeneration = errors.New("no active consumer group generation")
+
+// RevokeFunc сбрасывает состояние отзываемых партиций и возвращает оффсеты для коммита
+type RevokeFunc func(ctx context.Context, partitions map[string][]int) map[string]map[int]int64
+
+// Consumer - один участник группы на все топики; читает по горутине на каждую
+// назначенную партицию, так что параллелизм определяется числом партиций
 type Consumer struct {
-	cfg     *config.KafkaConfig
-	readers map[string][]*kafka.Reader // много ридеров не хорошо наверное лучше запускать консюмеры
-	logger  *zap.Logger
+	cfg    *config.KafkaConfig
+	group  *kafka.ConsumerGroup
+	start  *startpos.Starter
+	filter *filter.Filter
+	dedup  *dedup.Deduper
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	gen      *kafka.Generation
+	assigned map[string][]int
+	onRevoke RevokeFunc
+
+	done chan struct{}
+
+	messagesRead uint64
+	revokedAt    time.Time
 }
 
 func New(cfg *config.Config, logger *zap.Logger) (*Consumer, error) {
-	cons := &Consumer{
-		cfg:     cfg.Kafka,
-		readers: make(map[string][]*kafka.Reader),
-		logger:  logger,
-	}
-
-	for _, topic := range cfg.Kafka.Topics {
-		for i := 0; i < cfg.Kafka.ReaderInstance; i++ {
-			r := kafka.NewReader(kafka.ReaderConfig{
-				Brokers:  cfg.Kafka.Brokers,
-				GroupID:  cfg.Kafka.GroupID,
-				Topic:    topic,
-				MinBytes: 10e3,
-				MaxBytes: 10e6,
-			})
-			cons.readers[topic] = append(cons.readers[topic], r)
+	// сброс оффсетов - до вступления в группу, пока она пуста
+	start := startpos.New(&kafka.Client{Addr: kafka.TCP(cfg.Kafka.Brokers...)}, cfg.Kafka.Start, logger)
+	switch from := cfg.Kafka.Start.From; {
+	case cfg.Kafka.Start.Reset:
+		// явно запрошенный сброс не должен молча превращаться в чтение с закоммиченных оффсетов
+		if err := start.Reset(context.Background(), cfg.Kafka.GroupID, cfg.Kafka.Topics); err != nil {
+			return nil, fmt.Errorf("reset offsets of group %s: %w", cfg.Kafka.GroupID, err)
 		}
+	case from != "" && from != startpos.Committed:
+		logger.Warn("start position applies only to partitions without committed offsets, use reset to rewind the group",
+			zap.String("group", cfg.Kafka.GroupID), zap.String("from", from))
+	}
+	// после сброса дедупликация начинает новую эпоху ключей: перечитанное - не повторы
+	d := dedup.New(cfg.Dedup, dedupRedis(cfg), logger)
+	if err := d.Open(context.Background(), cfg.Kafka.GroupID, cfg.Kafka.Start.Reset); err != nil {
+		_ = d.Close()
+		return nil, fmt.Errorf("init dedup: %w", err)
+	}
+
+	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:               cfg.Kafka.GroupID,
+		Brokers:          cfg.Kafka.Brokers,
+		Topics:           cfg.Kafka.Topics,
+		SessionTimeout:   cfg.Kafka.SessionTimeout,
+		RebalanceTimeout: cfg.Kafka.RebalanceTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create consumer group: %w", err)
 	}
-	return cons, nil
+
+	f, err := filter.New(cfg.Filter, mymetrics.RuleHits)
+	if err != nil {
+		return nil, fmt.Errorf("init filter rules: %w", err)
+	}
+
+	return &Consumer{
+		cfg:    cfg.Kafka,
+		group:  group,
+		start:  start,
+		filter: f,
+		dedup:  d,
+		logger: logger,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// dedupRedis - клиент для дедупликации в Redis, nil без redis в её конфиге
+func dedupRedis(cfg *config.Config) redis.UniversalClient {
+	if !cfg.Dedup.UsesRedis() || cfg.Redis == nil {
+		return nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+}
+
+// OnRevoke задаёт обработчик отзыва партиций, вызывать до StartConsuming
+func (c *Consumer) OnRevoke(fn RevokeFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRevoke = fn
 }
 
 func (c *Consumer) StartConsuming(ctx context.Context) <-chan kafka.Message {
 	msgCh := make(chan kafka.Message, c.cfg.BufferChannelSize)
 
-	var wg sync.WaitGroup
-	var messagesRead uint64
-
-	for topic, readers := range c.readers {
-		for _, r := range readers {
-			wg.Add(1)
-			go func(topic string, rd *kafka.Reader) {
-				defer wg.Done()
-				for {
-					msg, err := rd.ReadMessage(ctx)
-					if err != nil {
-						if err == context.Canceled || ctx.Err() != nil {
-							c.logger.Info("stopping consumer for topic", zap.String("topic", topic))
-							return
-						}
-						c.logger.Error("failed to read message", zap.String("topic", topic), zap.Error(err))
-						continue
-					}
-
-					if n := atomic.AddUint64(&messagesRead, 1); n%100 == 0 {
-						c.logger.Info("consumer is active",
-							zap.Uint64("messages_read_total", n),
-							zap.String("topic", topic),
-						)
-					}
-
-					select {
-					case msgCh <- msg:
-					case <-ctx.Done():
-						return
-					}
+	go func() {
+		defer close(c.done)
+		defer close(msgCh)
+		backoff := readBackoff
+		for {
+			gen, err := c.group.Next(ctx)
+			if err != nil {
+				if errors.Is(err, kafka.ErrGroupClosed) || ctx.Err() != nil {
+					c.logger.Info("stopping consumer group", zap.String("group", c.cfg.GroupID))
+					return
+				}
+				c.logger.Error("failed to join consumer group",
+					zap.String("group", c.cfg.GroupID), zap.Duration("backoff", backoff), zap.Error(err))
+				mymetrics.Rebalances.WithLabelValues("failed").Inc()
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
 				}
-			}(topic, r)
+				backoff = min(backoff*2, maxReadBackoff)
+				continue
+			}
+			backoff = readBackoff
+			c.runGeneration(ctx, gen, msgCh)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return msgCh
+}
+
+// Done закрывается, когда чтение остановлено, а отозванные партиции сброшены и закоммичены
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// runGeneration читает назначенные партиции, пока не закончится поколение или ctx,
+// затем отдаёт их состояние в onRevoke и коммитит оффсеты в рамках этого же поколения
+func (c *Consumer) runGeneration(ctx context.Context, gen *kafka.Generation, msgCh chan<- kafka.Message) {
+	assigned := make(map[string][]int, len(gen.Assignments))
+	total := 0
+	for topic, assignments := range gen.Assignments {
+		for _, a := range assignments {
+			assigned[topic] = append(assigned[topic], a.ID)
+			total++
 		}
+		mymetrics.AssignedPartitions.WithLabelValues(topic).Set(float64(len(assignments)))
 	}
 
-	go func() {
+	c.mu.Lock()
+	c.gen = gen
+	c.assigned = assigned
+	if !c.revokedAt.IsZero() {
+		mymetrics.RebalanceDuration.WithLabelValues("rebalance").Observe(time.Since(c.revokedAt).Seconds())
+	}
+	c.mu.Unlock()
+
+	mymetrics.Rebalances.WithLabelValues("assigned").Inc()
+	c.logger.Info("partitions assigned",
+		zap.Int32("generation", gen.ID),
+		zap.String("member", gen.MemberID),
+		zap.Int("partitions", total),
+	)
+
+	assignments := c.start.Apply(ctx, gen)
+
+	done := make(chan struct{})
+	gen.Start(func(genCtx context.Context) {
+		defer close(done)
+
+		fetchCtx, cancel := context.WithCancel(genCtx)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		var wg sync.WaitGroup
+		for topic, as := range assignments {
+			for _, a := range as {
+				wg.Add(1)
+				go func(topic string, a kafka.PartitionAssignment) {
+					defer wg.Done()
+					c.fetch(fetchCtx, topic, a, msgCh)
+				}(topic, a)
+			}
+		}
+
+		<-fetchCtx.Done()
 		wg.Wait()
-		close(msgCh)
+		c.revoke(gen, assigned)
+	})
+	<-done
+}
+
+func (c *Consumer) revoke(gen *kafka.Generation, assigned map[string][]int) {
+	started := time.Now()
+
+	c.mu.Lock()
+	onRevoke := c.onRevoke
+	c.revokedAt = started
+	c.mu.Unlock()
+
+	timeout := c.cfg.RevokeTimeout
+	if timeout <= 0 {
+		timeout = defaultRevokeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if onRevoke != nil {
+		offsets := onRevoke(ctx, assigned)
+		if err := gen.CommitOffsets(offsets); err != nil {
+			c.logger.Error("failed to commit offsets on revoke", zap.Int32("generation", gen.ID), zap.Error(err))
+			mymetrics.Rebalances.WithLabelValues("commit_failed").Inc()
+		} else {
+			c.dedup.Commit(ctx, offsets)
+		}
+	}
+
+	c.mu.Lock()
+	c.gen = nil
+	c.assigned = nil
+	c.mu.Unlock()
+	mymetrics.AssignedPartitions.Reset()
+
+	mymetrics.Rebalances.WithLabelValues("revoked").Inc()
+	mymetrics.RebalanceDuration.WithLabelValues("revoke").Observe(time.Since(started).Seconds())
+	c.logger.Info("partitions revoked",
+		zap.Int32("generation", gen.ID),
+		zap.Duration("took", time.Since(started)),
+	)
+}
+
+func (c *Consumer) fetch(ctx context.Context, topic string, a kafka.PartitionAssignment, msgCh chan<- kafka.Message) {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   c.cfg.Brokers,
+		Topic:     topic,
+		Partition: a.ID,
+		MinBytes:  10e3,
+		MaxBytes:  10e6,
+	})
+	defer func() {
+		if err := r.Close(); err != nil {
+			c.logger.Error("failed to close kafka reader", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+		}
 	}()
-	return msgCh
+
+	if err := r.SetOffset(a.Offset); err != nil {
+		c.logger.Error("failed to set offset", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+		return
+	}
+
+	backoff := readBackoff
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.logger.Info("stopping consumer for partition", zap.String("topic", topic), zap.Int("partition", a.ID))
+				return
+			}
+			c.logger.Error("failed to read message",
+				zap.String("topic", topic), zap.Int("partition", a.ID), zap.Duration("backoff", backoff), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxReadBackoff)
+			continue
+		}
+		backoff = readBackoff
+
+		if n := atomic.AddUint64(&c.messagesRead, 1); n%100 == 0 {
+			c.logger.Info("consumer is active",
+				zap.Uint64("messages_read_total", n),
+				zap.String("topic", topic),
+			)
+		}
+
+		if !c.filter.Apply(&msg) {
+			continue
+		}
+		if c.dedup != nil && c.dedup.Duplicate(ctx, msg) {
+			mymetrics.DuplicatesDropped.WithLabelValues(topic).Inc()
+			continue
+		}
+
+		select {
+		case msgCh <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (c *Consumer) Close() error {
-	for topic, readers := range c.readers {
-		for _, r := range readers {
-			if err := r.Close(); err != nil {
-				c.logger.Error("failed to close kafka reader", zap.String("topic", topic), zap.Error(err))
-			} else {
-				c.logger.Info("kafka reader closed", zap.String("topic", topic))
+// CommitOffsets коммитит оффсеты текущего поколения; партиции, которые уже
+// не назначены этому участнику, пропускаются - их закоммитил revoke
+func (c *Consumer) CommitOffsets(offsets map[string]map[int]int64) error {
+	c.mu.Lock()
+	gen, assigned := c.gen, c.assigned
+	c.mu.Unlock()
+
+	if len(offsets) == 0 {
+		return nil
+	}
+	if gen == nil {
+		return ErrNoGeneration
+	}
+
+	owned := make(map[string]map[int]int64, len(offsets))
+	for topic, partitions := range offsets {
+		for _, p := range assigned[topic] {
+			if off, ok := partitions[p]; ok {
+				if owned[topic] == nil {
+					owned[topic] = make(map[int]int64)
+				}
+				owned[topic][p] = off
 			}
 		}
 	}
+	if err := gen.CommitOffsets(owned); err != nil {
+		return err
+	}
+	c.dedup.Commit(context.Background(), owned)
+	return nil
+}
+
+func (c *Consumer) Close() error {
+	if c.dedup != nil {
+		if err := c.dedup.Close(); err != nil {
+			c.logger.Error("failed to close dedup redis client", zap.Error(err))
+		}
+	}
+	if err := c.group.Close(); err != nil {
+		c.logger.Error("failed to close consumer group", zap.String("group", c.cfg.GroupID), zap.Error(err))
+		return err
+	}
+	c.logger.Info("consumer group closed", zap.String("group", c.cfg.GroupID))
 	return nil
 }
@@ -2,45 +2,52 @@ package flusher
 
 import (
 	"collector/internal/aggregator"
+	"collector/internal/retry"
 	"collector/pkg/mymetrics"
 	"context"
 	"go.uber.org/zap"
+	"shared/envelope"
 	"time"
 )
 
-// ..
+// Sender отправляет весь батч flush в выходной топик flusher'а и возвращает
+// ошибки только по тем пользователям, которые не записались
 type Sender interface {
-	Send(ctx context.Context, userID string, items []string) error
+	Send(ctx context.Context, topic string, batch envelope.Batch) map[string]error
 }
 
+// Committer коммитит оффсеты, которые покрывает отправленный батч
+type Committer interface {
+	CommitOffsets(offsets map[string]map[int]int64) error
+}
+
+// Flusher сбрасывает состояние входных топиков, которые таблица маршрутов ведёт в его выходной топик
 type Flusher struct {
 	agg       *aggregator.Aggregator
 	log       *zap.Logger
 	sender    Sender
+	committer Committer
 	interval  time.Duration
 	topicName string
+	attempts  int          // попыток отправки на пользователя за один flush
+	retries   *retry.Queue // неотправленное за attempts попыток ждёт следующих циклов здесь
 }
 
-func New(agg *aggregator.Aggregator, log *zap.Logger, sender Sender,
-	interval time.Duration, topic string) *Flusher {
+func New(agg *aggregator.Aggregator, log *zap.Logger, sender Sender, committer Committer,
+	interval time.Duration, topic string, attempts int, retries *retry.Queue) *Flusher {
 
 	return &Flusher{
 		agg:       agg,
 		log:       log,
 		sender:    sender,
+		committer: committer,
 		interval:  interval,
 		topicName: topic,
+		attempts:  attempts,
+		retries:   retries,
 	}
 }
 
-func countMessagesInBatch(data map[string][]string) float64 {
-	var total float64
-	for _, items := range data {
-		total += float64(len(items))
-	}
-	return total
-}
-
 func (f *Flusher) Run(ctx context.Context) {
 	ticker := time.NewTicker(f.interval)
 	defer ticker.Stop()
@@ -48,34 +55,101 @@ func (f *Flusher) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			f.log.Info("Flusher context cancelled, flushing before exit")
-			f.flush(ctx)
+			// финальный flush делает app.MustRun со своим контекстом: этот уже отменён
+			f.log.Info("Flusher context cancelled, stopping", zap.String("topic", f.topicName))
 			return
 		case <-ticker.C:
-			f.flush(ctx)
+			if err := f.Flush(ctx, aggregator.ReasonInterval); err != nil {
+				f.log.Error("offset commit failed", zap.String("topic", f.topicName), zap.Error(err))
+			}
+		case reason := <-f.agg.FlushRequests(f.topicName):
+			if err := f.Flush(ctx, reason); err != nil {
+				f.log.Error("offset commit failed", zap.String("topic", f.topicName), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush отправляет накопленное состояние своего выходного топика, коммитит покрытые им оффсеты
+// и повторяет созревшие записи очереди повторов; reason попадает в метрику collector_flushes_total.
+// Оффсеты коммитятся и при ошибке отправки: неотправленное уже лежит в очереди на диске
+func (f *Flusher) Flush(ctx context.Context, reason string) error {
+	batch := f.agg.DrainOutput(f.topicName)
+	f.send(ctx, batch, reason)
+	err := f.committer.CommitOffsets(batch.Offsets)
+	f.retries.Retry(ctx, f.topicName, f.sendOnce(f.topicName))
+	return err
+}
+
+// sendOnce - одна попытка отправки в topic, в том числе для очереди повторов
+func (f *Flusher) sendOnce(topic string) func(ctx context.Context, batch envelope.Batch) map[string]error {
+	return func(ctx context.Context, batch envelope.Batch) map[string]error {
+		failed := f.sender.Send(ctx, topic, batch)
+		for uid, items := range batch.Users {
+			if _, ok := failed[uid]; !ok {
+				mymetrics.MessagesConsumed.WithLabelValues(topic).Add(float64(len(items)))
+			}
 		}
+		return failed
+	}
+}
+
+// FlushPartitions отправляет состояние отзываемых партиций своего выходного топика и возвращает оффсеты,
+// которые нужно закоммитить до передачи партиций другому участнику группы
+func (f *Flusher) FlushPartitions(ctx context.Context, partitions map[string][]int) map[string]map[int]int64 {
+	batch := f.agg.DrainPartitions(f.topicName, partitions)
+	f.send(ctx, batch, aggregator.ReasonRevoke)
+	return batch.Offsets
+}
+
+// send отправляет сообщения своего выходного топика и переназначенные правилом route в их топики;
+// неотправленное встаёт в очередь повторов топика, куда шло, и его повторяет flusher того топика
+func (f *Flusher) send(ctx context.Context, batch aggregator.Batch, reason string) {
+	f.sendTo(ctx, f.topicName, envelope.Batch{Start: batch.Start, End: batch.End, Users: batch.Items}, reason)
+	for topic, users := range batch.Routed {
+		f.sendTo(ctx, topic, envelope.Batch{Start: batch.Start, End: batch.End, Users: users}, reason)
 	}
 }
 
-func (f *Flusher) flush(ctx context.Context) {
-	data := f.agg.DrainAndReset(f.topicName)
-	totalMessagesInBatch := countMessagesInBatch(data)
-	totalUsers := len(data)
+func (f *Flusher) sendTo(ctx context.Context, topic string, pending envelope.Batch, reason string) {
+	totalMessagesInBatch := float64(pending.Items())
+	totalUsers := len(pending.Users)
+	mymetrics.QueueSize.WithLabelValues("aggregated_batch").Set(totalMessagesInBatch)
+	if totalUsers == 0 {
+		f.log.Debug("Empty batch, nothing to flush", zap.String("topic", topic), zap.String("reason", reason))
+		return
+	}
+	mymetrics.Flushes.WithLabelValues(topic, reason).Inc()
 
 	f.log.Info("Batch flushed",
-		zap.String("topic", f.topicName),
+		zap.String("topic", topic),
 		zap.Int("user_count", totalUsers),
 		zap.Float64("total_messages", totalMessagesInBatch),
+		zap.String("reason", reason),
 	)
 
-	mymetrics.QueueSize.WithLabelValues("aggregated_batch").Set(totalMessagesInBatch)
-
-	for uid, items := range data {
-		if err := f.sender.Send(ctx, uid, items); err != nil {
-			f.log.Error("send failed", zap.String("uid", uid), zap.Error(err))
-			mymetrics.MessagesFailed.WithLabelValues(f.topicName, "send_error").Add(float64(len(items)))
-			continue
+	// повторяются только пользователи, которых не принял приёмник, а не весь батч
+	sendOnce := f.sendOnce(topic)
+	for attempt := 1; len(pending.Users) > 0; attempt++ {
+		failed := sendOnce(ctx, pending)
+		if len(failed) == 0 {
+			return
 		}
-		mymetrics.MessagesConsumed.WithLabelValues(f.topicName).Add(float64(len(items)))
+		if attempt >= f.attempts || ctx.Err() != nil {
+			f.log.Warn("send failed, queued for retry",
+				zap.String("topic", topic),
+				zap.Int("failed_users", len(failed)),
+				zap.Int("attempts", attempt),
+			)
+			f.retries.Add(ctx, topic, pending, failed)
+			return
+		}
+
+		f.log.Warn("send partially failed, retrying",
+			zap.String("topic", topic),
+			zap.Int("failed_users", len(failed)),
+			zap.Int("attempt", attempt),
+		)
+		pending = pending.Subset(failed)
 	}
 }
@@ -4,70 +4,265 @@ import (
 	"collector/config"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
-	"math/rand"
+	"shared/envelope"
+	"strconv"
 	"sync/atomic"
 )
 
+// Формат сообщения в заголовках content_type и version, processor выбирает по ним декодер.
+// По умолчанию пишется конверт (envelope), голый массив - только с format: batch
+const (
+	FormatEnvelope = "envelope"
+	FormatBatch    = "batch"
+
+	batchContentType = "application/vnd.collector.batch+json"
+	batchStrings     = "1" // ["{...}", ...] - события JSON-строками
+	batchObjects     = "2" // [{...}, ...] - события как есть, разбираются за один проход
+)
+
+// Стратегии выбора выходного топика (topic-strategy). Внутри топика партиция выбирается
+// хешем ключа (ID пользователя), так что агрегаты пользователя всегда в одной партиции
+const (
+	TopicRoute       = "route"        // топик flusher'а по таблице маршрутов
+	TopicUserHash    = "user-hash"    // топик по хешу ID пользователя
+	TopicContentType = "content-type" // топик по content_type сообщения из content-type-topics
+)
+
+// content_type задаётся форматом (format), а он один на конфиг, поэтому content-type выбирает
+// один топик на весь продюсер, а не на сообщение: стратегия нужна, чтобы развести по топикам
+// деплойменты collector с разными форматами через одну общую таблицу content-type-topics
+
 type Producer struct {
 	cfg      *config.ProducerConfig
 	writers  []*kafka.Writer
+	byTopic  map[string]*kafka.Writer
+	byType   *kafka.Writer // content-type: единственный топик для формата продюсера, nil - как route
 	log      *zap.Logger
 	counters map[string]*int64
 }
 
 func New(cfg *config.ProducerConfig, logger *zap.Logger) (*Producer, error) {
+	switch cfg.Format {
+	case FormatEnvelope, FormatBatch:
+	default:
+		return nil, fmt.Errorf("unknown producer format %q", cfg.Format)
+	}
+	switch cfg.EnvelopeItems {
+	case envelope.ItemsPayload, envelope.ItemsReference:
+	default:
+		return nil, fmt.Errorf("unknown envelope items mode %q", cfg.EnvelopeItems)
+	}
+	switch cfg.TopicStrategy {
+	case TopicRoute, TopicUserHash, TopicContentType:
+	default:
+		return nil, fmt.Errorf("unknown topic strategy %q", cfg.TopicStrategy)
+	}
+	if len(cfg.Topics) == 0 {
+		return nil, fmt.Errorf("no producer topics")
+	}
+
 	ws := make([]*kafka.Writer, len(cfg.Topics))
+	byTopic := make(map[string]*kafka.Writer, len(cfg.Topics))
 	counters := make(map[string]*int64)
 	for i, t := range cfg.Topics {
 		ws[i] = &kafka.Writer{
 			Addr:     kafka.TCP(cfg.Brokers...),
 			Topic:    t,
-			Balancer: &kafka.LeastBytes{},
+			Balancer: &kafka.Hash{}, // партиция по ключу - ID пользователя
+			// WriteMessages ждёт, пока соберётся BatchSize или пройдёт BatchTimeout,
+			// поэтому таймаут должен быть коротким: куски flush и так крупные
+			BatchSize:    cfg.SendBatchSize,
+			BatchTimeout: cfg.SendBatchTimeout,
 		}
+		byTopic[t] = ws[i]
 
 		var zero int64
 		counters[t] = &zero
 	}
+
+	var byType *kafka.Writer
+	if cfg.TopicStrategy == TopicContentType {
+		for ct, t := range cfg.ContentTypeTopics {
+			if byTopic[t] == nil {
+				return nil, fmt.Errorf("content type %q: topic %q is not in producer topics", ct, t)
+			}
+		}
+		if t, ok := cfg.ContentTypeTopics[contentType(cfg.Format)]; ok {
+			byType = byTopic[t]
+		}
+	}
 	return &Producer{
 		cfg:      cfg,
 		writers:  ws,
+		byTopic:  byTopic,
+		byType:   byType,
 		log:      logger,
 		counters: counters,
 	}, nil
 }
 
-func (p *Producer) Send(ctx context.Context, userID string, items []string) error {
+// writer выбирает топик пользователя по topic-strategy. Выбор зависит только от uid и
+// конфига, поэтому повтор из очереди попадает туда же, куда первая попытка. Топик маршрута,
+// которого нет среди топиков продюсера (у приёмника kafka свои topics), заменяется хешем uid
+func (p *Producer) writer(topic, uid string) *kafka.Writer {
+	switch p.cfg.TopicStrategy {
+	case TopicUserHash:
+		return p.hashWriter(uid)
+	case TopicContentType:
+		if p.byType != nil {
+			return p.byType
+		}
+	}
+	if w, ok := p.byTopic[topic]; ok {
+		return w
+	}
+	return p.hashWriter(uid)
+}
 
-	topicIdx := rand.Intn(len(p.writers))
+// hashWriter выбирает топик хешем xxhash, а не fnv-1a, которым kafka.Hash выбирает партицию:
+// с одним хешем при одинаковом числе топиков и партиций пользователи топика попадали бы
+// только в часть его партиций
+func (p *Producer) hashWriter(uid string) *kafka.Writer {
+	return p.writers[xxhash.Sum64String(uid)%uint64(len(p.writers))]
+}
 
-	value, err := json.Marshal(items)
-	if err != nil {
-		p.log.Error("failed to marshal items", zap.String("userID", userID), zap.Error(err))
-		return err
+// Send пишет батч кусками по send-batch-size сообщений: один WriteMessages на кусок,
+// а не на пользователя. kafka.WriteErrors раскладывается по сообщениям, поэтому повторять
+// придётся только пользователей, которых брокер не принял. topic - топик по таблице маршрутов,
+// куда пишется каждый пользователь, решает topic-strategy
+func (p *Producer) Send(ctx context.Context, topic string, batch envelope.Batch) map[string]error {
+	type pending struct {
+		uids []string
+		msgs []kafka.Message
+	}
+	failed := make(map[string]error)
+	byWriter := make(map[*kafka.Writer]*pending)
+	for uid, items := range batch.Users {
+		msg, err := p.message(uid, batch, items)
+		if err != nil {
+			p.log.Error("failed to marshal items", zap.String("userID", uid), zap.Error(err))
+			failed[uid] = err
+			continue
+		}
+		w := p.writer(topic, uid)
+		pw := byWriter[w]
+		if pw == nil {
+			pw = &pending{}
+			byWriter[w] = pw
+		}
+		pw.uids = append(pw.uids, uid)
+		pw.msgs = append(pw.msgs, msg)
 	}
 
-	msg := kafka.Message{
-		Key:   []byte(userID),
-		Value: value,
+	for w, pw := range byWriter {
+		p.write(ctx, w, pw.uids, pw.msgs, failed)
+	}
+	if len(failed) > 0 {
+		p.log.Error("failed to write messages",
+			zap.String("topic", topic),
+			zap.Int("failed", len(failed)),
+			zap.Int("total", len(batch.Users)),
+		)
+	}
+	return failed
+}
+
+// write отправляет сообщения одного топика, ошибки складываются в failed по uid
+func (p *Producer) write(ctx context.Context, w *kafka.Writer, uids []string, msgs []kafka.Message, failed map[string]error) {
+	var sent int64
+	for start := 0; start < len(msgs); start += p.cfg.SendBatchSize {
+		end := min(start+p.cfg.SendBatchSize, len(msgs))
+		err := w.WriteMessages(ctx, msgs[start:end]...)
+		var werrs kafka.WriteErrors
+		switch {
+		case err == nil:
+			sent += int64(end - start)
+		case errors.As(err, &werrs):
+			for i, e := range werrs {
+				if e != nil {
+					failed[uids[start+i]] = e
+				} else {
+					sent++
+				}
+			}
+		default:
+			for i := start; i < end; i++ {
+				failed[uids[i]] = err
+			}
+		}
 	}
 
-	err = p.writers[topicIdx].WriteMessages(ctx, msg)
+	count := atomic.AddInt64(p.counters[w.Topic], sent)
+	if count/100 != (count-sent)/100 {
+		p.log.Info("sent 100 messages", zap.String("topic", w.Topic), zap.Int64("total_sent", count))
+	}
+}
+
+// message кодирует батч пользователя; trace_id входных сообщений переносятся заголовками
+// trace_id (по одному на каждый различный), чтобы трассировка шла через collector, а время
+// последнего события - заголовком timestamp
+func (p *Producer) message(uid string, batch envelope.Batch, items []envelope.Item) (kafka.Message, error) {
+	var (
+		value   []byte
+		version string
+		err     error
+	)
+	if p.cfg.Format == FormatBatch {
+		value, version, err = encodeBatch(envelope.Values(items))
+	} else {
+		version = strconv.Itoa(envelope.Version)
+		value, err = json.Marshal(envelope.New(uid, batch.Start, batch.End, items, p.cfg.EnvelopeItems))
+	}
 	if err != nil {
-		p.log.Error("failed to write message",
-			zap.String("userID", userID),
-			zap.String("topic", p.writers[topicIdx].Topic),
-			zap.Error(err),
-		)
-		return err
+		return kafka.Message{}, err
 	}
 
-	count := atomic.AddInt64(p.counters[p.writers[topicIdx].Topic], 1)
-	if count%100 == 0 {
-		p.log.Info("sent 100 messages", zap.String("topic", p.writers[topicIdx].Topic), zap.Int64("total_sent", count))
+	headers := []kafka.Header{
+		{Key: "content_type", Value: []byte(contentType(p.cfg.Format))},
+		{Key: "version", Value: []byte(version)},
 	}
-	return nil
+	if h, ok := envelope.TimestampHeader(items); ok {
+		headers = append(headers, h)
+	}
+	for _, id := range envelope.TraceIDs(items) {
+		headers = append(headers, kafka.Header{Key: "trace_id", Value: []byte(id)})
+	}
+	return kafka.Message{Key: []byte(uid), Value: value, Headers: headers}, nil
+}
+
+func contentType(format string) string {
+	if format == FormatBatch {
+		return batchContentType
+	}
+	return envelope.ContentType
+}
+
+// encodeBatch склеивает события в JSON-массив без перекодирования; если хоть одно событие
+// не JSON, батч уходит в старом формате массива строк
+func encodeBatch(items []string) ([]byte, string, error) {
+	size := 2
+	for _, item := range items {
+		if !json.Valid([]byte(item)) {
+			value, err := json.Marshal(items)
+			return value, batchStrings, err
+		}
+		size += len(item) + 1
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, '[')
+	for i, item := range items {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, item...)
+	}
+	return append(buf, ']'), batchObjects, nil
 }
 
 func (p *Producer) Close() error {
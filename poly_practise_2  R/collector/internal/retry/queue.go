@@ -0,0 +1,298 @@
+package retry
+
+import (
+	"collector/config"
+	"collector/pkg/mymetrics"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"shared/envelope"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// причины отправки в dead-letter топик
+const (
+	ReasonExhausted = "exhausted"  // кончились попытки
+	ReasonQueueFull = "queue_full" // очередь переполнена
+)
+
+// Entry - батч пользователя, который приёмники не приняли за send-attempts попыток flush
+type Entry struct {
+	Topic    string          `json:"topic"`
+	UserID   string          `json:"user_id"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Items    []envelope.Item `json:"items"`
+	Attempts int             `json:"attempts"` // циклов отправки, которые закончились ошибкой
+	NextAt   time.Time       `json:"next_at"`
+	Error    string          `json:"error"`
+
+	inflight bool // сейчас отправляется, Retry другого flusher'а его не берёт
+	done     bool
+}
+
+// Queue - ограниченная очередь повторов в памяти, копия которой лежит в файле: после рестарта
+// неотправленное не теряется, хотя его оффсеты уже закоммичены. Записи повторяются на следующих
+// циклах flush с экспоненциальной задержкой; исчерпавшие попытки и не поместившиеся уходят
+// в dead-letter топик. Без него (или если запись в него не удалась) батч выбрасывается и
+// теряется насовсем: его оффсеты уже закоммичены, и из входного топика он не перечитается
+type Queue struct {
+	cfg *config.RetryConfig
+	dlq *kafka.Writer // nil - dead-letter топик не задан, такие батчи теряются вместе с оффсетами
+	log *zap.Logger
+
+	mu      sync.Mutex
+	entries []*Entry
+}
+
+func Open(cfg *config.RetryConfig, brokers []string, logger *zap.Logger) (*Queue, error) {
+	q := &Queue{cfg: cfg, log: logger}
+	if cfg.DeadLetterTopic != "" {
+		q.dlq = &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    cfg.DeadLetterTopic,
+			Balancer: &kafka.Hash{},
+		}
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read retry queue: %w", err)
+	default:
+		if err := json.Unmarshal(data, &q.entries); err != nil {
+			return nil, fmt.Errorf("decode retry queue %s: %w", cfg.Path, err)
+		}
+		if len(q.entries) > 0 {
+			logger.Info("Retry queue restored", zap.Int("entries", len(q.entries)))
+		}
+	}
+	q.updateDepth()
+	return q, nil
+}
+
+// Add ставит в очередь пользователей батча, которых не приняли приёмники
+func (q *Queue) Add(ctx context.Context, topic string, batch envelope.Batch, failed map[string]error) {
+	if len(failed) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var full, exhausted []*Entry
+	q.mu.Lock()
+	for uid, err := range failed {
+		e := &Entry{
+			Topic:    topic,
+			UserID:   uid,
+			Start:    batch.Start,
+			End:      batch.End,
+			Items:    batch.Users[uid],
+			Attempts: 1,
+			NextAt:   now.Add(q.backoff(1)),
+			Error:    err.Error(),
+		}
+		if len(q.entries) >= q.cfg.MaxEntries {
+			full = append(full, e)
+			continue
+		}
+		if e.Attempts >= q.cfg.MaxAttempts {
+			exhausted = append(exhausted, e)
+			continue
+		}
+		q.entries = append(q.entries, e)
+	}
+	q.saveLocked()
+	q.mu.Unlock()
+
+	q.updateDepth()
+	q.deadLetter(ctx, full, ReasonQueueFull)
+	q.deadLetter(ctx, exhausted, ReasonExhausted)
+}
+
+// Retry повторяет созревшие записи топика: по вызову send на окно flush, так что батч
+// повтора - тот же батч, только из неотправленных пользователей
+func (q *Queue) Retry(ctx context.Context, topic string, send func(context.Context, envelope.Batch) map[string]error) {
+	now := time.Now()
+	q.mu.Lock()
+	type window struct{ start, end time.Time }
+	due := make(map[window][]*Entry)
+	for _, e := range q.entries {
+		if e.Topic == topic && !e.inflight && !e.NextAt.After(now) {
+			e.inflight = true
+			w := window{e.Start, e.End}
+			due[w] = append(due[w], e)
+		}
+	}
+	q.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	// записи меняются только под q.mu: параллельный Add другого flusher'а сохраняет очередь в файл
+	results := make(map[*Entry]error)
+	for w, entries := range due {
+		batch := envelope.Batch{Start: w.start, End: w.end, Users: make(map[string][]envelope.Item, len(entries))}
+		for _, e := range entries {
+			batch.Users[e.UserID] = e.Items
+		}
+		failed := send(ctx, batch)
+		for _, e := range entries {
+			results[e] = failed[e.UserID]
+		}
+	}
+
+	var exhausted []*Entry
+	q.mu.Lock()
+	for e, err := range results {
+		if err == nil {
+			mymetrics.RetryAttempts.WithLabelValues(topic, "ok").Inc()
+			e.done = true
+			continue
+		}
+		mymetrics.RetryAttempts.WithLabelValues(topic, "error").Inc()
+		e.Attempts++
+		e.Error = err.Error()
+		e.NextAt = now.Add(q.backoff(e.Attempts))
+		if e.Attempts >= q.cfg.MaxAttempts {
+			e.done = true
+			exhausted = append(exhausted, e)
+		}
+	}
+	kept := q.entries[:0]
+	for _, e := range q.entries {
+		if !e.done {
+			e.inflight = false
+			kept = append(kept, e)
+		}
+	}
+	clear(q.entries[len(kept):])
+	q.entries = kept
+	q.saveLocked()
+	q.mu.Unlock()
+
+	q.updateDepth()
+	q.deadLetter(ctx, exhausted, ReasonExhausted)
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.cfg.Backoff
+	for i := 1; i < attempts && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, q.cfg.MaxBackoff)
+}
+
+// deadLetter пишет конверты с причиной и последней ошибкой в заголовках dlq_*; без
+// dead-letter топика батчи только логируются - оффсеты закоммичены, данные потеряны
+func (q *Queue) deadLetter(ctx context.Context, entries []*Entry, reason string) {
+	if len(entries) == 0 {
+		return
+	}
+	if q.dlq == nil {
+		for _, e := range entries {
+			q.log.Error("send failed, batch dropped",
+				zap.String("topic", e.Topic), zap.String("uid", e.UserID), zap.String("reason", reason), zap.String("error", e.Error))
+			mymetrics.MessagesFailed.WithLabelValues(e.Topic, "send_error").Add(float64(len(e.Items)))
+		}
+		return
+	}
+
+	msgs := make([]kafka.Message, 0, len(entries))
+	for _, e := range entries {
+		value, err := json.Marshal(envelope.New(e.UserID, e.Start, e.End, e.Items, envelope.ItemsPayload))
+		if err != nil {
+			q.log.Error("failed to encode dead letter", zap.String("uid", e.UserID), zap.Error(err))
+			continue
+		}
+		headers := []kafka.Header{
+			{Key: "content_type", Value: []byte(envelope.ContentType)},
+			{Key: "version", Value: []byte(strconv.Itoa(envelope.Version))},
+			{Key: "output_topic", Value: []byte(e.Topic)},
+			{Key: "dlq_reason", Value: []byte(reason)},
+			{Key: "dlq_error", Value: []byte(e.Error)},
+			{Key: "dlq_attempts", Value: []byte(strconv.Itoa(e.Attempts))},
+		}
+		if h, ok := envelope.TimestampHeader(e.Items); ok {
+			headers = append(headers, h)
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(e.UserID), Value: value, Headers: headers})
+	}
+	if err := q.dlq.WriteMessages(ctx, msgs...); err != nil {
+		q.log.Error("dead-letter write failed, batches dropped",
+			zap.String("dlq", q.dlq.Topic), zap.Int("users", len(msgs)), zap.Error(err))
+		for _, e := range entries {
+			mymetrics.MessagesFailed.WithLabelValues(e.Topic, "dead_letter_failed").Add(float64(len(e.Items)))
+		}
+		return
+	}
+	for _, e := range entries {
+		mymetrics.DeadLettered.WithLabelValues(e.Topic, reason).Add(float64(len(e.Items)))
+	}
+	q.log.Warn("batches sent to dead-letter topic",
+		zap.String("dlq", q.dlq.Topic), zap.Int("users", len(msgs)), zap.String("reason", reason))
+}
+
+func (q *Queue) updateDepth() {
+	q.mu.Lock()
+	depth := make(map[string]int)
+	for _, e := range q.entries {
+		depth[e.Topic]++
+	}
+	q.mu.Unlock()
+	mymetrics.RetryQueueDepth.Reset()
+	for topic, n := range depth {
+		mymetrics.RetryQueueDepth.WithLabelValues(topic).Set(float64(n))
+	}
+}
+
+// saveLocked переписывает файл очереди через временный файл, чтобы не оставить его обрезанным;
+// записи в отправке тоже сохраняются: при падении посреди повтора они повторятся ещё раз
+func (q *Queue) saveLocked() {
+	if err := q.writeFile(); err != nil {
+		q.log.Error("failed to persist retry queue", zap.String("path", q.cfg.Path), zap.Error(err))
+	}
+}
+
+func (q *Queue) writeFile() error {
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.cfg.Path), filepath.Base(q.cfg.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.cfg.Path)
+}
+
+// Close сохраняет очередь; то, что не успело повториться, повторится после рестарта
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	err := q.writeFile()
+	q.mu.Unlock()
+	if q.dlq != nil {
+		err = errors.Join(err, q.dlq.Close())
+	}
+	return err
+}
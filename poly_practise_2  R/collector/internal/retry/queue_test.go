@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"collector/config"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"path/filepath"
+	"shared/envelope"
+	"testing"
+	"time"
+)
+
+func openQueue(t *testing.T, cfg config.RetryConfig) *Queue {
+	t.Helper()
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(t.TempDir(), "retry.json")
+	}
+	q, err := Open(&cfg, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func failedBatch(users ...string) (envelope.Batch, map[string]error) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	batch := envelope.Batch{Start: start, End: start.Add(time.Minute), Users: make(map[string][]envelope.Item)}
+	failed := make(map[string]error, len(users))
+	for _, uid := range users {
+		batch.Users[uid] = []envelope.Item{{Value: `{"item_id":1}`, Topic: "in", Offset: 7, Time: start}}
+		failed[uid] = errors.New("sink down")
+	}
+	return batch, failed
+}
+
+func TestQueueReload(t *testing.T) {
+	cfg := config.RetryConfig{MaxEntries: 10, MaxAttempts: 5, Backoff: time.Hour, MaxBackoff: time.Hour,
+		Path: filepath.Join(t.TempDir(), "retry.json")}
+	q := openQueue(t, cfg)
+	batch, failed := failedBatch("u1", "u2")
+	q.Add(context.Background(), "out", batch, failed)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openQueue(t, cfg)
+	if got := len(reopened.entries); got != 2 {
+		t.Fatalf("reloaded %d entries, want 2", got)
+	}
+	for _, e := range reopened.entries {
+		if e.Topic != "out" || e.Attempts != 1 || e.Error != "sink down" || !e.Start.Equal(batch.Start) ||
+			len(e.Items) != 1 || e.Items[0].Offset != 7 {
+			t.Errorf("reloaded entry = %+v", e)
+		}
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		sendErr      error
+		wantEntries  int
+		wantAttempts int
+	}{
+		{"sent", 5, nil, 0, 0},
+		{"failed again", 5, errors.New("still down"), 1, 2},
+		{"attempts exhausted", 2, errors.New("still down"), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.RetryConfig{MaxEntries: 10, MaxAttempts: tt.maxAttempts, MaxBackoff: time.Hour,
+				Path: filepath.Join(t.TempDir(), "retry.json")}
+			q := openQueue(t, cfg) // без backoff записи созревают сразу
+			batch, failed := failedBatch("u1")
+			q.Add(context.Background(), "out", batch, failed)
+
+			q.Retry(context.Background(), "other", func(context.Context, envelope.Batch) map[string]error {
+				t.Error("entries of another topic retried")
+				return nil
+			})
+			var sent envelope.Batch
+			q.Retry(context.Background(), "out", func(_ context.Context, b envelope.Batch) map[string]error {
+				sent = b
+				if tt.sendErr != nil {
+					return map[string]error{"u1": tt.sendErr}
+				}
+				return nil
+			})
+			if !sent.Start.Equal(batch.Start) || len(sent.Users["u1"]) != 1 {
+				t.Errorf("retried batch = %+v, want the original window of u1", sent)
+			}
+
+			// состояние после повтора должно пережить рестарт
+			reopened := openQueue(t, cfg)
+			if got := len(reopened.entries); got != tt.wantEntries {
+				t.Fatalf("%d entries after retry, want %d", got, tt.wantEntries)
+			}
+			if tt.wantEntries > 0 && reopened.entries[0].Attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", reopened.entries[0].Attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := openQueue(t, config.RetryConfig{MaxEntries: 1, MaxAttempts: 5, Backoff: time.Hour, MaxBackoff: time.Hour})
+	batch, failed := failedBatch("u1", "u2", "u3")
+	q.Add(context.Background(), "out", batch, failed)
+	if got := len(q.entries); got != 1 {
+		t.Errorf("queue holds %d entries, want MaxEntries = 1", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{cfg: &config.RetryConfig{Backoff: time.Second, MaxBackoff: 10 * time.Second}}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{30, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := q.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package route
+
+import (
+	"collector/config"
+	"fmt"
+	"path"
+	"shared/filter"
+	"sync"
+)
+
+// Table сопоставляет входной топик выходному по producer.routes: побеждает первое правило,
+// чей шаблон input (path.Match) подходит; топики без правила идут в первый из producer.topics.
+// Flusher выбирается по входному топику, а не по сообщению, чтобы все сообщения партиции
+// уходили одним flusher'ом и её оффсет коммитился один раз. Сообщения, которым правило route
+// фильтра задало полосу или топик, этот же flusher отправляет в их топик (Target)
+type Table struct {
+	routes  []config.RouteConfig
+	outputs []string
+
+	mu    sync.RWMutex
+	cache map[string]string
+}
+
+func New(routes []config.RouteConfig, outputs []string) (*Table, error) {
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no output topics")
+	}
+	known := make(map[string]bool, len(outputs))
+	for _, o := range outputs {
+		known[o] = true
+	}
+	for i, r := range routes {
+		if _, err := path.Match(r.Input, ""); err != nil {
+			return nil, fmt.Errorf("route #%d: input: %w", i, err)
+		}
+		if !known[r.Output] {
+			return nil, fmt.Errorf("route #%d: output %q is not in producer topics", i, r.Output)
+		}
+	}
+	return &Table{routes: routes, outputs: outputs, cache: make(map[string]string)}, nil
+}
+
+// Output - выходной топик для сообщений входного топика input
+func (t *Table) Output(input string) string {
+	t.mu.RLock()
+	out, ok := t.cache[input]
+	t.mu.RUnlock()
+	if ok {
+		return out
+	}
+
+	out = t.outputs[0]
+	for _, r := range t.routes {
+		if r.Lane != "" {
+			continue
+		}
+		if ok, _ := path.Match(r.Input, input); ok {
+			out = r.Output
+			break
+		}
+	}
+	t.mu.Lock()
+	t.cache[input] = out
+	t.mu.Unlock()
+	return out
+}
+
+// Target - выходной топик сообщения по заголовкам правила route фильтра: output_topic, если
+// задан, иначе первое правило с полосой сообщения, иначе топик входного (Output)
+func (t *Table) Target(input, lane, topic string) string {
+	if topic != "" && t.known(topic) {
+		return topic
+	}
+	if lane != "" {
+		for _, r := range t.routes {
+			if r.Lane != lane {
+				continue
+			}
+			if ok, _ := path.Match(r.Input, input); ok {
+				return r.Output
+			}
+		}
+	}
+	return t.Output(input)
+}
+
+// Check проверяет, что правила route фильтра ведут в выходные топики продюсера
+func (t *Table) Check(rules []filter.Rule) error {
+	for _, r := range rules {
+		if r.Action == filter.ActionRoute && r.Topic != "" && !t.known(r.Topic) {
+			return fmt.Errorf("filter rule %q: topic %q is not in producer topics", r.Name, r.Topic)
+		}
+	}
+	return nil
+}
+
+func (t *Table) known(topic string) bool {
+	for _, o := range t.outputs {
+		if o == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Outputs - все выходные топики, по flusher'у на каждый
+func (t *Table) Outputs() []string {
+	return t.outputs
+}
@@ -0,0 +1,108 @@
+package route
+
+import (
+	"collector/config"
+	"shared/filter"
+	"strings"
+	"testing"
+)
+
+func newTable(t *testing.T) *Table {
+	t.Helper()
+	table, err := New([]config.RouteConfig{
+		{Input: "orders.*", Output: "out.orders"},
+		{Input: "orders.eu", Output: "out.eu"}, // перекрыто правилом выше
+		{Input: "*", Lane: "vip", Output: "out.vip"},
+		{Input: "clicks", Lane: "bulk", Output: "out.bulk"},
+	}, []string{"out.default", "out.orders", "out.eu", "out.vip", "out.bulk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestOutput(t *testing.T) {
+	table := newTable(t)
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"orders.us", "out.orders"},
+		{"orders.eu", "out.orders"}, // побеждает первое правило
+		{"orders", "out.default"},
+		{"clicks", "out.default"}, // правила с полосой не меняют топик входа
+	}
+	for _, tt := range tests {
+		for i := 0; i < 2; i++ { // второй раз - из кеша
+			if got := table.Output(tt.input); got != tt.want {
+				t.Errorf("Output(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	table := newTable(t)
+	tests := []struct {
+		name               string
+		input, lane, topic string
+		want               string
+	}{
+		{"no headers", "orders.us", "", "", "out.orders"},
+		{"explicit topic", "orders.us", "vip", "out.eu", "out.eu"},
+		{"unknown topic falls back to lane", "orders.us", "vip", "nowhere", "out.vip"},
+		{"lane rule", "clicks", "bulk", "", "out.bulk"},
+		{"lane rule for another input", "orders.us", "bulk", "", "out.orders"},
+		{"unknown lane", "clicks", "gold", "", "out.default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := table.Target(tt.input, tt.lane, tt.topic); got != tt.want {
+				t.Errorf("Target(%q, %q, %q) = %q, want %q", tt.input, tt.lane, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []config.RouteConfig
+		outputs []string
+		err     string
+	}{
+		{"no outputs", nil, nil, "no output topics"},
+		{"bad pattern", []config.RouteConfig{{Input: "[", Output: "out"}}, []string{"out"}, "input"},
+		{"unknown output", []config.RouteConfig{{Input: "*", Output: "other"}}, []string{"out"}, "not in producer topics"},
+		{"valid", []config.RouteConfig{{Input: "*", Output: "out"}}, []string{"out"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.routes, tt.outputs)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("New() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("New() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	table := newTable(t)
+	tests := []struct {
+		rule    filter.Rule
+		wantErr bool
+	}{
+		{filter.Rule{Name: "to known", Action: filter.ActionRoute, Topic: "out.vip"}, false},
+		{filter.Rule{Name: "lane only", Action: filter.ActionRoute, Lane: "vip"}, false},
+		{filter.Rule{Name: "to unknown", Action: filter.ActionRoute, Topic: "nowhere"}, true},
+		{filter.Rule{Name: "drop", Action: filter.ActionDrop, Topic: "nowhere"}, false},
+	}
+	for _, tt := range tests {
+		if err := table.Check([]filter.Rule{tt.rule}); (err != nil) != tt.wantErr {
+			t.Errorf("Check(%q) error = %v, want error %v", tt.rule.Name, err, tt.wantErr)
+		}
+	}
+}
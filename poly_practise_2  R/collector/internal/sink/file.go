@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"bufio"
+	"collector/config"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"shared/envelope"
+	"shared/sinkio"
+	"sync"
+	"time"
+)
+
+// line - строка архива: батч одного пользователя на момент flush
+type line struct {
+	Time   time.Time `json:"time"`
+	UserID string    `json:"user_id"`
+	Items  []string  `json:"items"`
+}
+
+// streamSink дописывает батчи построчно в JSONL или CSV (time, user_id, items как JSON-массив)
+type streamSink struct {
+	mu     sync.Mutex // flusher'ы разных топиков пишут в один приёмник
+	out    io.Writer
+	closer io.Closer // nil для stdout
+	format string
+	header bool // CSV: заголовок ещё не записан
+}
+
+// newFileSink открывает файл только на дозапись, архив переживает рестарты
+func newFileSink(cfg *config.SinkConfig) (*streamSink, error) {
+	f, header, err := sinkio.OpenAppend(cfg.Path, cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	return &streamSink{out: f, closer: f, format: cfg.Format, header: header}, nil
+}
+
+func newStdoutSink(cfg *config.SinkConfig) (*streamSink, error) {
+	if err := sinkio.CheckFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+	return &streamSink{out: os.Stdout, format: cfg.Format, header: true}, nil
+}
+
+func (s *streamSink) Send(_ context.Context, _ string, batch envelope.Batch) map[string]error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	buf := bufio.NewWriter(s.out)
+	enc := json.NewEncoder(buf)
+	cw := csv.NewWriter(buf)
+	if s.format == FormatCSV && s.header {
+		_ = cw.Write([]string{"time", "user_id", "items"})
+	}
+
+	failed := make(map[string]error)
+	for uid, batchItems := range batch.Users {
+		items := envelope.Values(batchItems)
+		if s.format == FormatJSONL {
+			if err := enc.Encode(line{Time: now, UserID: uid, Items: items}); err != nil {
+				failed[uid] = fmt.Errorf("encode batch: %w", err)
+			}
+			continue
+		}
+		data, err := json.Marshal(items)
+		if err != nil {
+			failed[uid] = fmt.Errorf("encode items: %w", err)
+			continue
+		}
+		_ = cw.Write([]string{now.Format(time.RFC3339Nano), uid, string(data)})
+	}
+	cw.Flush()
+	err := cw.Error()
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		// неизвестно, какие строки дошли до файла: повтор всего батча лучше потери
+		return failAll(batch, err)
+	}
+	if s.format == FormatCSV {
+		s.header = false
+	}
+	return failed
+}
+
+func (s *streamSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
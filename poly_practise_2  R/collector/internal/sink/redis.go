@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"collector/config"
+	"context"
+	"github.com/go-redis/redis/v8"
+	"shared/envelope"
+)
+
+// redisSink дописывает батч в список <key-prefix><uid>; TTL продлевается на каждой записи.
+// Весь flush уходит одним пайплайном, ошибка команды относится к её пользователю
+type redisSink struct {
+	rdb *redis.Client
+	cfg *config.SinkConfig
+}
+
+func newRedisSink(cfg *config.SinkConfig, redisCfg *config.RedisConfig) *redisSink {
+	return &redisSink{
+		cfg: cfg,
+		rdb: redis.NewClient(&redis.Options{
+			Addr:     redisCfg.Addr,
+			Password: redisCfg.Password,
+			DB:       redisCfg.DB,
+		}),
+	}
+}
+
+func (s *redisSink) Send(ctx context.Context, _ string, batch envelope.Batch) map[string]error {
+	pipe := s.rdb.Pipeline()
+	pushes := make(map[string]*redis.IntCmd, len(batch.Users))
+	for uid, items := range batch.Users {
+		key := s.cfg.KeyPrefix + uid
+		args := make([]interface{}, len(items))
+		for i, item := range items {
+			args[i] = item.Value
+		}
+		pushes[uid] = pipe.RPush(ctx, key, args...)
+		if s.cfg.TTL > 0 {
+			pipe.Expire(ctx, key, s.cfg.TTL)
+		}
+	}
+	_, _ = pipe.Exec(ctx) // ошибки разбираются по командам ниже
+
+	failed := make(map[string]error)
+	for uid, cmd := range pushes {
+		if err := cmd.Err(); err != nil {
+			failed[uid] = err
+		}
+	}
+	return failed
+}
+
+func (s *redisSink) Close() error {
+	return s.rdb.Close()
+}
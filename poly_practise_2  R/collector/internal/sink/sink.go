@@ -0,0 +1,160 @@
+package sink
+
+import (
+	"collector/config"
+	"collector/internal/producer"
+	"collector/pkg/mymetrics"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"shared/envelope"
+	"shared/sinkio"
+	"sync"
+	"time"
+)
+
+const (
+	TypeRedis  = "redis"
+	TypeKafka  = "kafka"
+	TypeFile   = "file"
+	TypeStdout = "stdout"
+	TypeSQL    = "sql"
+
+	FormatJSONL = sinkio.FormatJSONL
+	FormatCSV   = sinkio.FormatCSV
+)
+
+// Sink - приёмник батча flush; сигнатура Send совпадает с flusher.Sender.
+// Результат - ошибки по пользователям, которых приёмник не принял; остальные записаны.
+// topic - выходной топик по таблице маршрутов, kafka пишет в него, остальные приёмники его не используют
+type Sink interface {
+	Send(ctx context.Context, topic string, batch envelope.Batch) map[string]error
+	Close() error
+}
+
+func New(cfg *config.SinkConfig, prodCfg *config.ProducerConfig, redisCfg *config.RedisConfig, logger *zap.Logger) (Sink, error) {
+	switch cfg.Type {
+	case TypeKafka:
+		pc := *prodCfg
+		if len(cfg.Topics) > 0 {
+			pc.Topics = cfg.Topics
+		}
+		return producer.New(&pc, logger)
+	case TypeRedis:
+		return newRedisSink(cfg, redisCfg), nil
+	case TypeFile:
+		return newFileSink(cfg)
+	case TypeStdout:
+		return newStdoutSink(cfg)
+	case TypeSQL:
+		return newSQLSink(cfg)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+type target struct {
+	name     string
+	sink     Sink
+	required bool
+	timeout  time.Duration
+}
+
+// Fanout отправляет батч во все приёмники параллельно. Ошибка приёмника логируется и попадает
+// в метрику; наружу возвращаются только ошибки приёмников с required. Коммит они не держат:
+// flusher коммитит оффсеты после каждого flush, а отказанные батчи ставит в очередь повторов
+type Fanout struct {
+	targets []target
+	logger  *zap.Logger
+}
+
+func NewFanout(cfgs []config.SinkConfig, prodCfg *config.ProducerConfig, redisCfg *config.RedisConfig,
+	logger *zap.Logger) (*Fanout, error) {
+	f := &Fanout{logger: logger}
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		s, err := New(cfg, prodCfg, redisCfg, logger)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("sink %q: %w", cfg.Name, err)
+		}
+		f.targets = append(f.targets, target{name: cfg.Name, sink: s, required: cfg.Required, timeout: cfg.Timeout})
+	}
+	return f, nil
+}
+
+// Send возвращает пользователей, которых не принял хотя бы один required приёмник. Повтор
+// такого пользователя уходит во все приёмники снова, поэтому они должны терпеть дубликаты
+func (f *Fanout) Send(ctx context.Context, topic string, batch envelope.Batch) map[string]error {
+	if len(batch.Users) == 0 {
+		return nil
+	}
+
+	results := make([]map[string]error, len(f.targets))
+	var wg sync.WaitGroup
+	for i, t := range f.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = f.send(ctx, t, topic, batch)
+		}()
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, t := range f.targets {
+		if !t.required {
+			continue
+		}
+		for uid, err := range results[i] {
+			failed[uid] = errors.Join(failed[uid], fmt.Errorf("sink %q: %w", t.name, err))
+		}
+	}
+	return failed
+}
+
+func (f *Fanout) send(ctx context.Context, t target, topic string, batch envelope.Batch) map[string]error {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	failed := t.sink.Send(ctx, topic, batch)
+	if n := len(failed); n > 0 {
+		var sample error
+		for _, err := range failed {
+			sample = err
+			break
+		}
+		mymetrics.SinkWrites.WithLabelValues(t.name, "error").Add(float64(n))
+		f.logger.Error("sink send failed",
+			zap.String("sink", t.name),
+			zap.Int("failed_users", n),
+			zap.Int("batch_users", len(batch.Users)),
+			zap.Bool("required", t.required),
+			zap.Error(sample),
+		)
+	}
+	mymetrics.SinkWrites.WithLabelValues(t.name, "ok").Add(float64(len(batch.Users) - len(failed)))
+	return failed
+}
+
+// failAll - результат приёмника, который не записал батч целиком
+func failAll(batch envelope.Batch, err error) map[string]error {
+	failed := make(map[string]error, len(batch.Users))
+	for uid := range batch.Users {
+		failed[uid] = err
+	}
+	return failed
+}
+
+func (f *Fanout) Close() error {
+	var errs []error
+	for _, t := range f.targets {
+		if err := t.sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close sink %q: %w", t.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
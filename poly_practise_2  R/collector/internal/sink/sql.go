@@ -0,0 +1,53 @@
+package sink
+
+import (
+	"collector/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"shared/envelope"
+	"shared/sinkio"
+	"time"
+)
+
+// sqlSink вставляет батч строкой в таблицу через database/sql (sinkio.Table).
+// Ожидаемая схема: CREATE TABLE batches (flushed_at TIMESTAMP, user_id TEXT, items TEXT).
+// Батч flush вставляется одной транзакцией, поэтому ошибка любой строки - ошибка всего батча
+type sqlSink struct {
+	table *sinkio.Table
+}
+
+func newSQLSink(cfg *config.SinkConfig) (*sqlSink, error) {
+	table, err := sinkio.OpenTable(cfg.Driver, cfg.DSN, cfg.Table, cfg.Placeholder, []string{"flushed_at", "user_id", "items"})
+	if err != nil {
+		return nil, err
+	}
+	return &sqlSink{table: table}, nil
+}
+
+func (s *sqlSink) Send(ctx context.Context, _ string, batch envelope.Batch) map[string]error {
+	if err := s.insertBatch(ctx, batch); err != nil {
+		return failAll(batch, err)
+	}
+	return nil
+}
+
+func (s *sqlSink) insertBatch(ctx context.Context, batch envelope.Batch) error {
+	now := time.Now().UTC()
+	return s.table.Insert(ctx, func(insert func(args ...interface{}) error) error {
+		for uid, items := range batch.Users {
+			data, err := json.Marshal(envelope.Values(items))
+			if err != nil {
+				return fmt.Errorf("encode items: %w", err)
+			}
+			if err := insert(now, uid, string(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlSink) Close() error {
+	return s.table.Close()
+}
@@ -50,6 +50,87 @@ var (
 		},
 		[]string{"stage"},
 	)
+
+	Flushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_flushes_total",
+			Help: "Total number of aggregator flushes by trigger",
+		},
+		[]string{"topic", "reason"},
+	)
+
+	SinkWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_writes_total",
+			Help: "Total number of user batches sent to each sink by result",
+		},
+		[]string{"sink", "result"},
+	)
+
+	RetryAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_retry_attempts_total",
+			Help: "Total number of retried user batches by result",
+		},
+		[]string{"topic", "result"},
+	)
+
+	RetryQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "collector_retry_queue_depth",
+			Help: "Number of user batches waiting in the retry queue",
+		},
+		[]string{"topic"},
+	)
+
+	DeadLettered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "collector_dead_lettered_messages_total",
+			Help: "Total number of messages written to the dead-letter topic",
+		},
+		[]string{"topic", "reason"},
+	)
+
+	AssignedPartitions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_assigned_partitions",
+			Help: "Number of partitions assigned to this consumer group member",
+		},
+		[]string{"topic"},
+	)
+
+	DuplicatesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dedup_duplicates_total",
+			Help: "Total number of redelivered messages dropped by deduplication",
+		},
+		[]string{"topic"},
+	)
+
+	RuleHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consumer_rule_hits_total",
+			Help: "Total number of messages matched by consumer filter rules",
+		},
+		[]string{"rule", "action"},
+	)
+
+	Rebalances = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kafka_rebalances_total",
+			Help: "Total number of consumer group rebalance events",
+		},
+		[]string{"event"},
+	)
+
+	RebalanceDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kafka_rebalance_duration_seconds",
+			Help:    "Duration of consumer group rebalance phases",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"phase"},
+	)
 )
 
 func Init() {
@@ -62,6 +143,16 @@ func Init() {
 	reg.MustRegister(InFlightMessages)
 	reg.MustRegister(KafkaConsumerLag)
 	reg.MustRegister(QueueSize)
+	reg.MustRegister(AssignedPartitions)
+	reg.MustRegister(RuleHits)
+	reg.MustRegister(DuplicatesDropped)
+	reg.MustRegister(Rebalances)
+	reg.MustRegister(RebalanceDuration)
+	reg.MustRegister(Flushes)
+	reg.MustRegister(SinkWrites)
+	reg.MustRegister(RetryAttempts)
+	reg.MustRegister(RetryQueueDepth)
+	reg.MustRegister(DeadLettered)
 }
 
 func Handler() http.Handler {
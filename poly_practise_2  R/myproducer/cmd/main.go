@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"log"
@@ -10,11 +11,15 @@ import (
 	"myproducer/internal/producer"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 //$env:KAFKA_BROKER = "localhost:29092"
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 
 	configPath := os.Getenv("CONFIG_PATH")
@@ -37,16 +42,48 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	for i := 0; i < cfg.Producer.ProducerInstance; i++ {
-		go func(instanceID int) {
-			prod := producer.New(*cfg.Producer, cfg.Producer.Brokers, logger.With(zap.Int("instance_id", instanceID)))
-			if err := prod.Run(ctx); err != nil {
+	var wg sync.WaitGroup
+	producers := make([]*producer.Producer, cfg.Producer.ProducerInstance)
+	for i := range producers {
+		producers[i] = producer.New(*cfg.Producer, cfg.Producer.Brokers, logger.With(zap.Int("instance_id", i)))
+		wg.Add(1)
+		go func(prod *producer.Producer) {
+			defer wg.Done()
+			if err := prod.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 				logger.Error("producer error", zap.Error(err))
 			}
-		}(i)
+		}(producers[i])
 	}
 
 	<-sigCh
 	fmt.Println("Shutdown signal received")
+
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.After(timeout)
+	started := time.Now()
+
 	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("shutdown phase complete", zap.String("phase", "stop producers"), zap.Duration("took", time.Since(started)))
+	case <-deadline:
+		logger.Error("shutdown phase timed out", zap.String("phase", "stop producers"), zap.Duration("took", time.Since(started)))
+	}
+
+	closeStarted := time.Now()
+	for _, prod := range producers {
+		if err := prod.Close(); err != nil {
+			logger.Error("failed to close producer", zap.Error(err))
+		}
+	}
+	logger.Info("shutdown phase complete", zap.String("phase", "close writers"), zap.Duration("took", time.Since(closeStarted)))
+	logger.Info("Shutdown complete", zap.Duration("took", time.Since(started)))
 }
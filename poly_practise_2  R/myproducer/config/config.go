@@ -3,11 +3,14 @@ package config
 import (
 	"gopkg.in/yaml.v3"
 	"os"
+	"time"
 )
 
 type Config struct {
 	Producer *ProducerConfig `yaml:"producer"`
 	Logger   *LoggerConfig   `yaml:"logging"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout" env-default:"30s"`
 }
 type ProducerConfig struct {
 	Brokers          []string `yaml:"brokers" env-required:"true"`
@@ -6,11 +6,13 @@ require (
 	github.com/segmentio/kafka-go v0.4.48
 	go.uber.org/zap v1.27.0
 	gopkg.in/yaml.v3 v3.0.1
+	shared v0.0.0
 )
 
 require (
-	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
-
 )
+
+replace shared => ../shared
@@ -6,6 +6,7 @@ import (
 	"github.com/segmentio/kafka-go"
 	"math/rand"
 	"myproducer/config"
+	"shared/event"
 	"time"
 )
 
@@ -47,11 +48,11 @@ func New(cfg *config.ProducerConfig) Generator {
 }
 
 func (g *DefaultGenerator) Event() kafka.Message {
-	event := g.randomEvent()
-	valueBytes, _ := json.Marshal(event)
+	ev := g.randomEvent()
+	valueBytes, _ := json.Marshal(ev)
 
 	return kafka.Message{
-		Key:   []byte(fmt.Sprintf("item-%d", event.ItemID)),
+		Key:   []byte(fmt.Sprintf("item-%d", ev.ItemID)),
 		Value: valueBytes,
 		Headers: []kafka.Header{
 			{Key: "auth_user_id", Value: []byte(g.randomUser())},
@@ -59,55 +60,18 @@ func (g *DefaultGenerator) Event() kafka.Message {
 			{Key: "trace_id", Value: []byte(g.randomTraceID())},
 			{Key: "timestamp", Value: []byte(time.Now().UTC().Format(time.RFC3339))},
 			{Key: "source", Value: []byte(g.randomSource())},
-			{Key: "category", Value: []byte(event.Category)},
-			{Key: "brand", Value: []byte(event.Brand)},
-			{Key: "currency", Value: []byte(event.Pricing.Currency)},
-			{Key: "environment", Value: []byte(event.Metadata.Environment)},
-			{Key: "version", Value: []byte(event.Metadata.Version)},
-			{Key: "batch_id", Value: []byte(event.Metadata.BatchID)},
+			{Key: "category", Value: []byte(ev.Category)},
+			{Key: "brand", Value: []byte(ev.Brand)},
+			{Key: "currency", Value: []byte(ev.Pricing.Currency)},
+			{Key: "environment", Value: []byte(ev.Metadata.Environment)},
+			{Key: "version", Value: []byte(ev.Metadata.Version)},
+			{Key: "batch_id", Value: []byte(ev.Metadata.BatchID)},
 			{Key: "content_type", Value: []byte("application/json")},
 			{Key: "encoding", Value: []byte("utf-8")},
 		},
 	}
 }
 
-type MyEvent struct {
-	ItemID      int     `json:"item_id"`
-	Price       float64 `json:"price"`
-	Name        string  `json:"name"`
-	Category    string  `json:"category"`
-	Description string  `json:"description"`
-	Brand       string  `json:"brand"`
-	SKU         string  `json:"sku"`
-	Weight      float64 `json:"weight"`
-	Dimensions  struct {
-		Length float64 `json:"length"`
-		Width  float64 `json:"width"`
-		Height float64 `json:"height"`
-	} `json:"dimensions"`
-	Tags       []string          `json:"tags"`
-	Attributes map[string]string `json:"attributes"`
-	CreatedAt  string            `json:"created_at"`
-	UpdatedAt  string            `json:"updated_at"`
-	Inventory  struct {
-		Quantity int    `json:"quantity"`
-		Location string `json:"location"`
-		Status   string `json:"status"`
-	} `json:"inventory"`
-	Pricing struct {
-		BasePrice    float64 `json:"base_price"`
-		SalePrice    float64 `json:"sale_price"`
-		Currency     string  `json:"currency"`
-		DiscountRate float64 `json:"discount_rate"`
-	} `json:"pricing"`
-	Metadata struct {
-		Source      string `json:"source"`
-		Version     string `json:"version"`
-		Environment string `json:"environment"`
-		BatchID     string `json:"batch_id"`
-	} `json:"metadata"`
-}
-
 func (g *DefaultGenerator) randomUser() string {
 	return g.userIDs[rand.Intn(len(g.userIDs))]
 }
@@ -124,7 +88,7 @@ func (g *DefaultGenerator) randomTraceID() string {
 	return fmt.Sprintf("trace-%d", rand.Int63())
 }
 
-func (g *DefaultGenerator) randomEvent() MyEvent {
+func (g *DefaultGenerator) randomEvent() event.Event {
 	basePrice := rand.Float64()*10000 + 100
 	discountRate := rand.Float64() * 0.3
 	salePrice := basePrice * (1 - discountRate)
@@ -144,7 +108,7 @@ func (g *DefaultGenerator) randomEvent() MyEvent {
 
 	now := time.Now().UTC()
 
-	return MyEvent{
+	return event.Event{
 		ItemID:      rand.Intn(100000),
 		Price:       basePrice,
 		Name:        fmt.Sprintf("Product-%d", rand.Intn(1000)),
@@ -153,11 +117,7 @@ func (g *DefaultGenerator) randomEvent() MyEvent {
 		Brand:       g.brands[rand.Intn(len(g.brands))],
 		SKU:         fmt.Sprintf("SKU-%d-%d", rand.Intn(1000), rand.Intn(1000)),
 		Weight:      rand.Float64()*10 + 0.1,
-		Dimensions: struct {
-			Length float64 `json:"length"`
-			Width  float64 `json:"width"`
-			Height float64 `json:"height"`
-		}{
+		Dimensions: event.Dimensions{
 			Length: rand.Float64()*100 + 1,
 			Width:  rand.Float64()*50 + 1,
 			Height: rand.Float64()*30 + 1,
@@ -166,32 +126,18 @@ func (g *DefaultGenerator) randomEvent() MyEvent {
 		Attributes: attributes,
 		CreatedAt:  now.Format(time.RFC3339),
 		UpdatedAt:  now.Format(time.RFC3339),
-		Inventory: struct {
-			Quantity int    `json:"quantity"`
-			Location string `json:"location"`
-			Status   string `json:"status"`
-		}{
+		Inventory: event.Inventory{
 			Quantity: rand.Intn(1000) + 1,
 			Location: g.locations[rand.Intn(len(g.locations))],
 			Status:   g.statuses[rand.Intn(len(g.statuses))],
 		},
-		Pricing: struct {
-			BasePrice    float64 `json:"base_price"`
-			SalePrice    float64 `json:"sale_price"`
-			Currency     string  `json:"currency"`
-			DiscountRate float64 `json:"discount_rate"`
-		}{
+		Pricing: event.Pricing{
 			BasePrice:    basePrice,
 			SalePrice:    salePrice,
 			Currency:     g.currencies[rand.Intn(len(g.currencies))],
 			DiscountRate: discountRate,
 		},
-		Metadata: struct {
-			Source      string `json:"source"`
-			Version     string `json:"version"`
-			Environment string `json:"environment"`
-			BatchID     string `json:"batch_id"`
-		}{
+		Metadata: event.Metadata{
 			Source:      g.sources[rand.Intn(len(g.sources))],
 			Version:     g.versions[rand.Intn(len(g.versions))],
 			Environment: g.environments[rand.Intn(len(g.environments))],
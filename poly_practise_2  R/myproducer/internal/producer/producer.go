@@ -2,6 +2,8 @@ package producer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"myproducer/config"
@@ -65,7 +67,8 @@ func (p *Producer) Run(ctx context.Context) error {
 
 				topicIdx := id % len(p.writers)
 				msg := p.gen.Event()
-				err := p.writers[topicIdx].WriteMessages(ctx, msg)
+				// уже начатую запись доводим до конца: ctx отменяется только приём новых сообщений
+				err := p.writers[topicIdx].WriteMessages(context.WithoutCancel(ctx), msg)
 				if err != nil {
 					p.logger.Warn("Kafka write failed",
 						zap.String("topic", p.writers[topicIdx].Topic),
@@ -85,3 +88,14 @@ func (p *Producer) Run(ctx context.Context) error {
 	p.logger.Info("Producer finished sending all messages")
 	return nil
 }
+
+// Close дожидается отправки буферизованных сообщений и закрывает writer'ы
+func (p *Producer) Close() error {
+	var errs []error
+	for _, w := range p.writers {
+		if err := w.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close writer %s: %w", w.Topic, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -5,6 +5,10 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"gopkg.in/yaml.v3"
 	"os"
+	"shared/dedup"
+	"shared/filter"
+	"shared/startpos"
+	"strings"
 	"time"
 )
 
@@ -14,6 +18,11 @@ type Config struct {
 	Kafka      *KafkaConfig      `yaml:"kafka"`
 	Aggregator *AggregatorConfig `yaml:"aggregator"`
 	Redis      *RedisConfig      `yaml:"redis"`
+	Filter     *FilterConfig     `yaml:"filter"`
+	Dedup      *DedupConfig      `yaml:"dedup"`
+	Checkpoint *CheckpointConfig `yaml:"checkpoint"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout" env-default:"30s"`
 }
 
 type HttpServer struct {
@@ -34,17 +43,159 @@ type KafkaConfig struct {
 	GroupID           string   `yaml:"groupid" env-required:"true"`
 	ClientID          string   `yaml:"clientid"`
 	WorkerCount       int      `yaml:"worker-count" env-default:"1"`
-	ReaderInstance    int      `yaml:"reader-instance" env-default:"2"`
 	BufferChannelSize int      `yaml:"buffer-channel-size" env-default:"100"`
+
+	CommitInterval time.Duration `yaml:"commit-interval" env-default:"1s"`
+
+	Start *StartConfig `yaml:"start"`
 }
 
+// StartConfig общий с collector: shared/startpos
+type StartConfig = startpos.Config
+
+const (
+	StartCommitted = startpos.Committed
+	StartEarliest  = startpos.Earliest
+	StartLatest    = startpos.Latest
+	StartOffset    = startpos.Offset
+	StartTimestamp = startpos.Timestamp
+)
+
+var ParseOffsets = startpos.ParseOffsets
+
 type AggregatorConfig struct {
 	AggregationWindow time.Duration `yaml:"aggregationwindow" env-default:"5s"` // Как часто сбрасывать агрегированные данные
+
+	Window       *WindowConfig       `yaml:"window"`
+	Aggregations []AggregationConfig `yaml:"aggregations"`
+	Sinks        []SinkConfig        `yaml:"sinks"` // по умолчанию - только redis
+
+	Instance string `yaml:"instance"` // имя реплики в ключах окон, по умолчанию hostname
 }
+
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts" env-default:"3"` // всего попыток, включая первую
+	Backoff    time.Duration `yaml:"backoff" env-default:"200ms"`
+	MaxBackoff time.Duration `yaml:"max-backoff" env-default:"2s"`
+}
+
+// BreakerConfig - после failures неудачных записей подряд приёмник не вызывается cooldown,
+// flush сразу уходят в WAL; с тем же периодом WAL воспроизводится в фоне
+type BreakerConfig struct {
+	Failures int           `yaml:"failures" env-default:"3"`
+	Cooldown time.Duration `yaml:"cooldown" env-default:"10s"`
+}
+
+// SinkConfig - приёмник результатов окон; все приёмники получают один и тот же flush параллельно
+type SinkConfig struct {
+	Name     string        `yaml:"name"`                      // для логов и метрик, по умолчанию type
+	Type     string        `yaml:"type"`                      // redis | kafka | file | stdout | sql
+	Required bool          `yaml:"required"`                  // ошибка приёмника считается ошибкой flush
+	Timeout  time.Duration `yaml:"timeout" env-default:"10s"` // на одну запись flush
+
+	Retry   RetryConfig   `yaml:"retry"`
+	Breaker BreakerConfig `yaml:"breaker"`
+	TTL     time.Duration `yaml:"ttl" env-default:"168h"` // redis: время жизни окон и индекса, < 0 - без TTL
+	WAL     string        `yaml:"wal"`                    // файл для flush, не записанных из-за ошибок; для redis по умолчанию processor.<name>.wal
+
+	Topic   string   `yaml:"topic"`   // kafka
+	Brokers []string `yaml:"brokers"` // kafka, по умолчанию kafka.brokers
+
+	Path   string `yaml:"path"`                       // file
+	Format string `yaml:"format" env-default:"jsonl"` // file, stdout: jsonl | csv
+
+	Driver      string `yaml:"driver"` // sql: имя драйвера database/sql
+	DSN         string `yaml:"dsn"`
+	Table       string `yaml:"table" env-default:"aggregates"`
+	Placeholder string `yaml:"placeholder" env-default:"?"` // sql: ? | $ (postgres)
+}
+
+// AggregationConfig - агрегация по окну: группировка по полям события и функции над полями.
+// Поля задаются путём в JSON события: brand, pricing.currency, inventory.quantity; "@key" - ключ сообщения
+type AggregationConfig struct {
+	Name      string           `yaml:"name"`
+	GroupBy   []string         `yaml:"group-by"`
+	Functions []FunctionConfig `yaml:"functions"`
+	Lanes     []string         `yaml:"lanes"` // только сообщения этих полос (заголовок lane правила route), пусто - все
+}
+
+type FunctionConfig struct {
+	Func     string `yaml:"func"` // count | sum | min | max | avg | last | distinct | topk
+	Field    string `yaml:"field"`
+	K        int    `yaml:"k" env-default:"10"`         // topk: сколько элементов выдавать
+	Capacity int    `yaml:"capacity" env-default:"100"` // topk: число счётчиков Space-Saving, не меньше k
+	Redis    bool   `yaml:"redis"`                      // distinct: PFMERGE в Redis, topk: ZINCRBY в Redis
+}
+
+// WindowConfig - окна событийного времени; закрытые watermark'ом окна сбрасываются раз в AggregationWindow
+type WindowConfig struct {
+	Type            string        `yaml:"type" env-default:"tumbling"` // tumbling | hopping | session
+	Size            time.Duration `yaml:"size"`                        // tumbling, hopping; по умолчанию AggregationWindow
+	Slide           time.Duration `yaml:"slide"`                       // hopping
+	Gap             time.Duration `yaml:"gap"`                         // session
+	AllowedLateness time.Duration `yaml:"allowed-lateness"`
+	TimeSource      string        `yaml:"time-source" env-default:"header"`    // header | kafka
+	TimeHeader      string        `yaml:"time-header" env-default:"timestamp"` // ставят myproducer и collector; нужен записям без своего updated_at, затем Kafka
+	LateTopic       string        `yaml:"late-topic"`                          // side output для опоздавших событий, пусто - только метрика
+	IdleTimeout     time.Duration `yaml:"idle-timeout" env-default:"1m"`       // партиция без событий дольше не сдерживает watermark
+	MaxFutureSkew   time.Duration `yaml:"max-future-skew" env-default:"1m"`    // событийное время дальше now+skew обрезается до него
+}
+
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
 type RedisConfig struct {
-	Addr     string `yaml:"address"`
-	Password string `yaml:"password"`
-	DB       int    `yaml:"db"`
+	Mode             string   `yaml:"mode" env-default:"standalone"` // standalone | sentinel | cluster
+	Addr             string   `yaml:"address"`                       // standalone
+	Addrs            []string `yaml:"addresses"`                     // sentinel: адреса sentinel, cluster: seed-узлы
+	MasterName       string   `yaml:"master-name"`                   // sentinel
+	SentinelPassword string   `yaml:"sentinel-password"`
+	Password         string   `yaml:"password"`
+	DB               int      `yaml:"db"` // в cluster есть только 0
+}
+
+func (c *RedisConfig) Validate() error {
+	switch c.Mode {
+	case RedisStandalone:
+		if c.Addr == "" {
+			return fmt.Errorf("standalone mode requires address")
+		}
+	case RedisSentinel:
+		if c.MasterName == "" || len(c.Addrs) == 0 {
+			return fmt.Errorf("sentinel mode requires master-name and addresses")
+		}
+	case RedisCluster:
+		if len(c.Addrs) == 0 {
+			return fmt.Errorf("cluster mode requires addresses")
+		}
+		if c.DB != 0 {
+			return fmt.Errorf("cluster mode supports only db 0")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	return nil
+}
+
+// FilterConfig и RuleConfig общие с collector: shared/filter
+type (
+	FilterConfig = filter.Config
+	RuleConfig   = filter.Rule
+)
+
+// DedupConfig общий с collector: shared/dedup
+type DedupConfig = dedup.Config
+
+// CheckpointConfig - периодический снапшот незакрытых окон вместе с оффсетами, которые он покрывает
+type CheckpointConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval" env-default:"30s"`
+	Store    string        `yaml:"store" env-default:"file"` // file | redis
+	Path     string        `yaml:"path" env-default:"processor.checkpoint.json"`
+	RedisKey string        `yaml:"redis-key" env-default:"processor:checkpoint"`
 }
 
 func Load(path string) (*Config, error) {
@@ -63,5 +214,124 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("read env: %w", err)
 	}
 
+	if cfg.Kafka.Start == nil {
+		cfg.Kafka.Start = &StartConfig{}
+	}
+	if err := cfg.Kafka.Start.Validate(); err != nil {
+		return nil, fmt.Errorf("kafka start: %w", err)
+	}
+
+	if cfg.Filter != nil {
+		for _, r := range cfg.Filter.Rules {
+			if r.Action == filter.ActionRoute && r.Topic != "" {
+				return nil, fmt.Errorf("filter rule %q: processor has no output topics, route by lane", r.Name)
+			}
+		}
+	}
+
+	if cfg.Redis.Mode == "" {
+		cfg.Redis.Mode = RedisStandalone
+	}
+	if err := cfg.Redis.Validate(); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	if cfg.Aggregator.AggregationWindow <= 0 {
+		cfg.Aggregator.AggregationWindow = 5 * time.Second
+	}
+	if cfg.Aggregator.Instance == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = cfg.Kafka.ClientID
+		}
+		cfg.Aggregator.Instance = host
+	}
+	if strings.Contains(cfg.Aggregator.Instance, ":") {
+		return nil, fmt.Errorf("aggregator instance %q must not contain ':'", cfg.Aggregator.Instance)
+	}
+	if len(cfg.Aggregator.Sinks) == 0 {
+		cfg.Aggregator.Sinks = []SinkConfig{{Type: "redis", Required: true}}
+	}
+	for i := range cfg.Aggregator.Sinks {
+		s := &cfg.Aggregator.Sinks[i]
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = 10 * time.Second
+		}
+		if s.Retry.Attempts <= 0 {
+			s.Retry.Attempts = 3
+		}
+		if s.Retry.Backoff <= 0 {
+			s.Retry.Backoff = 200 * time.Millisecond
+		}
+		if s.Retry.MaxBackoff <= 0 {
+			s.Retry.MaxBackoff = 2 * time.Second
+		}
+		if s.Breaker.Failures <= 0 {
+			s.Breaker.Failures = 3
+		}
+		if s.Breaker.Cooldown <= 0 {
+			s.Breaker.Cooldown = 10 * time.Second
+		}
+		if s.TTL == 0 {
+			s.TTL = 168 * time.Hour
+		}
+		if s.WAL == "" && s.Type == "redis" {
+			s.WAL = "processor." + s.Name + ".wal"
+		}
+		if s.Format == "" {
+			s.Format = "jsonl"
+		}
+		if s.Table == "" {
+			s.Table = "aggregates"
+		}
+		if s.Placeholder == "" {
+			s.Placeholder = "?"
+		}
+	}
+
+	cp := cfg.Checkpoint
+	if cp.Interval <= 0 {
+		cp.Interval = 30 * time.Second
+	}
+	if cp.Store == "" {
+		cp.Store = "file"
+	}
+	if cp.Path == "" {
+		cp.Path = "processor.checkpoint.json"
+	}
+	if cp.RedisKey == "" {
+		cp.RedisKey = "processor:checkpoint:" + cfg.Kafka.GroupID
+	}
+
+	if cfg.HTTPServer.Timeout <= 0 {
+		cfg.HTTPServer.Timeout = 5 * time.Second
+	}
+	if cfg.HTTPServer.IdleTimeout <= 0 {
+		cfg.HTTPServer.IdleTimeout = 60 * time.Second
+	}
+
+	w := cfg.Aggregator.Window
+	if w.Type == "" {
+		w.Type = "tumbling"
+	}
+	if w.Size <= 0 {
+		w.Size = cfg.Aggregator.AggregationWindow
+	}
+	if w.TimeSource == "" {
+		w.TimeSource = "header"
+	}
+	if w.TimeHeader == "" {
+		w.TimeHeader = "timestamp"
+	}
+	if w.IdleTimeout <= 0 {
+		w.IdleTimeout = time.Minute
+	}
+	if w.MaxFutureSkew <= 0 {
+		w.MaxFutureSkew = time.Minute
+	}
+
 	return &cfg, nil
 }
@@ -0,0 +1,180 @@
+package aggregation
+
+import (
+	"fmt"
+	"processor/internal/sink"
+	"processor/internal/sketch"
+)
+
+type accumulator interface {
+	add(v interface{})
+	merge(other accumulator)
+	// record возвращает значение для приёмника; false - значения нет (например, min без чисел)
+	record() (sink.Record, bool)
+}
+
+func newAccumulator(f Func) accumulator {
+	switch f.Kind {
+	case FuncSum:
+		return &sumAcc{}
+	case FuncMin:
+		return &extremumAcc{op: sink.OpMin, less: func(a, b float64) bool { return a < b }}
+	case FuncMax:
+		return &extremumAcc{op: sink.OpMax, less: func(a, b float64) bool { return a > b }}
+	case FuncAvg:
+		return &avgAcc{}
+	case FuncLast:
+		return &lastAcc{}
+	case FuncDistinct:
+		return &distinctAcc{HLL: sketch.NewHLL(), redis: f.Redis}
+	case FuncTopK:
+		return &topKAcc{Top: sketch.NewTopK(f.Capacity), k: f.K, redis: f.Redis}
+	}
+	return &countAcc{}
+}
+
+// Экспортируемые поля аккумуляторов попадают в снапшот состояния (checkpoint)
+
+type countAcc struct {
+	N int64 `json:"n"`
+}
+
+func (a *countAcc) add(interface{}) { a.N++ }
+
+func (a *countAcc) merge(other accumulator) { a.N += other.(*countAcc).N }
+
+func (a *countAcc) record() (sink.Record, bool) {
+	return sink.Record{Op: sink.OpIncr, Value: a.N}, true
+}
+
+type sumAcc struct {
+	Sum float64 `json:"sum"`
+}
+
+func (a *sumAcc) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		a.Sum += f
+	}
+}
+
+func (a *sumAcc) merge(other accumulator) { a.Sum += other.(*sumAcc).Sum }
+
+func (a *sumAcc) record() (sink.Record, bool) {
+	return sink.Record{Op: sink.OpIncr, Value: a.Sum}, true
+}
+
+// extremumAcc - min или max в зависимости от less
+type extremumAcc struct {
+	op    string
+	less  func(a, b float64) bool
+	Value float64 `json:"value"`
+	Set   bool    `json:"set"`
+}
+
+func (a *extremumAcc) add(v interface{}) {
+	f, ok := toFloat(v)
+	if !ok {
+		return
+	}
+	if !a.Set || a.less(f, a.Value) {
+		a.Value, a.Set = f, true
+	}
+}
+
+func (a *extremumAcc) merge(other accumulator) {
+	o := other.(*extremumAcc)
+	if o.Set {
+		a.add(o.Value)
+	}
+}
+
+func (a *extremumAcc) record() (sink.Record, bool) {
+	return sink.Record{Op: a.op, Value: a.Value}, a.Set
+}
+
+type avgAcc struct {
+	Sum float64 `json:"sum"`
+	N   int64   `json:"n"`
+}
+
+func (a *avgAcc) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		a.Sum += f
+		a.N++
+	}
+}
+
+func (a *avgAcc) merge(other accumulator) {
+	o := other.(*avgAcc)
+	a.Sum += o.Sum
+	a.N += o.N
+}
+
+func (a *avgAcc) record() (sink.Record, bool) {
+	if a.N == 0 {
+		return sink.Record{}, false
+	}
+	return sink.Record{Op: sink.OpAvg, Value: a.Sum / float64(a.N), Count: a.N}, true
+}
+
+// lastAcc - последнее значение поля в порядке обработки, не обязательно числовое
+type lastAcc struct {
+	Value interface{} `json:"value"`
+}
+
+func (a *lastAcc) add(v interface{}) {
+	if v != nil {
+		a.Value = v
+	}
+}
+
+func (a *lastAcc) merge(other accumulator) { a.add(other.(*lastAcc).Value) }
+
+func (a *lastAcc) record() (sink.Record, bool) {
+	return sink.Record{Op: sink.OpSet, Value: a.Value}, a.Value != nil
+}
+
+// distinctAcc - приближённое число различных значений поля
+type distinctAcc struct {
+	HLL   *sketch.HLL `json:"hll"`
+	redis bool
+}
+
+func (a *distinctAcc) add(v interface{}) {
+	if v != nil {
+		a.HLL.Add(fmt.Sprint(v))
+	}
+}
+
+func (a *distinctAcc) merge(other accumulator) { a.HLL.Merge(other.(*distinctAcc).HLL) }
+
+// record с redis отдаёт регистры целиком, чтобы приёмник мог объединить их с другими репликами
+func (a *distinctAcc) record() (sink.Record, bool) {
+	if !a.redis {
+		return sink.Record{Op: sink.OpSet, Value: a.HLL.Count()}, true
+	}
+	return sink.Record{Op: sink.OpHLL, Value: a.HLL.Count(), Sketch: a.HLL.Bytes()}, true
+}
+
+// topKAcc - самые частые значения поля
+type topKAcc struct {
+	Top   *sketch.TopK `json:"top"`
+	k     int
+	redis bool
+}
+
+func (a *topKAcc) add(v interface{}) {
+	if v != nil {
+		a.Top.Add(fmt.Sprint(v), 1)
+	}
+}
+
+func (a *topKAcc) merge(other accumulator) { a.Top.Merge(other.(*topKAcc).Top) }
+
+// record с redis отдаёт все счётчики: приёмник складывает их с другими flush и сам обрезает до capacity
+func (a *topKAcc) record() (sink.Record, bool) {
+	if !a.redis {
+		return sink.Record{Op: sink.OpSet, Value: a.Top.Top(a.k)}, true
+	}
+	return sink.Record{Op: sink.OpTopK, Value: a.Top.Top(0), Capacity: a.Top.Capacity()}, true
+}
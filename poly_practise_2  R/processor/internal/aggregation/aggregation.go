@@ -0,0 +1,228 @@
+package aggregation
+
+import (
+	"encoding/json"
+	"fmt"
+	"processor/config"
+	"processor/internal/decode"
+	"processor/internal/sink"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FuncCount = "count"
+	FuncSum   = "sum"
+	FuncMin   = "min"
+	FuncMax   = "max"
+	FuncAvg   = "avg"
+	FuncLast  = "last"
+
+	FuncDistinct = "distinct" // HyperLogLog
+	FuncTopK     = "topk"     // Space-Saving
+
+	// KeyField - ключ сообщения Kafka (для processor это id пользователя), доступен как поле записи
+	KeyField = decode.KeyField
+)
+
+// Spec - разобранное описание агрегации из конфига
+type Spec struct {
+	Name    string
+	GroupBy [][]string // пути полей, "pricing.currency" -> ["pricing", "currency"]
+	Funcs   []Func
+	Lanes   map[string]bool // nil - все полосы
+}
+
+type Func struct {
+	Kind     string
+	Field    []string
+	K        int
+	Capacity int
+	Redis    bool
+	label    string // имя поля в выходном хеше, например sum(pricing.sale_price)
+}
+
+func Compile(cfgs []config.AggregationConfig) ([]*Spec, error) {
+	specs := make([]*Spec, 0, len(cfgs))
+	seen := make(map[string]bool, len(cfgs))
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("aggregation without name")
+		}
+		if strings.HasPrefix(c.Name, "@") || strings.Contains(c.Name, ":") {
+			return nil, fmt.Errorf("aggregation %q: name must not start with '@' or contain ':'", c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate aggregation %q", c.Name)
+		}
+		seen[c.Name] = true
+		if len(c.Functions) == 0 {
+			return nil, fmt.Errorf("aggregation %q: no functions", c.Name)
+		}
+
+		spec := &Spec{Name: c.Name}
+		for _, lane := range c.Lanes {
+			if spec.Lanes == nil {
+				spec.Lanes = make(map[string]bool, len(c.Lanes))
+			}
+			spec.Lanes[lane] = true
+		}
+		for _, g := range c.GroupBy {
+			spec.GroupBy = append(spec.GroupBy, strings.Split(g, "."))
+		}
+		for _, f := range c.Functions {
+			switch f.Func {
+			case FuncCount:
+			case FuncSum, FuncMin, FuncMax, FuncAvg, FuncLast, FuncDistinct, FuncTopK:
+				if f.Field == "" {
+					return nil, fmt.Errorf("aggregation %q: %s requires field", c.Name, f.Func)
+				}
+			default:
+				return nil, fmt.Errorf("aggregation %q: unknown function %q", c.Name, f.Func)
+			}
+			fn := Func{Kind: f.Func, K: f.K, Capacity: f.Capacity, Redis: f.Redis, label: f.Func}
+			if fn.K <= 0 {
+				fn.K = 10
+			}
+			if fn.Capacity < fn.K {
+				fn.Capacity = max(fn.K, 100)
+			}
+			if f.Field != "" {
+				fn.Field = strings.Split(f.Field, ".")
+				fn.label = f.Func + "(" + f.Field + ")"
+			}
+			spec.Funcs = append(spec.Funcs, fn)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Table - состояние одной агрегации в одном окне: группа -> аккумуляторы функций
+type Table struct {
+	spec *Spec
+	rows map[string][]accumulator
+}
+
+func NewTable(spec *Spec) *Table {
+	return &Table{spec: spec, rows: make(map[string][]accumulator)}
+}
+
+// Accepts - считает ли агрегация сообщения полосы lane (пусто - сообщение без полосы)
+func (t *Table) Accepts(lane string) bool {
+	return t.spec.Lanes == nil || t.spec.Lanes[lane]
+}
+
+// Add учитывает запись; записи без числового значения поля не меняют sum/min/max/avg
+func (t *Table) Add(rec decode.Record) {
+	group := t.groupKey(rec)
+	accs, ok := t.rows[group]
+	if !ok {
+		accs = make([]accumulator, len(t.spec.Funcs))
+		for i, f := range t.spec.Funcs {
+			accs[i] = newAccumulator(f)
+		}
+		t.rows[group] = accs
+	}
+	for i, f := range t.spec.Funcs {
+		var v interface{}
+		if f.Field != nil {
+			v = rec.Field(f.Field)
+		}
+		accs[i].add(v)
+	}
+}
+
+func (t *Table) Merge(other *Table) {
+	for group, accs := range other.rows {
+		mine, ok := t.rows[group]
+		if !ok {
+			t.rows[group] = accs
+			continue
+		}
+		for i := range mine {
+			mine[i].merge(accs[i])
+		}
+	}
+}
+
+// MarshalJSON - снапшот таблицы: группа -> аккумуляторы в порядке функций спецификации
+func (t *Table) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.rows)
+}
+
+// UnmarshalJSON восстанавливает снапшот в таблицу, созданную NewTable с той же спецификацией
+func (t *Table) UnmarshalJSON(data []byte) error {
+	var rows map[string][]json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return err
+	}
+	t.rows = make(map[string][]accumulator, len(rows))
+	for group, raw := range rows {
+		if len(raw) != len(t.spec.Funcs) {
+			return fmt.Errorf("aggregation %q: snapshot has %d functions, config has %d", t.spec.Name, len(raw), len(t.spec.Funcs))
+		}
+		accs := make([]accumulator, len(raw))
+		for i, f := range t.spec.Funcs {
+			accs[i] = newAccumulator(f)
+			if err := json.Unmarshal(raw[i], accs[i]); err != nil {
+				return fmt.Errorf("aggregation %q: %w", t.spec.Name, err)
+			}
+		}
+		t.rows[group] = accs
+	}
+	return nil
+}
+
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Records возвращает значения всех функций по группам окна [start, end). count и sum
+// идут с OpIncr и складываются между частичными flush; min и max - с OpMin/OpMax и
+// сравниваются с записанным; avg - с OpAvg, его сумма и число значений складываются;
+// last - с OpSet, то есть побеждает последний flush окна. distinct и topk с redis: true отдают скетч целиком
+func (t *Table) Records(start, end time.Time) []sink.Record {
+	out := make([]sink.Record, 0, len(t.rows)*len(t.spec.Funcs))
+	for group, accs := range t.rows {
+		for i, f := range t.spec.Funcs {
+			r, ok := accs[i].record()
+			if !ok {
+				continue
+			}
+			r.Start, r.End = start, end
+			r.Aggregation, r.Group, r.Field = t.spec.Name, group, f.label
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (t *Table) groupKey(rec decode.Record) string {
+	if len(t.spec.GroupBy) == 0 {
+		return "*"
+	}
+	parts := make([]string, len(t.spec.GroupBy))
+	for i, path := range t.spec.GroupBy {
+		if v := rec.Field(path); v != nil {
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,187 @@
+package aggregation
+
+import (
+	"encoding/json"
+	"processor/config"
+	"processor/internal/sink"
+	"strings"
+	"testing"
+	"time"
+)
+
+// record - запись с полями по пути через точку
+type record map[string]interface{}
+
+func (r record) Field(path []string) interface{} { return r[strings.Join(path, ".")] }
+
+func compileOne(t *testing.T, cfg config.AggregationConfig) *Spec {
+	t.Helper()
+	specs, err := Compile([]config.AggregationConfig{cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return specs[0]
+}
+
+// values - значения Records по группе и полю
+func values(records []sink.Record) map[string]sink.Record {
+	out := make(map[string]sink.Record, len(records))
+	for _, r := range records {
+		out[r.Group+" "+r.Field] = r
+	}
+	return out
+}
+
+func TestCompile(t *testing.T) {
+	fn := func(f, field string) config.FunctionConfig { return config.FunctionConfig{Func: f, Field: field} }
+	tests := []struct {
+		name string
+		cfgs []config.AggregationConfig
+		err  string
+	}{
+		{"valid", []config.AggregationConfig{{Name: "by_category", GroupBy: []string{"category"}, Functions: []config.FunctionConfig{fn("count", ""), fn("sum", "price")}}}, ""},
+		{"no name", []config.AggregationConfig{{Functions: []config.FunctionConfig{fn("count", "")}}}, "without name"},
+		{"reserved name", []config.AggregationConfig{{Name: "a:b", Functions: []config.FunctionConfig{fn("count", "")}}}, "must not start"},
+		{"duplicate", []config.AggregationConfig{{Name: "a", Functions: []config.FunctionConfig{fn("count", "")}}, {Name: "a", Functions: []config.FunctionConfig{fn("count", "")}}}, "duplicate"},
+		{"no functions", []config.AggregationConfig{{Name: "a"}}, "no functions"},
+		{"missing field", []config.AggregationConfig{{Name: "a", Functions: []config.FunctionConfig{fn("sum", "")}}}, "requires field"},
+		{"unknown function", []config.AggregationConfig{{Name: "a", Functions: []config.FunctionConfig{fn("median", "price")}}}, "unknown function"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.cfgs)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Compile() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Compile() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileTopKDefaults(t *testing.T) {
+	tests := []struct {
+		k, capacity         int
+		wantK, wantCapacity int
+	}{
+		{0, 0, 10, 100},
+		{5, 20, 5, 20},
+		{50, 20, 50, 100}, // счётчиков не меньше k
+		{200, 0, 200, 200},
+	}
+	for _, tt := range tests {
+		spec := compileOne(t, config.AggregationConfig{Name: "a", Functions: []config.FunctionConfig{{Func: FuncTopK, Field: "sku", K: tt.k, Capacity: tt.capacity}}})
+		if f := spec.Funcs[0]; f.K != tt.wantK || f.Capacity != tt.wantCapacity {
+			t.Errorf("k=%d capacity=%d: got k=%d capacity=%d, want k=%d capacity=%d",
+				tt.k, tt.capacity, f.K, f.Capacity, tt.wantK, tt.wantCapacity)
+		}
+	}
+}
+
+func TestTableRecords(t *testing.T) {
+	spec := compileOne(t, config.AggregationConfig{
+		Name:    "by_category",
+		GroupBy: []string{"category"},
+		Functions: []config.FunctionConfig{
+			{Func: FuncCount}, {Func: FuncSum, Field: "price"}, {Func: FuncMin, Field: "price"},
+			{Func: FuncMax, Field: "price"}, {Func: FuncAvg, Field: "price"}, {Func: FuncLast, Field: "name"},
+		},
+	})
+	table := NewTable(spec)
+	for _, r := range []record{
+		{"category": "books", "price": 10.0, "name": "a"},
+		{"category": "books", "price": "30", "name": "b"}, // число строкой тоже считается
+		{"category": "books", "name": "c"},                // без цены - только count и last
+		{"category": "games", "price": 5, "name": "d"},
+	} {
+		table.Add(r)
+	}
+
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	got := values(table.Records(start, start.Add(time.Minute)))
+	tests := []struct {
+		key   string
+		op    string
+		value interface{}
+	}{
+		{"books count", sink.OpIncr, int64(3)},
+		{"books sum(price)", sink.OpIncr, 40.0},
+		{"books min(price)", sink.OpMin, 10.0},
+		{"books max(price)", sink.OpMax, 30.0},
+		{"books avg(price)", sink.OpAvg, 20.0},
+		{"books last(name)", sink.OpSet, "c"},
+		{"games count", sink.OpIncr, int64(1)},
+		{"games min(price)", sink.OpMin, 5.0},
+	}
+	for _, tt := range tests {
+		r, ok := got[tt.key]
+		if !ok {
+			t.Errorf("%s: no record", tt.key)
+			continue
+		}
+		if r.Op != tt.op || r.Value != tt.value || r.Aggregation != "by_category" || !r.Start.Equal(start) {
+			t.Errorf("%s = %s %v (%s, %s), want %s %v", tt.key, r.Op, r.Value, r.Aggregation, r.Start, tt.op, tt.value)
+		}
+	}
+	if r := got["books avg(price)"]; r.Count != 2 {
+		t.Errorf("avg count = %d, want 2", r.Count)
+	}
+}
+
+func TestTableMergeAndSnapshot(t *testing.T) {
+	spec := compileOne(t, config.AggregationConfig{
+		Name:      "total",
+		Functions: []config.FunctionConfig{{Func: FuncCount}, {Func: FuncMax, Field: "price"}, {Func: FuncDistinct, Field: "sku"}},
+	})
+	a, b := NewTable(spec), NewTable(spec)
+	a.Add(record{"price": 1.0, "sku": "x"})
+	b.Add(record{"price": 7.0, "sku": "y"})
+	b.Add(record{"price": 3.0, "sku": "x"})
+	a.Merge(b)
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTable(spec)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+
+	got := values(restored.Records(time.Time{}, time.Time{}))
+	if r := got["* count"]; r.Value != int64(3) {
+		t.Errorf("count = %v, want 3", r.Value)
+	}
+	if r := got["* max(price)"]; r.Value != 7.0 {
+		t.Errorf("max = %v, want 7", r.Value)
+	}
+	if r := got["* distinct(sku)"]; r.Value != uint64(2) {
+		t.Errorf("distinct = %v, want 2", r.Value)
+	}
+
+	other := compileOne(t, config.AggregationConfig{Name: "total", Functions: []config.FunctionConfig{{Func: FuncCount}}})
+	if err := json.Unmarshal(data, NewTable(other)); err == nil {
+		t.Error("snapshot with other functions restored without error")
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		lanes []string
+		lane  string
+		want  bool
+	}{
+		{nil, "", true},
+		{nil, "vip", true},
+		{[]string{"vip"}, "vip", true},
+		{[]string{"vip"}, "bulk", false},
+		{[]string{"vip"}, "", false},
+	}
+	for _, tt := range tests {
+		spec := compileOne(t, config.AggregationConfig{Name: "a", Lanes: tt.lanes, Functions: []config.FunctionConfig{{Func: FuncCount}}})
+		if got := NewTable(spec).Accepts(tt.lane); got != tt.want {
+			t.Errorf("lanes %v: Accepts(%q) = %v, want %v", tt.lanes, tt.lane, got, tt.want)
+		}
+	}
+}
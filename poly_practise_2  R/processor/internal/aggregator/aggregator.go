@@ -3,47 +3,208 @@ package aggregator
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"processor/config"
+	"processor/internal/aggregation"
+	"processor/internal/checkpoint"
+	"processor/internal/decode"
+	"processor/internal/sink"
 	"processor/internal/stress-tester"
+	"processor/internal/window"
 	"processor/pkg/metrics"
+	"shared/filter"
 )
 
+// bucket - состояние одного окна: число сообщений по ключу, декларативные агрегации
+// и первые учтённые оффсеты партиций - дальше них нельзя коммитить, пока окно не записано
+type bucket struct {
+	counts  map[string]int64
+	tables  []*aggregation.Table
+	offsets map[string]map[int]int64
+}
+
+type bucketSnapshot struct {
+	Counts  map[string]int64         `json:"counts"`
+	Tables  []*aggregation.Table     `json:"tables"`
+	Offsets map[string]map[int]int64 `json:"offsets,omitempty"`
+}
+
+func (b *bucket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucketSnapshot{Counts: b.counts, Tables: b.tables, Offsets: b.offsets})
+}
+
+// UnmarshalJSON восстанавливает снапшот в bucket, созданный фабрикой окон (таблицы уже со спецификациями)
+func (b *bucket) UnmarshalJSON(data []byte) error {
+	snap := bucketSnapshot{Counts: b.counts, Tables: b.tables}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if len(snap.Tables) != len(b.tables) {
+		return fmt.Errorf("snapshot has %d aggregations, config has %d", len(snap.Tables), len(b.tables))
+	}
+	b.counts = snap.Counts
+	for topic, ps := range snap.Offsets {
+		for p, off := range ps {
+			holdOffset(b.offsets, topic, p, off)
+		}
+	}
+	return nil
+}
+
+func (b *bucket) Merge(other window.State) {
+	o := other.(*bucket)
+	for k, v := range o.counts {
+		b.counts[k] += v
+	}
+	for i, t := range b.tables {
+		t.Merge(o.tables[i])
+	}
+	for topic, ps := range o.offsets {
+		for p, off := range ps {
+			holdOffset(b.offsets, topic, p, off)
+		}
+	}
+}
+
+// holdOffset запоминает в offsets меньший из оффсетов партиции
+func holdOffset(offsets map[string]map[int]int64, topic string, partition int, off int64) {
+	if offsets[topic] == nil {
+		offsets[topic] = make(map[int]int64)
+	}
+	if cur, ok := offsets[topic][partition]; !ok || off < cur {
+		offsets[topic][partition] = off
+	}
+}
+
+// ProgressFunc получает прогресс после каждого flush: processed - следующий оффсет после
+// последнего учтённого сообщения, held - первый оффсет, чьи окна ещё не записаны в приёмники
+type ProgressFunc func(processed, held map[string]map[int]int64)
+
+const checkpointTimeout = 5 * time.Second
+
 type Aggregator struct {
-	cfg             *config.AggregatorConfig
-	logger          *zap.Logger
-	inputChan       <-chan kafka.Message
-	aggregatorState map[string]int64
-	redisClient     *redis.Client
-	redisCfg        *config.RedisConfig
+	cfg        *config.AggregatorConfig
+	logger     *zap.Logger
+	inputChan  <-chan kafka.Message
+	windows    *window.Windows
+	lateWriter *kafka.Writer
+	sinks      *sink.Fanout
+	decoders   *decode.Registry
+
+	checkpoints        checkpoint.Store
+	checkpointInterval time.Duration
+	offsets            map[string]map[int]int64 // следующий оффсет после последнего учтённого сообщения
+	pinned             map[string]map[int]int64 // первые оффсеты окон, запись которых не удалась
+	onProgress         ProgressFunc
+
+	fallbackLogged map[string]bool // топики, о сообщениях без событийного времени в которых уже предупредили
 }
 
 func New(cfg *config.AggregatorConfig, logger *zap.Logger, inputChan <-chan kafka.Message, redisCfg *config.RedisConfig,
-) (*Aggregator, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisCfg.Addr,
-		Password: redisCfg.Password,
-		DB:       redisCfg.DB,
+	brokers []string) (*Aggregator, error) {
+	specs, err := aggregation.Compile(cfg.Aggregations)
+	if err != nil {
+		return nil, fmt.Errorf("init aggregations: %w", err)
+	}
+	windows, err := window.New(cfg.Window, func() window.State {
+		b := &bucket{
+			counts:  make(map[string]int64),
+			tables:  make([]*aggregation.Table, len(specs)),
+			offsets: make(map[string]map[int]int64),
+		}
+		for i, spec := range specs {
+			b.tables[i] = aggregation.NewTable(spec)
+		}
+		return b
 	})
+	if err != nil {
+		return nil, fmt.Errorf("init windows: %w", err)
+	}
 
-	return &Aggregator{
-		cfg:             cfg,
-		logger:          logger,
-		inputChan:       inputChan,
-		aggregatorState: make(map[string]int64),
-		redisClient:     rdb,
-		redisCfg:        redisCfg,
-	}, nil
+	sinks, err := sink.NewFanout(cfg.Sinks, redisCfg, brokers, cfg.Instance, logger)
+	if err != nil {
+		return nil, fmt.Errorf("init sinks: %w", err)
+	}
+
+	a := &Aggregator{
+		cfg:            cfg,
+		logger:         logger,
+		inputChan:      inputChan,
+		windows:        windows,
+		sinks:          sinks,
+		decoders:       decode.NewRegistry(),
+		offsets:        make(map[string]map[int]int64),
+		pinned:         make(map[string]map[int]int64),
+		fallbackLogged: make(map[string]bool),
+	}
+	if cfg.Window.LateTopic != "" {
+		a.lateWriter = &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    cfg.Window.LateTopic,
+			Balancer: &kafka.Hash{},
+			Async:    true, // опоздавшие события не должны тормозить основной цикл
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					logger.Error("failed to write late events", zap.Int("count", len(messages)), zap.Error(err))
+					metrics.MessagesFailed.WithLabelValues("late_output_failed").Add(float64(len(messages)))
+				}
+			},
+		}
+	}
+	return a, nil
+}
+
+// EnableCheckpoints включает периодический снапшот состояния; store закрывается в Close
+func (a *Aggregator) EnableCheckpoints(store checkpoint.Store, interval time.Duration) {
+	a.checkpoints = store
+	a.checkpointInterval = interval
+}
+
+// OnProgress задаёт получателя прогресса для коммита оффсетов; вызывать до StartProcessing
+func (a *Aggregator) OnProgress(fn ProgressFunc) {
+	a.onProgress = fn
+}
+
+// Restore поднимает состояние окон из снапшота; вызывать до StartProcessing, а консьюмер
+// должен начать чтение с cp.Offsets - иначе состояние сбрасывается через Discard
+func (a *Aggregator) Restore(cp *checkpoint.Checkpoint) error {
+	if err := a.windows.Restore(cp.State); err != nil {
+		return err
+	}
+	for topic, ps := range cp.Offsets {
+		a.offsets[topic] = make(map[int]int64, len(ps))
+		for p, off := range ps {
+			a.offsets[topic][p] = off
+		}
+	}
+	a.logger.Info("Aggregator state restored from checkpoint",
+		zap.Time("taken_at", cp.TakenAt),
+		zap.Int("open_windows", a.windows.Open()),
+		zap.Any("offsets", cp.Offsets),
+	)
+	return nil
+}
+
+// Discard сбрасывает состояние, поднятое Restore: консьюмер не применил оффсеты снапшота,
+// и его события будут прочитаны заново. Вызывать до StartProcessing
+func (a *Aggregator) Discard() {
+	a.windows.Reset()
+	a.offsets = make(map[string]map[int]int64)
+	a.logger.Info("Aggregator state from checkpoint discarded")
 }
 
 func (a *Aggregator) StartProcessing(ctx context.Context) {
 	a.logger.Info("Central aggregator processing loop started",
 		zap.Duration("aggregation_window", a.cfg.AggregationWindow),
+		zap.String("window_type", a.cfg.Window.Type),
+		zap.Duration("window_size", a.cfg.Window.Size),
+		zap.Duration("allowed_lateness", a.cfg.Window.AllowedLateness),
 	)
 
 	metrics.QueueSize.WithLabelValues("aggregator_input").Set(float64(len(a.inputChan)))
@@ -51,11 +212,12 @@ func (a *Aggregator) StartProcessing(ctx context.Context) {
 	ticker := time.NewTicker(a.cfg.AggregationWindow)
 	defer ticker.Stop()
 
-	defer func() {
-		if err := a.redisClient.Close(); err != nil {
-			a.logger.Error("failed to close Redis client", zap.Error(err))
-		}
-	}()
+	var checkpointC <-chan time.Time
+	if a.checkpoints != nil {
+		cpTicker := time.NewTicker(a.checkpointInterval)
+		defer cpTicker.Stop()
+		checkpointC = cpTicker.C
+	}
 
 	for {
 		select {
@@ -63,69 +225,325 @@ func (a *Aggregator) StartProcessing(ctx context.Context) {
 			metrics.QueueSize.WithLabelValues("aggregator_input").Dec()
 			if !ok {
 				a.logger.Info("Input channel closed, flushing final data...")
-				a.flushResults()
+				a.flushResults(a.windows.Drain())
+				a.saveCheckpoint()
+				a.reportProgress()
 				return
 			}
 
-			_ = processMessageValue(msg.Value, a.logger)
+			if a.offsets[msg.Topic] == nil {
+				a.offsets[msg.Topic] = make(map[int]int64)
+			}
+			a.offsets[msg.Topic][msg.Partition] = msg.Offset + 1
+
+			records, err := a.decoders.Decode(msg)
+			if err != nil {
+				a.decodeFailed(msg, err)
+			}
+			for i, rec := range records {
+				records[i] = decode.WithKey(rec, string(msg.Key))
+			}
 
 			metrics.MessagesConsumed.Inc()
 			metrics.InFlightMessages.Inc()
 
 			key := string(msg.Key)
+			lane := header(msg, filter.LaneHeader)
 			stress_tester.SimulateHeavyGCPollution()
-			a.aggregatorState[key]++
+			src := msg.Topic + "/" + strconv.Itoa(msg.Partition)
+			groups := a.byEventTime(msg, records)
+			late := 0
+			for i, g := range groups {
+				states := a.windows.Add(src, key, g.time)
+				if len(states) == 0 {
+					late++
+					continue
+				}
+				for _, st := range states {
+					b := st.(*bucket)
+					holdOffset(b.offsets, msg.Topic, msg.Partition, msg.Offset)
+					if i == 0 {
+						b.counts[key]++
+					}
+					for _, t := range b.tables {
+						if !t.Accepts(lane) {
+							continue
+						}
+						for _, rec := range g.records {
+							t.Add(rec)
+						}
+					}
+				}
+			}
+			if late == len(groups) {
+				a.sendLate(msg)
+			} else if late > 0 {
+				// успевшие события уже учтены: в side output сообщение не уходит, иначе
+				// они посчитались бы дважды
+				metrics.LateEvents.WithLabelValues(msg.Topic).Add(float64(late))
+			}
 
 			metrics.InFlightMessages.Dec()
 
 		case <-ticker.C:
-			a.flushResults()
-			a.aggregatorState = make(map[string]int64)
+			closed := a.windows.Closed()
+			a.flushResults(closed)
+			if len(closed) > 0 {
+				// записанные окна больше не должны попасть в снапшот вместе со старыми оффсетами
+				a.saveCheckpoint()
+			}
+			a.reportProgress()
+			if wm := a.windows.Watermark(); !wm.IsZero() {
+				metrics.Watermark.Set(float64(wm.Unix()))
+			}
+			metrics.OpenWindows.Set(float64(a.windows.Open()))
+
+		case <-checkpointC:
+			a.saveCheckpoint()
 
 		case <-ctx.Done():
-			a.logger.Info("Context cancelled, flushing final data...")
-			a.flushResults()
+			// штатно цикл завершается по закрытию inputChan, ctx - только жёсткая остановка по дедлайну
+			a.logger.Warn("Context cancelled before input was drained, flushing what is left")
+			a.flushResults(a.windows.Drain())
+			a.saveCheckpoint()
+			a.reportProgress()
 			return
 		}
 	}
 }
 
-func (a *Aggregator) flushResults() {
-	if len(a.aggregatorState) == 0 {
+// reportProgress отдаёт в onProgress учтённые оффсеты и первые оффсеты открытых окон
+// и окон, запись которых не удалась: их сообщения должны прочитаться заново после рестарта
+func (a *Aggregator) reportProgress() {
+	if a.onProgress == nil {
+		return
+	}
+	processed := make(map[string]map[int]int64, len(a.offsets))
+	for topic, ps := range a.offsets {
+		processed[topic] = make(map[int]int64, len(ps))
+		for p, off := range ps {
+			processed[topic][p] = off
+		}
+	}
+	held := make(map[string]map[int]int64)
+	for topic, ps := range a.pinned {
+		for p, off := range ps {
+			holdOffset(held, topic, p, off)
+		}
+	}
+	for _, st := range a.windows.States() {
+		for topic, ps := range st.(*bucket).offsets {
+			for p, off := range ps {
+				holdOffset(held, topic, p, off)
+			}
+		}
+	}
+	a.onProgress(processed, held)
+}
+
+// saveCheckpoint сохраняет незакрытые окна и оффсеты, до которых они посчитаны. После рестарта
+// чтение продолжится с этих оффсетов, и незакрытые окна досчитываются без потерь. Двойной учёт
+// возможен, только если процесс упал между записью закрытых окон в Redis и следующим снапшотом
+func (a *Aggregator) saveCheckpoint() {
+	if a.checkpoints == nil {
+		return
+	}
+	started := time.Now()
+
+	state, err := a.windows.Snapshot()
+	if err != nil {
+		a.logger.Error("failed to snapshot aggregator state", zap.Error(err))
+		return
+	}
+	offsets := make(map[string]map[int]int64, len(a.offsets))
+	for topic, ps := range a.offsets {
+		offsets[topic] = make(map[int]int64, len(ps))
+		for p, off := range ps {
+			offsets[topic][p] = off
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+	cp := &checkpoint.Checkpoint{TakenAt: started, Offsets: offsets, State: state}
+	if err := a.checkpoints.Save(ctx, cp); err != nil {
+		a.logger.Error("failed to save checkpoint", zap.Error(err))
+		metrics.MessagesFailed.WithLabelValues("checkpoint_failed").Inc()
+		return
+	}
+	a.logger.Debug("Checkpoint saved", zap.Int("bytes", len(state)), zap.Duration("took", time.Since(started)))
+}
+
+func (a *Aggregator) Close() error {
+	var errs []error
+	if a.lateWriter != nil {
+		if err := a.lateWriter.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close late writer: %w", err))
+		}
+	}
+	if a.checkpoints != nil {
+		if err := a.checkpoints.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close checkpoint store: %w", err))
+		}
+	}
+	if err := a.sinks.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("close sinks: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// timed - события сообщения с одним событийным временем
+type timed struct {
+	time    time.Time
+	records []decode.Record
+}
+
+// byEventTime раскладывает события по их собственному времени (updated_at события, у
+// конверта без него - время последнего события батча): батч collector накрывает несколько
+// окон, и событие должно попасть в своё. Запись без времени берёт время сообщения. Первая
+// группа - окно, где считается само сообщение; сообщение без записей - одна группа
+func (a *Aggregator) byEventTime(msg kafka.Message, records []decode.Record) []timed {
+	var msgTime time.Time
+	resolved := false
+	messageTime := func() time.Time {
+		if !resolved {
+			msgTime, resolved = a.eventTime(msg), true
+		}
+		return msgTime
+	}
+	if len(records) == 0 {
+		return []timed{{time: messageTime()}}
+	}
+
+	var groups []timed
+	index := make(map[int64]int)
+	for _, rec := range records {
+		t, ok := decode.EventTime(rec)
+		if ok && a.cfg.Window.TimeSource == window.TimeFromHeader {
+			t = a.clampFuture(msg, t)
+		} else {
+			t = messageTime()
+		}
+		i, seen := index[t.UnixNano()]
+		if !seen {
+			i = len(groups)
+			index[t.UnixNano()] = i
+			groups = append(groups, timed{time: t})
+		}
+		groups[i].records = append(groups[i].records, rec)
+	}
+	return groups
+}
+
+// eventTime - время сообщения из заголовка. Без него окно выбирается по времени Kafka, то
+// есть по времени обработки: такие сообщения считаются в метрике, а о топике один раз
+// пишется предупреждение
+func (a *Aggregator) eventTime(msg kafka.Message) time.Time {
+	t, ok := a.windows.EventTime(msg)
+	if !ok {
+		metrics.EventTimeFallbacks.WithLabelValues(msg.Topic).Inc()
+		if !a.fallbackLogged[msg.Topic] {
+			a.fallbackLogged[msg.Topic] = true
+			a.logger.Warn("message has no event time, windowing by kafka time",
+				zap.String("topic", msg.Topic), zap.String("time_header", a.cfg.Window.TimeHeader))
+		}
+	}
+	return a.clampFuture(msg, t)
+}
+
+// clampFuture обрезает время дальше now+MaxFutureSkew: одно событие из будущего иначе
+// сдвинуло бы watermark партиции и все её настоящие события стали бы опоздавшими
+func (a *Aggregator) clampFuture(msg kafka.Message, t time.Time) time.Time {
+	if skew := a.cfg.Window.MaxFutureSkew; skew > 0 && t.After(time.Now().Add(skew)) {
+		metrics.FutureEvents.WithLabelValues(msg.Topic).Inc()
+		return time.Now().Add(skew)
+	}
+	return t
+}
+
+// sendLate отправляет опоздавшее событие в side output, сохраняя исходные заголовки
+func (a *Aggregator) sendLate(msg kafka.Message) {
+	metrics.LateEvents.WithLabelValues(msg.Topic).Inc()
+	if a.lateWriter == nil {
 		return
 	}
 
-	a.logger.Info("Flushing aggregated data to Redis",
-		zap.Int("unique_keys_count", len(a.aggregatorState)),
+	headers := append(msg.Headers[:len(msg.Headers):len(msg.Headers)],
+		kafka.Header{Key: "source_topic", Value: []byte(msg.Topic)},
+		kafka.Header{Key: "watermark", Value: []byte(a.windows.Watermark().Format(time.RFC3339Nano))},
 	)
+	err := a.lateWriter.WriteMessages(context.Background(), kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		a.logger.Error("failed to queue late event", zap.String("topic", msg.Topic), zap.Error(err))
+	}
+}
 
-	redisHashKey := fmt.Sprintf("agg_batch:%s", time.Now().Format("2006-01-02T15:04:05"))
+// flushResults отдаёт закрытые окна во все приёмники: счётчики сообщений по ключу и
+// значения декларативных агрегаций. Раскладку по ключам выбирает приёмник
+func (a *Aggregator) flushResults(results []window.Result) {
+	if len(results) == 0 {
+		return
+	}
 
-	fields := make(map[string]interface{}, len(a.aggregatorState))
-	for k, v := range a.aggregatorState {
-		fields[k] = v
+	var records []sink.Record
+	for _, r := range results {
+		b := r.State.(*bucket)
+		start, end := r.Start.UTC(), r.End.UTC()
+		for k, v := range b.counts {
+			records = append(records, sink.Record{Start: start, End: end, Group: k, Field: "count", Op: sink.OpIncr, Value: v})
+		}
+		for _, t := range b.tables {
+			records = append(records, t.Records(start, end)...)
+		}
 	}
 
-	if err := a.redisClient.HMSet(a.redisClient.Context(), redisHashKey, fields).Err(); err != nil {
-		a.logger.Error("failed to write aggregated data to Redis", zap.Error(err), zap.String("redis_key", redisHashKey))
-		metrics.MessagesFailed.WithLabelValues("redis_write_failed").Inc()
+	a.logger.Info("Flushing aggregated windows to sinks",
+		zap.Int("windows_count", len(results)),
+		zap.Int("records_count", len(records)),
+	)
+
+	if err := a.sinks.Write(context.Background(), records); err != nil {
+		a.logger.Error("failed to write aggregated windows", zap.Error(err))
+		metrics.MessagesFailed.WithLabelValues("sink_write_failed").Inc()
+		// оффсеты этих окон не коммитятся до рестарта, чтобы их сообщения прочитались заново
+		for _, r := range results {
+			for topic, ps := range r.State.(*bucket).offsets {
+				for p, off := range ps {
+					holdOffset(a.pinned, topic, p, off)
+				}
+			}
+		}
 	} else {
-		a.logger.Info("Successfully wrote aggregated data to Redis", zap.String("redis_key", redisHashKey), zap.Int("fields_count", len(fields)))
+		a.logger.Info("Successfully wrote aggregated windows", zap.Int("windows_count", len(results)))
 	}
 }
 
-func processMessageValue(value []byte, logger *zap.Logger) error {
-	var records []string
-	if err := json.Unmarshal(value, &records); err != nil {
-		logger.Error("failed to unmarshal Kafka message value", zap.Error(err))
-		return err
+// decodeFailed логирует ошибку декодирования; валидные записи батча при этом уже учтены
+func (a *Aggregator) decodeFailed(msg kafka.Message, err error) {
+	reason := "malformed"
+	var derr *decode.Error
+	if errors.As(err, &derr) {
+		reason = derr.Reason()
 	}
+	metrics.DecodeErrors.WithLabelValues(msg.Topic, reason).Inc()
+	a.logger.Warn("failed to decode message",
+		zap.String("topic", msg.Topic),
+		zap.Int("partition", msg.Partition),
+		zap.Int64("offset", msg.Offset),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+}
 
-	for _, r := range records {
-		var obj map[string]interface{}
-		if err := json.Unmarshal([]byte(r), &obj); err != nil {
-			logger.Warn("skipping invalid record", zap.Error(err))
+func header(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
 		}
 	}
-	return nil
+	return ""
 }
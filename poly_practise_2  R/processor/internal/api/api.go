@@ -0,0 +1,465 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"processor/config"
+	"processor/internal/redisclient"
+	"processor/internal/sink"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+
+	// maxUserRange ограничивает диапазон /users/{uid}: его ответ собирается HGET по хешам окон
+	maxUserRange = 24 * time.Hour
+
+	windowPrefix = "agg_window:"
+	timeLayout   = time.RFC3339
+)
+
+// Server - HTTP API только для чтения агрегатов, которые processor пишет в Redis
+type Server struct {
+	srv    *http.Server
+	rdb    redis.UniversalClient
+	logger *zap.Logger
+}
+
+func New(cfg *config.HttpServer, redisCfg *config.RedisConfig, logger *zap.Logger) *Server {
+	s := &Server{
+		rdb:    redisclient.New(redisCfg),
+		logger: logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/users/{uid}", s.handleUser)
+	mux.HandleFunc("GET /api/v1/windows", s.handleWindows)
+	mux.HandleFunc("GET /api/v1/windows/top", s.handleTop)
+
+	s.srv = &http.Server{
+		Addr:         cfg.Address,
+		Handler:      mux,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	return s
+}
+
+func (s *Server) Run() {
+	s.logger.Info("Starting query API", zap.String("address", s.srv.Addr))
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("query API stopped", zap.Error(err))
+	}
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if cerr := s.rdb.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// windowInfo - хеш окна одной реплики
+type windowInfo struct {
+	Key         string    `json:"key"`
+	Aggregation string    `json:"aggregation,omitempty"` // пусто - счётчики сообщений по ключу
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Instance    string    `json:"instance"`
+}
+
+type page struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// handleUser - счётчики сообщений пользователя по окнам из диапазона [from, to). Диапазон
+// обязателен и не длиннее maxUserRange, страница отбирается по индексу окон в Redis, так что
+// на запрос приходится не больше limit HGET. offset и limit считаются по хешам окон: у окна
+// по хешу на реплику, и окна, где пользователя нет, в ответ не попадают
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	from, to, err := boundedRange(r, maxUserRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	windows, p, err := s.windows(r.Context(), "", from, to, offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(windows))
+	for i, win := range windows {
+		cmds[i] = pipe.HGet(r.Context(), win.Key, uid)
+	}
+	if len(cmds) > 0 {
+		if _, err := pipe.Exec(r.Context()); err != nil && !errors.Is(err, redis.Nil) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	type userWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Count int64     `json:"count"`
+	}
+	// окна уже по возрастанию начала, хеши реплик одного окна идут подряд и складываются
+	var (
+		items []userWindow
+		count int64
+	)
+	for i, cmd := range cmds {
+		n, err := cmd.Int64()
+		if err != nil {
+			continue
+		}
+		count += n
+		if last := len(items) - 1; last >= 0 && items[last].Start.Equal(windows[i].Start) && items[last].End.Equal(windows[i].End) {
+			items[last].Count += n
+			continue
+		}
+		items = append(items, userWindow{Start: windows[i].Start, End: windows[i].End, Count: n})
+	}
+	if items == nil {
+		items = []userWindow{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":    uid,
+		"count":   count, // сумма по окнам страницы
+		"windows": items,
+		"page":    p,
+	})
+}
+
+// handleWindows - окна в диапазоне [from, to), по возрастанию начала
+func (s *Server) handleWindows(w http.ResponseWriter, r *http.Request) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	windows, p, err := s.windows(r.Context(), r.URL.Query().Get("aggregation"), from, to, offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"windows": windows,
+		"page":    p,
+	})
+}
+
+// handleTop - ключи окна по убыванию значения. Без aggregation - пользователи по числу
+// сообщений; с aggregation нужен func, например "sum(pricing.sale_price)"
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, err := time.Parse(timeLayout, q.Get("start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad start: %w", err))
+		return
+	}
+	end, err := time.Parse(timeLayout, q.Get("end"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad end: %w", err))
+		return
+	}
+	offset, limit, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	aggregation, fn := q.Get("aggregation"), q.Get("func")
+	if aggregation != "" && fn == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("func is required with aggregation"))
+		return
+	}
+
+	keys, err := s.windowKeys(r.Context(), aggregation, start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(keys) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("window %s - %s not found", start.Format(timeLayout), end.Format(timeLayout)))
+		return
+	}
+
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(r.Context(), key)
+	}
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// значения реплик сводятся по функции: min и max - экстремум, остальное складывается.
+	// avg хранится суммой и числом значений, они складываются по репликам и делятся один раз
+	combine := func(a, b float64) float64 { return a + b }
+	switch {
+	case strings.HasPrefix(fn, "min("):
+		combine = math.Min
+	case strings.HasPrefix(fn, "max("):
+		combine = math.Max
+	}
+	avg := strings.HasPrefix(fn, "avg(")
+	values := make(map[string]float64)
+	counts := make(map[string]float64)
+	for _, cmd := range cmds {
+		for field, raw := range cmd.Val() {
+			name, target := field, values
+			if aggregation != "" {
+				group, f, ok := strings.Cut(field, "|")
+				if !ok {
+					continue
+				}
+				switch {
+				case avg && f == fn+sink.AvgSumSuffix:
+				case avg && f == fn+sink.AvgCountSuffix:
+					target = counts
+				case !avg && f == fn:
+				default:
+					continue
+				}
+				name = group
+			}
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				continue // last и topk без redis хранят не числа
+			}
+			if cur, ok := target[name]; ok {
+				target[name] = combine(cur, v)
+				continue
+			}
+			target[name] = v
+		}
+	}
+	if avg {
+		for name, sum := range values {
+			if n := counts[name]; n > 0 {
+				values[name] = sum / n
+			} else {
+				delete(values, name)
+			}
+		}
+	}
+
+	type entry struct {
+		Key   string  `json:"key"`
+		Value float64 `json:"value"`
+	}
+	entries := make([]entry, 0, len(values))
+	for name, v := range values {
+		entries = append(entries, entry{Key: name, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	entries, p := paginate(entries, offset, limit)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window": map[string]interface{}{"aggregation": aggregation, "start": start, "end": end, "keys": keys},
+		"top":    entries,
+		"page":   p,
+	})
+}
+
+// windows читает из индекса агрегации страницу хешей окон, которые начинаются в [from, to),
+// по возрастанию начала; у одного окна может быть по хешу на реплику. limit 0 - все хеши диапазона
+func (s *Server) windows(ctx context.Context, aggregation string, from, to time.Time, offset, limit int) ([]windowInfo, page, error) {
+	name := aggregation
+	if name == "" {
+		name = sink.CountsAggregation
+	}
+	index := sink.IndexKey(name)
+	lo, hi := strconv.FormatInt(from.Unix(), 10), "("+strconv.FormatInt(to.Unix(), 10)
+
+	p := page{Offset: offset, Limit: limit}
+	total, err := s.rdb.ZCount(ctx, index, lo, hi).Result()
+	if err != nil {
+		return nil, p, fmt.Errorf("read window index: %w", err)
+	}
+	p.Total = int(total)
+	if offset >= p.Total {
+		return []windowInfo{}, p, nil
+	}
+	rng := &redis.ZRangeBy{Min: lo, Max: hi, Offset: int64(offset)}
+	if limit > 0 {
+		rng.Count = int64(limit)
+		if next := offset + limit; next < p.Total {
+			p.NextOffset = &next
+		}
+	}
+	// при равном начале ZSET упорядочивает ключи лексикографически, то есть по концу окна
+	keys, err := s.rdb.ZRangeByScore(ctx, index, rng).Result()
+	if err != nil {
+		return nil, p, fmt.Errorf("read window index: %w", err)
+	}
+
+	out := make([]windowInfo, 0, len(keys))
+	for _, key := range keys {
+		info, ok := parseWindowKey(key)
+		if !ok {
+			continue
+		}
+		info.Aggregation = aggregation
+		out = append(out, info)
+	}
+	return out, p, nil
+}
+
+// windowKeys - хеши всех реплик окна [start, end)
+func (s *Server) windowKeys(ctx context.Context, aggregation string, start, end time.Time) ([]string, error) {
+	windows, _, err := s.windows(ctx, aggregation, start, start.Add(time.Second), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, w := range windows {
+		if w.End.Equal(end) {
+			keys = append(keys, w.Key)
+		}
+	}
+	return keys, nil
+}
+
+// parseWindowKey разбирает agg_window:<aggregation>:<start>:<end>:<instance>, время - unix-секунды
+func parseWindowKey(key string) (windowInfo, bool) {
+	rest, ok := strings.CutPrefix(key, windowPrefix)
+	if !ok {
+		return windowInfo{}, false
+	}
+	parts := strings.SplitN(rest, ":", 4)
+	if len(parts) != 4 {
+		return windowInfo{}, false
+	}
+	start, err1 := strconv.ParseInt(parts[1], 10, 64)
+	end, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return windowInfo{}, false
+	}
+	return windowInfo{
+		Key:         key,
+		Aggregation: parts[0],
+		Start:       time.Unix(start, 0).UTC(),
+		End:         time.Unix(end, 0).UTC(),
+		Instance:    parts[3],
+	}, true
+}
+
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	from, to := time.Time{}, time.Now().Add(24*time.Hour*365)
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("bad from: %w", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("bad to: %w", err)
+		}
+	}
+	return from, to, nil
+}
+
+// boundedRange - обязательный диапазон [from, to) не длиннее maxRange
+func boundedRange(r *http.Request, maxRange time.Duration) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	if q.Get("from") == "" || q.Get("to") == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("from and to are required")
+	}
+	from, to, err := timeRange(r)
+	if err != nil {
+		return from, to, err
+	}
+	if !to.After(from) {
+		return from, to, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > maxRange {
+		return from, to, fmt.Errorf("range is longer than %s", maxRange)
+	}
+	return from, to, nil
+}
+
+func pagination(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	offset, limit := 0, defaultLimit
+	var err error
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad offset %q", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("bad limit %q", v)
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return offset, limit, nil
+}
+
+func paginate[T any](items []T, offset, limit int) ([]T, page) {
+	p := page{Offset: offset, Limit: limit, Total: len(items)}
+	if offset >= len(items) {
+		return []T{}, p
+	}
+	end := offset + limit
+	if end < len(items) {
+		p.NextOffset = &end
+	} else {
+		end = len(items)
+	}
+	return items[offset:end], p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -2,20 +2,24 @@ package app
 
 import (
 	"context"
-	"github.com/segmentio/kafka-go"
+	"errors"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
 	"os/signal"
 	"processor/config"
 	"processor/internal/aggregator"
+	"processor/internal/api"
+	"processor/internal/checkpoint"
 	"processor/internal/consumer"
 	"processor/pkg/logging"
 	"processor/pkg/metrics"
-	"sync"
 	"syscall"
+	"time"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func MustRun(cfg *config.Config) {
 	logger, err := logging.NewLogger(*cfg.Logger)
 	if err != nil {
@@ -23,87 +27,131 @@ func MustRun(cfg *config.Config) {
 	}
 	logging.StatusLogger(logger, *cfg.Logger)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	var wg sync.WaitGroup
+	consumeCtx, stopConsuming := context.WithCancel(context.Background())
+	defer stopConsuming()
+	processCtx, stopProcessing := context.WithCancel(context.Background())
+	defer stopProcessing()
 
 	go serveMetrics()
 
-	consumers := make([]*consumer.Consumer, 0, cfg.Kafka.ReaderInstance)
-
-	mergedChan := make(chan kafka.Message, cfg.Kafka.BufferChannelSize)
-	var producerWg sync.WaitGroup
-
-	logger.Info("Starting consumer instances", zap.Int("n", cfg.Kafka.ReaderInstance))
-	for i := 0; i < cfg.Kafka.ReaderInstance; i++ {
-		cons, err := consumer.New(cfg, logger)
+	// снапшот восстанавливается до старта консьюмера: его оффсеты - позиция чтения в первом поколении
+	var (
+		store    checkpoint.Store
+		restored *checkpoint.Checkpoint
+	)
+	if cfg.Checkpoint.Enabled {
+		store, err = checkpoint.New(cfg.Checkpoint, cfg.Redis)
 		if err != nil {
-			logger.Fatal("failed to init consumer", zap.Error(err))
+			logger.Fatal("failed to init checkpoint store", zap.Error(err))
+		}
+		restored, err = store.Load(context.Background())
+		switch {
+		case errors.Is(err, checkpoint.ErrNotFound):
+			logger.Info("No checkpoint found, starting from committed offsets")
+		case err != nil:
+			logger.Fatal("failed to load checkpoint", zap.Error(err))
+		case cfg.Kafka.Start.From != "" && cfg.Kafka.Start.From != config.StartCommitted:
+			logger.Warn("Explicit start position overrides checkpoint, state is not restored", zap.String("from", cfg.Kafka.Start.From))
+			restored = nil
 		}
-		consumers = append(consumers, cons)
-
-		inputChan := cons.StartConsuming(ctx)
-
-		producerWg.Add(1)
-		wg.Add(1)
-		go func(instance int) {
-			defer producerWg.Done()
-			defer wg.Done()
-
-			for {
-				select {
-				case msg, ok := <-inputChan:
-					if !ok {
-						logger.Info("Input channel closed, forwarder exiting", zap.Int("instance", instance))
-						return
-					}
-					select {
-					case mergedChan <- msg:
-					case <-ctx.Done():
-						logger.Info("Shutdown signal received while forwarding message, exiting", zap.Int("instance", instance))
-						return
-					}
-				case <-ctx.Done():
-					logger.Info("Shutdown signal received, forwarder exiting", zap.Int("instance", instance))
-					return
-				}
-			}
-		}(i)
 	}
 
-	go func() {
-		producerWg.Wait()
-		close(mergedChan)
-		logger.Info("All producers finished, closing merged channel.")
-	}()
+	cons, err := consumer.New(cfg, logger)
+	if err != nil {
+		logger.Fatal("failed to init consumer", zap.Error(err))
+	}
+	var applied <-chan bool
+	if restored != nil {
+		applied = cons.Restore(restored.Offsets)
+	}
 
-	agg, err := aggregator.New(cfg.Aggregator, logger, mergedChan, cfg.Redis)
+	inputChan := cons.StartConsuming(consumeCtx)
+
+	agg, err := aggregator.New(cfg.Aggregator, logger, inputChan, cfg.Redis, cfg.Kafka.Brokers)
 	if err != nil {
 		logger.Fatal("failed to init aggregator", zap.Error(err))
 	}
+	agg.OnProgress(cons.Ack)
+	if store != nil {
+		agg.EnableCheckpoints(store, cfg.Checkpoint.Interval)
+	}
+	if restored != nil {
+		if err := agg.Restore(restored); err != nil {
+			logger.Fatal("failed to restore checkpoint", zap.Error(err))
+		}
+	}
+
+	var queryAPI *api.Server
+	if cfg.HTTPServer.Address != "" {
+		queryAPI = api.New(cfg.HTTPServer, cfg.Redis, logger)
+		go queryAPI.Run()
+	}
 
-	wg.Add(1)
+	aggDone := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		agg.StartProcessing(ctx)
+		defer close(aggDone)
+		// о снапшоте решает первое поколение (или остановка консьюмера): до него агрегатору нечего обрабатывать
+		if applied != nil && !<-applied {
+			agg.Discard()
+		}
+		agg.StartProcessing(processCtx)
 		logger.Info("Aggregator has finished processing.")
 	}()
 
 	waitForSignal(logger)
-	logger.Info("Shutdown signal received. Shutting down...")
 
-	cancel()
-	wg.Wait()
-	logger.Info("All worker goroutines have been shut down.")
-
-	for i, c := range consumers {
-		if err := c.Close(); err != nil {
-			logger.Error("failed to close consumer", zap.Error(err), zap.Int("instance", i))
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	started := time.Now()
+
+	// консьюмер перестаёт читать и закрывает канал, агрегатор дочитывает его и делает финальный
+	// flush (по дедлайну - принудительно), и только после этого коммитятся оффсеты записанных окон
+	if queryAPI != nil {
+		shutdownPhase(logger, "stop query API", func() error {
+			return queryAPI.Shutdown(shutdownCtx)
+		})
+	}
+	shutdownPhase(logger, "stop fetching", func() error {
+		stopConsuming()
+		return nil
+	})
+	shutdownPhase(logger, "drain and final flush", func() error {
+		err := waitChan(shutdownCtx, aggDone)
+		if err != nil {
+			stopProcessing()
+			<-aggDone
 		}
+		return err
+	})
+	shutdownPhase(logger, "commit offsets", func() error {
+		return cons.Finish(shutdownCtx)
+	})
+	shutdownPhase(logger, "close consumer", cons.Close)
+	shutdownPhase(logger, "close sinks", agg.Close)
+
+	logger.Info("Shutdown complete", zap.Duration("took", time.Since(started)))
+}
+
+func shutdownPhase(logger *zap.Logger, name string, fn func() error) {
+	started := time.Now()
+	if err := fn(); err != nil {
+		logger.Error("shutdown phase failed", zap.String("phase", name), zap.Duration("took", time.Since(started)), zap.Error(err))
+		return
 	}
+	logger.Info("shutdown phase complete", zap.String("phase", name), zap.Duration("took", time.Since(started)))
+}
 
-	logger.Info("Shutdown complete")
+func waitChan(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func serveMetrics() {
@@ -0,0 +1,141 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"os"
+	"path/filepath"
+	"processor/config"
+	"processor/internal/redisclient"
+	"time"
+)
+
+const (
+	StoreFile  = "file"
+	StoreRedis = "redis"
+
+	version = 1
+)
+
+// ErrNotFound - снапшота ещё нет, сервис стартует с закоммиченных оффсетов
+var ErrNotFound = errors.New("checkpoint not found")
+
+// Checkpoint - состояние незакрытых окон и оффсеты, до которых (не включая) оно посчитано
+type Checkpoint struct {
+	Version int                      `json:"version"`
+	TakenAt time.Time                `json:"taken_at"`
+	Offsets map[string]map[int]int64 `json:"offsets"`
+	State   json.RawMessage          `json:"state"`
+}
+
+type Store interface {
+	Save(ctx context.Context, cp *Checkpoint) error
+	Load(ctx context.Context) (*Checkpoint, error)
+	Close() error
+}
+
+func New(cfg *config.CheckpointConfig, redisCfg *config.RedisConfig) (Store, error) {
+	switch cfg.Store {
+	case StoreFile:
+		return &fileStore{path: cfg.Path}, nil
+	case StoreRedis:
+		return &redisStore{
+			key: cfg.RedisKey,
+			rdb: redisclient.New(redisCfg),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown checkpoint store %q", cfg.Store)
+}
+
+func decode(data []byte) (*Checkpoint, error) {
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("decode checkpoint: %w", err)
+	}
+	if cp.Version != version {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+	}
+	return &cp, nil
+}
+
+func encode(cp *Checkpoint) ([]byte, error) {
+	cp.Version = version
+	return json.Marshal(cp)
+}
+
+type fileStore struct {
+	path string
+}
+
+// Save пишет во временный файл и переименовывает его, чтобы не оставить обрезанный снапшот
+func (s *fileStore) Save(_ context.Context, cp *Checkpoint) error {
+	data, err := encode(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create checkpoint file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write checkpoint file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync checkpoint file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close checkpoint file: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileStore) Load(_ context.Context) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint file: %w", err)
+	}
+	return decode(data)
+}
+
+func (s *fileStore) Close() error { return nil }
+
+type redisStore struct {
+	key string
+	rdb redis.UniversalClient
+}
+
+func (s *redisStore) Save(ctx context.Context, cp *Checkpoint) error {
+	data, err := encode(cp)
+	if err != nil {
+		return err
+	}
+	if err := s.rdb.Set(ctx, s.key, data, 0).Err(); err != nil {
+		return fmt.Errorf("save checkpoint to redis: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) Load(ctx context.Context) (*Checkpoint, error) {
+	data, err := s.rdb.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load checkpoint from redis: %w", err)
+	}
+	return decode(data)
+}
+
+func (s *redisStore) Close() error {
+	return s.rdb.Close()
+}
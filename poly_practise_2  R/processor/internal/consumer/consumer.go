@@ -3,97 +3,438 @@ package consumer
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"processor/config"
+	"processor/internal/redisclient"
+	"processor/pkg/metrics"
+	"shared/dedup"
+	"shared/filter"
+	"shared/startpos"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const defaultCommitInterval = time.Second
+
+// пауза после ошибки чтения или вступления в группу: удваивается до maxReadBackoff, чтобы
+// при недоступном брокере цикл не крутил ядро и не заваливал лог
+const (
+	readBackoff    = 100 * time.Millisecond
+	maxReadBackoff = 5 * time.Second
+)
+
+// Consumer - один участник группы на все топики; читает по горутине на каждую
+// назначенную партицию, так что параллелизм определяется числом партиций
 type Consumer struct {
-	cfg     *config.KafkaConfig
-	readers map[string]*kafka.Reader
-	logger  *zap.Logger
+	cfg    *config.KafkaConfig
+	group  *kafka.ConsumerGroup
+	start  *startpos.Starter
+	filter *filter.Filter
+	dedup  *dedup.Deduper
+	logger *zap.Logger
+
+	done       chan struct{}
+	finish     chan struct{} // закрывается после финального flush агрегатора
+	finishOnce sync.Once
+
+	mu        sync.Mutex
+	read      map[string]map[int]int64 // следующий оффсет после последнего прочитанного сообщения
+	sent      map[string]map[int]int64 // то же для сообщений, отданных агрегатору
+	processed map[string]map[int]int64 // то же для сообщений, учтённых агрегатором (Ack)
+	held      map[string]map[int]int64 // первые оффсеты окон, ещё не записанных в приёмники (Ack)
+
+	messagesRead uint64
 }
 
 func New(cfg *config.Config, logger *zap.Logger) (*Consumer, error) {
-	cons := &Consumer{
-		cfg:     cfg.Kafka,
-		readers: make(map[string]*kafka.Reader),
-		logger:  logger,
-	}
-
-	for _, topic := range cfg.Kafka.Topics {
-		cons.readers[topic] = kafka.NewReader(kafka.ReaderConfig{
-			Brokers:  cfg.Kafka.Brokers,
-			GroupID:  cfg.Kafka.GroupID,
-			Topic:    topic,
-			MinBytes: 10e3,
-			MaxBytes: 10e6,
-		})
-	}
-	return cons, nil
+	// сброс оффсетов - до вступления в группу, пока она пуста
+	start := startpos.New(&kafka.Client{Addr: kafka.TCP(cfg.Kafka.Brokers...)}, cfg.Kafka.Start, logger)
+	switch from := cfg.Kafka.Start.From; {
+	case cfg.Kafka.Start.Reset:
+		// явно запрошенный сброс не должен молча превращаться в чтение с закоммиченных оффсетов
+		if err := start.Reset(context.Background(), cfg.Kafka.GroupID, cfg.Kafka.Topics); err != nil {
+			return nil, fmt.Errorf("reset offsets of group %s: %w", cfg.Kafka.GroupID, err)
+		}
+	case from != "" && from != startpos.Committed:
+		logger.Warn("start position applies only to partitions without committed offsets, use reset to rewind the group",
+			zap.String("group", cfg.Kafka.GroupID), zap.String("from", from))
+	}
+	// после сброса дедупликация начинает новую эпоху ключей: перечитанное - не повторы
+	d := dedup.New(cfg.Dedup, dedupRedis(cfg), logger)
+	if err := d.Open(context.Background(), cfg.Kafka.GroupID, cfg.Kafka.Start.Reset); err != nil {
+		_ = d.Close()
+		return nil, fmt.Errorf("init dedup: %w", err)
+	}
+
+	group, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:      cfg.Kafka.GroupID,
+		Brokers: cfg.Kafka.Brokers,
+		Topics:  cfg.Kafka.Topics,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create consumer group: %w", err)
+	}
+
+	f, err := filter.New(cfg.Filter, metrics.RuleHits)
+	if err != nil {
+		return nil, fmt.Errorf("init filter rules: %w", err)
+	}
+
+	return &Consumer{
+		cfg:    cfg.Kafka,
+		group:  group,
+		start:  start,
+		filter: f,
+		dedup:  d,
+		logger: logger,
+		done:   make(chan struct{}),
+		finish: make(chan struct{}),
+		read:   make(map[string]map[int]int64),
+		sent:   make(map[string]map[int]int64),
+	}, nil
+}
+
+// dedupRedis - клиент для дедупликации в Redis, nil без redis в её конфиге
+func dedupRedis(cfg *config.Config) redis.UniversalClient {
+	if !cfg.Dedup.UsesRedis() || cfg.Redis == nil {
+		return nil
+	}
+	return redisclient.New(cfg.Redis)
+}
+
+// Restore - оффсеты снапшота состояния, с которых читать партиции в первом поколении;
+// вызывать до StartConsuming. Канал получит false, если первому поколению назначены не все
+// партиции снапшота: тогда оффсеты не применяются, и состояние нужно сбросить
+func (c *Consumer) Restore(offsets map[string]map[int]int64) <-chan bool {
+	return c.start.Restore(offsets)
+}
+
+// Ack принимает прогресс агрегатора: processed - следующий оффсет после последнего учтённого
+// сообщения, held - первый оффсет, чьи окна ещё не записаны. Коммитятся только оффсеты не дальше обоих
+func (c *Consumer) Ack(processed, held map[string]map[int]int64) {
+	c.mu.Lock()
+	c.processed = processed
+	c.held = held
+	c.mu.Unlock()
 }
 
 func (c *Consumer) StartConsuming(ctx context.Context) <-chan kafka.Message {
 	msgCh := make(chan kafka.Message, c.cfg.BufferChannelSize)
-	var wg sync.WaitGroup
+	var closeOnce sync.Once
+	closeInput := func() { closeOnce.Do(func() { close(msgCh) }) }
+
+	go func() {
+		defer close(c.done)
+		defer closeInput()
+		defer c.start.Skip()
+		backoff := readBackoff
+		for {
+			gen, err := c.group.Next(ctx)
+			if err != nil {
+				if errors.Is(err, kafka.ErrGroupClosed) || ctx.Err() != nil {
+					c.logger.Info("Context cancelled, stopping consumer", zap.String("group", c.cfg.GroupID))
+					return
+				}
+				c.logger.Error("Failed to join consumer group",
+					zap.String("group", c.cfg.GroupID), zap.Duration("backoff", backoff), zap.Error(err))
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff = min(backoff*2, maxReadBackoff)
+				continue
+			}
+			backoff = readBackoff
+			c.runGeneration(ctx, gen, msgCh, closeInput)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return msgCh
+}
+
+// Finish разрешает финальный коммит после того, как агрегатор дочитал канал и записал окна,
+// и ждёт выхода из поколения
+func (c *Consumer) Finish(ctx context.Context) error {
+	c.finishOnce.Do(func() { close(c.finish) })
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done закрывается, когда чтение остановлено и финальные оффсеты закоммичены
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// runGeneration читает назначенные партиции и по тикеру коммитит подтверждённые агрегатором
+// оффсеты. При остановке поколение держится до Finish: коммит возможен только внутри него,
+// а финальные оффсеты известны лишь после финального flush
+func (c *Consumer) runGeneration(ctx context.Context, gen *kafka.Generation, msgCh chan<- kafka.Message, closeInput func()) {
+	metrics.AssignedPartitions.Reset()
+	total := 0
+	for topic, assignments := range gen.Assignments {
+		metrics.AssignedPartitions.WithLabelValues(topic).Set(float64(len(assignments)))
+		total += len(assignments)
+	}
+	c.logger.Info("Partitions assigned",
+		zap.Int32("generation", gen.ID),
+		zap.String("member", gen.MemberID),
+		zap.Int("partitions", total),
+	)
+
+	assignments := c.start.Apply(ctx, gen)
+
+	committed := make(map[string]map[int]int64)
+	commit := func(offsets map[string]map[int]int64) {
+		fresh := make(map[string]map[int]int64)
+		for topic, ps := range offsets {
+			for p, off := range ps {
+				if last, ok := committed[topic][p]; ok && off <= last {
+					continue
+				}
+				if fresh[topic] == nil {
+					fresh[topic] = make(map[int]int64)
+				}
+				fresh[topic][p] = off
+			}
+		}
+		if len(fresh) == 0 {
+			return
+		}
+		if err := gen.CommitOffsets(fresh); err != nil {
+			c.logger.Error("Failed to commit offsets", zap.Int32("generation", gen.ID), zap.Error(err))
+			return
+		}
+		c.dedup.Commit(context.Background(), fresh)
+		for topic, ps := range fresh {
+			if committed[topic] == nil {
+				committed[topic] = make(map[int]int64)
+			}
+			for p, off := range ps {
+				committed[topic][p] = off
+			}
+		}
+	}
 
-	var messagesRead uint64 = 0
+	done := make(chan struct{})
+	gen.Start(func(genCtx context.Context) {
+		defer close(done)
 
-	for topic, reader := range c.readers {
-		wg.Add(1)
-		go func(topic string, r *kafka.Reader) {
-			defer wg.Done()
-			c.logger.Info("Starting consumer loop for topic", zap.String("topic", topic))
+		fetchCtx, cancel := context.WithCancel(genCtx)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
 
-			for {
+		var wg sync.WaitGroup
+		for topic, as := range assignments {
+			for _, a := range as {
+				wg.Add(1)
+				go func(topic string, a kafka.PartitionAssignment) {
+					defer wg.Done()
+					c.fetch(fetchCtx, topic, a, msgCh)
+				}(topic, a)
+			}
+		}
 
-				c.logger.Debug("Attempting to read message from Kafka", zap.String("topic", topic))
+		interval := c.cfg.CommitInterval
+		if interval <= 0 {
+			interval = defaultCommitInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				commit(c.safeOffsets(gen))
+			case <-fetchCtx.Done():
+				wg.Wait()
+				if genCtx.Err() != nil {
+					// ребаланс: прочитанное уже у агрегатора, и окна он запишет сам, поэтому
+					// коммитится всё прочитанное - иначе новый владелец посчитал бы это второй раз
+					commit(c.readOffsets(gen))
+					c.logger.Info("Partitions revoked", zap.Int32("generation", gen.ID))
+					return
+				}
 
-				msg, err := r.ReadMessage(ctx)
-				if err != nil {
-					if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-						c.logger.Info("Context cancelled, stopping consumer", zap.String("topic", topic))
+				// остановка: агрегатор дочитывает канал и делает финальный flush, поколение
+				// держится до Finish, чтобы закоммитить то, что он подтвердит
+				closeInput()
+				for {
+					select {
+					case <-ticker.C:
+						commit(c.safeOffsets(gen))
+					case <-c.finish:
+						commit(c.safeOffsets(gen))
+						c.logger.Info("Final offsets committed", zap.Int32("generation", gen.ID))
 						return
-					}
-					c.logger.Error("Failed to read message from Kafka", zap.String("topic", topic), zap.Error(err))
-					if ctx.Err() != nil {
+					case <-genCtx.Done():
+						c.logger.Warn("Generation ended before final flush, offsets are not committed", zap.Int32("generation", gen.ID))
 						return
 					}
-					continue
 				}
+			}
+		}
+	})
+	<-done
+}
 
-				c.logger.Debug("Message read successfully", zap.String("topic", topic), zap.Int64("offset", msg.Offset))
+// safeOffsets - оффсеты назначенных партиций, которые можно коммитить: не дальше учтённого
+// агрегатором и не дальше первого сообщения незаписанного окна. Хвост сообщений, отброшенных
+// фильтром или дедупликацией, коммитится, когда агрегатор учёл всё отданное ему до них
+func (c *Consumer) safeOffsets(gen *kafka.Generation) map[string]map[int]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-				atomic.AddUint64(&messagesRead, 1)
+	out := make(map[string]map[int]int64)
+	for topic, as := range gen.Assignments {
+		for _, a := range as {
+			off, ok := c.read[topic][a.ID]
+			if !ok {
+				continue
+			}
+			if sent, ok := c.sent[topic][a.ID]; ok {
+				processed, ok := c.processed[topic][a.ID]
+				if !ok {
+					continue
+				}
+				if processed < sent {
+					off = processed
+				}
+			}
+			if held, ok := c.held[topic][a.ID]; ok && held < off {
+				off = held
+			}
+			if out[topic] == nil {
+				out[topic] = make(map[int]int64)
+			}
+			out[topic][a.ID] = off
+		}
+	}
+	return out
+}
 
-				select {
-				case msgCh <- msg:
-				case <-ctx.Done():
-					c.logger.Info("Context cancelled while sending message to channel", zap.String("topic", topic))
-					return
+// readOffsets - следующие оффсеты после последних прочитанных сообщений назначенных партиций
+func (c *Consumer) readOffsets(gen *kafka.Generation) map[string]map[int]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]map[int]int64)
+	for topic, as := range gen.Assignments {
+		for _, a := range as {
+			if off, ok := c.read[topic][a.ID]; ok {
+				if out[topic] == nil {
+					out[topic] = make(map[int]int64)
 				}
+				out[topic][a.ID] = off
 			}
-		}(topic, reader)
+		}
 	}
+	return out
+}
 
-	go func() {
-		wg.Wait()
-		close(msgCh)
-		c.logger.Info("All topic consumers have shut down, closing messages channel.")
+// track отмечает прочитанное сообщение; sent - оно отдано агрегатору, а не отброшено
+func (c *Consumer) track(msg kafka.Message, sent bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.read[msg.Topic] == nil {
+		c.read[msg.Topic] = make(map[int]int64)
+		c.sent[msg.Topic] = make(map[int]int64)
+	}
+	c.read[msg.Topic][msg.Partition] = msg.Offset + 1
+	if sent {
+		c.sent[msg.Topic][msg.Partition] = msg.Offset + 1
+	}
+}
+
+func (c *Consumer) fetch(ctx context.Context, topic string, a kafka.PartitionAssignment, msgCh chan<- kafka.Message) {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   c.cfg.Brokers,
+		Topic:     topic,
+		Partition: a.ID,
+		MinBytes:  10e3,
+		MaxBytes:  10e6,
+	})
+	defer func() {
+		if err := r.Close(); err != nil {
+			c.logger.Error("failed to close kafka reader", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+		}
 	}()
 
-	return msgCh
+	if err := r.SetOffset(a.Offset); err != nil {
+		c.logger.Error("Failed to set offset", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+		return
+	}
+	c.logger.Info("Starting consumer loop for partition", zap.String("topic", topic), zap.Int("partition", a.ID))
+
+	backoff := readBackoff
+	for {
+		c.logger.Debug("Attempting to read message from Kafka", zap.String("topic", topic))
+
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				c.logger.Info("Context cancelled, stopping partition consumer", zap.String("topic", topic), zap.Int("partition", a.ID))
+				return
+			}
+			c.logger.Error("Failed to read message from Kafka",
+				zap.String("topic", topic), zap.Int("partition", a.ID), zap.Duration("backoff", backoff), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxReadBackoff)
+			continue
+		}
+		backoff = readBackoff
+
+		c.logger.Debug("Message read successfully", zap.String("topic", topic), zap.Int64("offset", msg.Offset))
+
+		atomic.AddUint64(&c.messagesRead, 1)
+
+		if !c.filter.Apply(&msg) {
+			c.track(msg, false)
+			continue
+		}
+		if c.dedup != nil && c.dedup.Duplicate(ctx, msg) {
+			metrics.DuplicatesDropped.WithLabelValues(topic).Inc()
+			c.track(msg, false)
+			continue
+		}
+
+		select {
+		case msgCh <- msg:
+			c.track(msg, true)
+		case <-ctx.Done():
+			c.logger.Info("Context cancelled while sending message to channel", zap.String("topic", topic))
+			return
+		}
+	}
 }
 
 func (c *Consumer) Close() error {
-	for topic, r := range c.readers {
-		if err := r.Close(); err != nil {
-			c.logger.Error("failed to close kafka reader", zap.String("topic", topic), zap.Error(err))
-		} else {
-			c.logger.Info("kafka reader closed", zap.String("topic", topic))
+	if c.dedup != nil {
+		if err := c.dedup.Close(); err != nil {
+			c.logger.Error("failed to close dedup redis client", zap.Error(err))
 		}
 	}
+	if err := c.group.Close(); err != nil {
+		c.logger.Error("failed to close consumer group", zap.String("group", c.cfg.GroupID), zap.Error(err))
+		return err
+	}
+	c.logger.Info("consumer group closed", zap.String("group", c.cfg.GroupID))
 	return nil
 }
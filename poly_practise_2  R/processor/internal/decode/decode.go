@@ -0,0 +1,238 @@
+package decode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"shared/event"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderContentType = "content_type"
+	HeaderVersion     = "version"
+
+	// BatchContentType - батч событий пользователя от collector
+	BatchContentType = "application/vnd.collector.batch+json"
+	// EventContentType - одиночное событие myproducer
+	EventContentType = "application/json"
+
+	// BatchStrings - массив событий, каждое закодировано JSON-строкой (как писал collector раньше)
+	BatchStrings = "1"
+	// BatchObjects - массив JSON-объектов, разбирается за один проход
+	BatchObjects = "2"
+
+	// KeyField - ключ сообщения Kafka (для processor это id пользователя), доступен как поле записи
+	KeyField = "@key"
+)
+
+// ErrUnsupported - для пары content_type/version нет декодера
+var ErrUnsupported = errors.New("unsupported payload format")
+
+// Record - одна запись сообщения; поле ищется по пути из конфига агрегаций
+type Record interface {
+	Field(path []string) interface{}
+}
+
+// Decoder разбирает значение сообщения в записи. Невалидные элементы батча пропускаются
+// и возвращаются в *Error вместе с валидными записями
+type Decoder interface {
+	Decode(value []byte) ([]Record, error)
+}
+
+// Event - событие товара, схема общая с myproducer
+type Event = event.Event
+
+// FieldError - нарушение правила валидации одного поля
+type FieldError = event.FieldError
+
+// ItemError - ошибка одного элемента батча: не разобран (Err) или не прошёл валидацию (Fields)
+type ItemError struct {
+	Index  int          `json:"index"`
+	Err    error        `json:"-"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// Error - структурированная ошибка декодирования сообщения
+type Error struct {
+	ContentType string      `json:"content_type"`
+	Version     string      `json:"version"`
+	Err         error       `json:"-"` // сообщение не разобрано целиком
+	Items       []ItemError `json:"items,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("decode content_type %q version %q: %v", e.ContentType, e.Version, e.Err)
+	}
+	parts := make([]string, 0, len(e.Items))
+	for _, it := range e.Items {
+		if it.Err != nil {
+			parts = append(parts, fmt.Sprintf("[%d] %v", it.Index, it.Err))
+			continue
+		}
+		fields := make([]string, len(it.Fields))
+		for i, f := range it.Fields {
+			fields[i] = f.Field + " " + f.Reason
+		}
+		parts = append(parts, fmt.Sprintf("[%d] %s", it.Index, strings.Join(fields, ", ")))
+	}
+	return fmt.Sprintf("decode content_type %q version %q: %d invalid items: %s", e.ContentType, e.Version, len(e.Items), strings.Join(parts, "; "))
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reason - короткая причина для метрик
+func (e *Error) Reason() string {
+	switch {
+	case errors.Is(e.Err, ErrUnsupported):
+		return "unsupported"
+	case e.Err != nil:
+		return "malformed"
+	}
+	return "invalid_items"
+}
+
+type format struct {
+	contentType string
+	version     string
+}
+
+// Registry выбирает декодер по заголовкам content_type и version. Версия "" - декодер
+// для любой версии этого content_type; сообщения без заголовков читаются как BatchStrings
+type Registry struct {
+	decoders map[format]Decoder
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{decoders: make(map[format]Decoder)}
+	r.Register("", "", batchStrings{})
+	r.Register(BatchContentType, BatchStrings, batchStrings{})
+	r.Register(BatchContentType, BatchObjects, batchObjects{})
+	r.Register(EventContentType, "", single{})
+	r.Register(EnvelopeContentType, EnvelopeV1, envelopeV1{})
+	return r
+}
+
+func (r *Registry) Register(contentType, version string, d Decoder) {
+	r.decoders[format{contentType, version}] = d
+}
+
+func (r *Registry) Decode(msg kafka.Message) ([]Record, error) {
+	var contentType, version string
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderContentType:
+			contentType = string(h.Value)
+		case HeaderVersion:
+			version = string(h.Value)
+		}
+	}
+
+	d, ok := r.decoders[format{contentType, version}]
+	if !ok {
+		d, ok = r.decoders[format{contentType, ""}]
+	}
+	if !ok {
+		return nil, &Error{ContentType: contentType, Version: version, Err: ErrUnsupported}
+	}
+
+	records, err := d.Decode(msg.Value)
+	var derr *Error
+	if errors.As(err, &derr) {
+		derr.ContentType, derr.Version = contentType, version
+	} else if err != nil {
+		err = &Error{ContentType: contentType, Version: version, Err: err}
+	}
+	return records, err
+}
+
+// batchStrings - ["{...}", "{...}"]: каждый элемент - JSON события внутри строки
+type batchStrings struct{}
+
+func (batchStrings) Decode(value []byte) ([]Record, error) {
+	var items []string
+	if err := json.Unmarshal(value, &items); err != nil {
+		return nil, err
+	}
+	b := batch{events: make([]Event, len(items))}
+	for i, item := range items {
+		b.add(i, json.Unmarshal([]byte(item), &b.events[i]))
+	}
+	return b.result()
+}
+
+// batchObjects - [{...}, {...}]: весь батч разбирается одним Unmarshal
+type batchObjects struct{}
+
+func (batchObjects) Decode(value []byte) ([]Record, error) {
+	var b batch
+	if err := json.Unmarshal(value, &b.events); err != nil {
+		return nil, err
+	}
+	for i := range b.events {
+		b.add(i, nil)
+	}
+	return b.result()
+}
+
+// single - одно событие без обёртки
+type single struct{}
+
+func (single) Decode(value []byte) ([]Record, error) {
+	b := batch{events: make([]Event, 1)}
+	b.add(0, json.Unmarshal(value, &b.events[0]))
+	return b.result()
+}
+
+// batch собирает валидные события и ошибки остальных
+type batch struct {
+	events  []Event
+	records []Record
+	errs    []ItemError
+}
+
+func (b *batch) add(i int, err error) {
+	if err != nil {
+		b.errs = append(b.errs, ItemError{Index: i, Err: err})
+		return
+	}
+	if fields := b.events[i].Validate(); len(fields) > 0 {
+		b.errs = append(b.errs, ItemError{Index: i, Fields: fields})
+		return
+	}
+	b.records = append(b.records, &b.events[i])
+}
+
+func (b *batch) result() ([]Record, error) {
+	if len(b.errs) > 0 {
+		return b.records, &Error{Items: b.errs}
+	}
+	return b.records, nil
+}
+
+// WithKey добавляет к записи ключ сообщения под именем KeyField
+func WithKey(r Record, key string) Record {
+	return keyed{Record: r, key: key}
+}
+
+type keyed struct {
+	Record
+	key string
+}
+
+func (k keyed) Field(path []string) interface{} {
+	if len(path) == 1 && path[0] == KeyField {
+		return k.key
+	}
+	return k.Record.Field(path)
+}
+
+func (k keyed) EventTime() time.Time {
+	t, _ := EventTime(k.Record)
+	return t
+}
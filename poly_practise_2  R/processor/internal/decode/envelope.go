@@ -0,0 +1,105 @@
+package decode
+
+import (
+	"encoding/json"
+	"fmt"
+	"shared/envelope"
+	"time"
+)
+
+const (
+	// EnvelopeContentType - конверт collector: батч пользователя с окном и источниками
+	EnvelopeContentType = envelope.ContentType
+	EnvelopeV1          = "1"
+)
+
+// Envelope - выходное сообщение collector, схема версии 1; описана в shared/envelope,
+// её же пишет collector
+type Envelope = envelope.Envelope
+
+// Timed - запись, которая знает событийное время: событие товара и событие из конверта collector
+type Timed interface {
+	EventTime() time.Time
+}
+
+// EventTime - событийное время записи; false - запись его не несёт
+func EventTime(r Record) (time.Time, bool) {
+	if t, ok := r.(Timed); ok {
+		et := t.EventTime()
+		return et, !et.IsZero()
+	}
+	return time.Time{}, false
+}
+
+// envelopeV1 отдаёт события из items; элемент-строка - событие, которое collector получил
+// не JSON-объектом. Конверт со ссылками (refs) записей не даёт: содержимое в нём не передаётся
+type envelopeV1 struct{}
+
+func (envelopeV1) Decode(value []byte) ([]Record, error) {
+	var env Envelope
+	if err := json.Unmarshal(value, &env); err != nil {
+		return nil, err
+	}
+	if env.SchemaVersion != envelope.Version {
+		return nil, fmt.Errorf("envelope schema_version %d: %w", env.SchemaVersion, ErrUnsupported)
+	}
+
+	b := batch{events: make([]Event, len(env.Items))}
+	for i, raw := range env.Items {
+		if len(raw) > 0 && raw[0] == '"' {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				b.add(i, err)
+				continue
+			}
+			raw = json.RawMessage(s)
+		}
+		b.add(i, json.Unmarshal(raw, &b.events[i]))
+	}
+	records, err := b.result()
+	for i, r := range records {
+		records[i] = enveloped{Record: r, env: &env}
+	}
+	return records, err
+}
+
+// enveloped - событие из конверта. Поля конверта доступны по путям envelope.user_id,
+// envelope.window_start, envelope.window_end, envelope.event_start и envelope.event_end
+// (время - RFC3339). Событийное время записи - её собственное (updated_at, created_at), без
+// него - время последнего события батча
+type enveloped struct {
+	Record
+	env *Envelope
+}
+
+func (e enveloped) Field(path []string) interface{} {
+	if len(path) != 2 || path[0] != "envelope" {
+		return e.Record.Field(path)
+	}
+	var t time.Time
+	switch path[1] {
+	case "user_id":
+		return e.env.UserID
+	case "window_start":
+		t = e.env.WindowStart
+	case "window_end":
+		t = e.env.WindowEnd
+	case "event_start":
+		t = e.env.EventStart
+	case "event_end":
+		t = e.env.EventEnd
+	default:
+		return nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (e enveloped) EventTime() time.Time {
+	if t, ok := EventTime(e.Record); ok {
+		return t
+	}
+	return e.env.EventEnd
+}
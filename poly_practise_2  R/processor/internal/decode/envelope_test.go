@@ -0,0 +1,158 @@
+package decode
+
+import (
+	"encoding/json"
+	"github.com/segmentio/kafka-go"
+	"shared/envelope"
+	"shared/event"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestEnvelopeRoundTrip проходит путь события: входное сообщение myproducer -> Item в состоянии
+// collector -> конверт и заголовки выходного сообщения -> записи processor
+func TestEnvelopeRoundTrip(t *testing.T) {
+	first := time.Date(2026, 10, 19, 12, 0, 1, 0, time.UTC)
+	last := first.Add(90 * time.Second)
+	flushed := last.Add(time.Hour) // collector отправил батч сильно позже событий
+
+	inputs := []kafka.Message{
+		inputMessage(t, 10, "books", last),
+		inputMessage(t, 11, "games", first),
+	}
+	items := make([]envelope.Item, len(inputs))
+	for i, msg := range inputs {
+		items[i] = envelope.Item{
+			Value:     string(msg.Value),
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Time:      envelope.EventTime(msg),
+		}
+	}
+
+	value, err := json.Marshal(envelope.New("user-1", flushed.Add(-time.Minute), flushed, items, envelope.ItemsPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := kafka.Message{
+		Key:   []byte("user-1"),
+		Value: value,
+		Time:  flushed,
+		Headers: []kafka.Header{
+			{Key: HeaderContentType, Value: []byte(envelope.ContentType)},
+			{Key: HeaderVersion, Value: []byte(strconv.Itoa(envelope.Version))},
+		},
+	}
+	h, ok := envelope.TimestampHeader(items)
+	if !ok {
+		t.Fatal("no timestamp header for items with event time")
+	}
+	out.Headers = append(out.Headers, h)
+
+	if got := envelope.EventTime(out); !got.Equal(last) {
+		t.Errorf("output timestamp header = %s, want %s", got, last)
+	}
+
+	records, err := NewRegistry().Decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(inputs) {
+		t.Fatalf("decoded %d records, want %d", len(records), len(inputs))
+	}
+	for i, want := range []string{"books", "games"} {
+		rec := WithKey(records[i], "user-1")
+		if got := rec.Field([]string{"category"}); got != want {
+			t.Errorf("record %d category = %v, want %s", i, got, want)
+		}
+		if got, ok := EventTime(rec); !ok || !got.Equal(last) {
+			t.Errorf("record %d event time = %s, %v; want %s", i, got, ok, last)
+		}
+		if got := rec.Field([]string{"envelope", "event_start"}); got != first.Format(time.RFC3339) {
+			t.Errorf("record %d envelope.event_start = %v, want %s", i, got, first.Format(time.RFC3339))
+		}
+		if got := rec.Field([]string{"envelope", "window_end"}); got != flushed.Format(time.RFC3339) {
+			t.Errorf("record %d envelope.window_end = %v, want %s", i, got, flushed.Format(time.RFC3339))
+		}
+	}
+}
+
+// TestEnvelopeItemTime: у события в конверте своё событийное время (updated_at, затем
+// created_at), время последнего события батча - только для событий без него
+func TestEnvelopeItemTime(t *testing.T) {
+	first := time.Date(2026, 10, 19, 12, 0, 1, 0, time.UTC)
+	last := first.Add(90 * time.Second)
+	tests := []struct {
+		name    string
+		created time.Time
+		updated time.Time
+		want    time.Time
+	}{
+		{"updated_at", first.Add(-time.Hour), first, first},
+		{"created_at without updated_at", first.Add(time.Second), time.Time{}, first.Add(time.Second)},
+		{"no own time", time.Time{}, time.Time{}, last},
+	}
+
+	items := make([]envelope.Item, len(tests))
+	for i, tt := range tests {
+		ev := Event{Name: "Product-1", SKU: "SKU-1-1", Category: "books", Brand: "brand",
+			Pricing: event.Pricing{BasePrice: 100, SalePrice: 90, Currency: "USD"}}
+		if !tt.created.IsZero() {
+			ev.CreatedAt = tt.created.Format(time.RFC3339)
+		}
+		if !tt.updated.IsZero() {
+			ev.UpdatedAt = tt.updated.Format(time.RFC3339)
+		}
+		value, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items[i] = envelope.Item{Value: string(value), Topic: "my-topic", Offset: int64(i), Time: last}
+	}
+	value, err := json.Marshal(envelope.New("user-1", first, last, items, envelope.ItemsPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := NewRegistry().Decode(kafka.Message{
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: HeaderContentType, Value: []byte(envelope.ContentType)},
+			{Key: HeaderVersion, Value: []byte(strconv.Itoa(envelope.Version))},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("decoded %d records, want %d", len(records), len(tests))
+	}
+	for i, tt := range tests {
+		if got, ok := EventTime(WithKey(records[i], "user-1")); !ok || !got.Equal(tt.want) {
+			t.Errorf("%s: event time = %s, %v; want %s", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func inputMessage(t *testing.T, offset int64, category string, at time.Time) kafka.Message {
+	t.Helper()
+	value, err := json.Marshal(Event{
+		Name:     "Product-1",
+		SKU:      "SKU-1-1",
+		Category: category,
+		Brand:    "brand",
+		Pricing:  event.Pricing{BasePrice: 100, SalePrice: 90, Currency: "USD", DiscountRate: 0.1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{
+		Topic:     "my-topic",
+		Partition: 0,
+		Offset:    offset,
+		Value:     value,
+		Time:      at.Add(time.Minute), // время Kafka не совпадает с событийным
+		Headers:   []kafka.Header{{Key: envelope.HeaderTimestamp, Value: []byte(at.Format(time.RFC3339))}},
+	}
+}
@@ -0,0 +1,32 @@
+package redisclient
+
+import (
+	"github.com/go-redis/redis/v8"
+	"processor/config"
+)
+
+// New создаёт клиент под режим из конфига. В cluster Pipeline сам раскладывает команды
+// по узлам согласно hash slot ключей, поэтому flush-пайплайны работают без изменений;
+// команды над несколькими ключами (PFMERGE) должны держать ключи в одном слоте через {hash tag}
+func New(cfg *config.RedisConfig) redis.UniversalClient {
+	switch cfg.Mode {
+	case config.RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addrs,
+			SentinelPassword: cfg.SentinelPassword,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+		})
+	case config.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.Addrs,
+			Password: cfg.Password,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+}
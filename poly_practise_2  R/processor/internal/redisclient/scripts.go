@@ -0,0 +1,260 @@
+package redisclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lua-скрипты атомарного слияния агрегатов. Скрипт выполняется на сервере целиком, поэтому
+// реплики, пишущие в один ключ, не теряют обновления между чтением и записью. Скрипты
+// грузятся SCRIPT LOAD (в cluster - на все мастера) и вызываются EVALSHA в пайплайне;
+// каждый трогает только ключи из одного слота: токен flush лежит под хеш-тегом своего ключа.
+// Файл повторяет internal/redisclient/scripts.go монолита poly_practise_1 (там go-redis v9);
+// topKScript есть только здесь, остальные скрипты правятся в обеих копиях
+
+// TokenTTL - сколько помнится токен flush, если у ключа нет ttl: дольше этого повтор из
+// журнала применится второй раз
+const TokenTTL = 7 * 24 * time.Hour
+
+// incrScript: KEYS[1] - хеш, KEYS[2] - токен flush (необязателен);
+// ARGV[1] - ttl хеша в мс (0 - без ttl), ARGV[2] - ttl токена в мс,
+// далее тройки поле, тип (i - целое, f - дробное), приращение.
+// Повтор того же flush не меняет хеш и возвращает 0
+var incrScript = redis.NewScript(`
+if KEYS[2] and not redis.call('SET', KEYS[2], 1, 'NX', 'PX', ARGV[2]) then
+	return 0
+end
+for i = 3, #ARGV, 3 do
+	if ARGV[i + 1] == 'f' then
+		redis.call('HINCRBYFLOAT', KEYS[1], ARGV[i], ARGV[i + 2])
+	else
+		redis.call('HINCRBY', KEYS[1], ARGV[i], ARGV[i + 2])
+	end
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// appendScript: KEYS[1] - список, KEYS[2] - токен flush (необязателен);
+// ARGV[1] - сколько последних элементов держать (0 - без обрезки), ARGV[2] - ttl списка в мс,
+// ARGV[3] - ttl токена в мс, далее элементы. Возвращает длину списка или -1 на повторе
+var appendScript = redis.NewScript(`
+if KEYS[2] and not redis.call('SET', KEYS[2], 1, 'NX', 'PX', ARGV[3]) then
+	return -1
+end
+for i = 4, #ARGV, 1000 do
+	redis.call('RPUSH', KEYS[1], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+end
+local cap = tonumber(ARGV[1])
+if cap > 0 then
+	redis.call('LTRIM', KEYS[1], -cap, -1)
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return redis.call('LLEN', KEYS[1])
+`)
+
+// topKScript: KEYS[1] - ZSET счётчиков, KEYS[2] - токен flush (необязателен);
+// ARGV[1] - сколько самых частых элементов держать (0 - все), ARGV[2] - ttl ZSET в мс,
+// ARGV[3] - ttl токена в мс, далее пары элемент, приращение. Повтор того же flush возвращает 0
+var topKScript = redis.NewScript(`
+if KEYS[2] and not redis.call('SET', KEYS[2], 1, 'NX', 'PX', ARGV[3]) then
+	return 0
+end
+for i = 4, #ARGV, 2 do
+	redis.call('ZINCRBY', KEYS[1], ARGV[i + 1], ARGV[i])
+end
+local cap = tonumber(ARGV[1])
+if cap > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -cap - 1)
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// extremumScript: KEYS[1] - хеш; ARGV[1] - max или min, ARGV[2] - ttl хеша в мс,
+// далее пары поле, значение. Поле меняется, только если новое значение больше (меньше)
+// текущего, так что повтор и порядок flush реплик не важны
+var extremumScript = redis.NewScript(`
+for i = 3, #ARGV, 2 do
+	local v = tonumber(ARGV[i + 1])
+	local cur = tonumber(redis.call('HGET', KEYS[1], ARGV[i]))
+	if cur == nil or (ARGV[1] == 'max' and v > cur) or (ARGV[1] == 'min' and v < cur) then
+		redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// indexScript: KEYS[1] - индекс окон (ZSET); ARGV[1] - ttl индекса в мс,
+// ARGV[2] - score, ниже которого записи удаляются (пустая строка - не чистить), далее пары score, ключ окна
+var indexScript = redis.NewScript(`
+for i = 3, #ARGV, 2 do
+	redis.call('ZADD', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+if ARGV[2] ~= '' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[2])
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+var scripts = []*redis.Script{incrScript, appendScript, topKScript, extremumScript, indexScript}
+
+// LoadScripts загружает все скрипты; вызывается до первого пайплайна и после NOSCRIPT
+// (рестарт Redis, SCRIPT FLUSH, failover на реплику без кеша скриптов)
+func LoadScripts(ctx context.Context, rdb redis.UniversalClient) error {
+	for _, s := range scripts {
+		if err := s.Load(ctx, rdb).Err(); err != nil {
+			return fmt.Errorf("script load: %w", err)
+		}
+	}
+	return nil
+}
+
+// IsNoScript - пайплайн упал, потому что скриптов нет в кеше сервера
+func IsNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// NewToken - токен одного flush. Он должен жить вместе с батчем (в журнале тоже),
+// чтобы повтор записи узнавался по нему
+func NewToken() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TokenKey лежит в слоте key, иначе скрипт над ними получил бы CROSSSLOT в cluster
+func TokenKey(key, token string) string {
+	return "{" + key + "}:flush:" + token
+}
+
+// Counters - приращения полей хеша одного flush
+type Counters struct {
+	Ints   map[string]int64
+	Floats map[string]float64
+}
+
+func (c *Counters) AddInt(field string, n int64) {
+	if c.Ints == nil {
+		c.Ints = make(map[string]int64)
+	}
+	c.Ints[field] += n
+}
+
+func (c *Counters) AddFloat(field string, f float64) {
+	if c.Floats == nil {
+		c.Floats = make(map[string]float64)
+	}
+	c.Floats[field] += f
+}
+
+// IncrBy прибавляет счётчики к хешу ровно один раз на token; пустой token - без защиты от повтора
+func IncrBy(ctx context.Context, pipe redis.Pipeliner, key, token string, ttl time.Duration, c Counters) *redis.Cmd {
+	keys := []string{key}
+	if token != "" {
+		keys = append(keys, TokenKey(key, token))
+	}
+	args := make([]interface{}, 0, 2+3*(len(c.Ints)+len(c.Floats)))
+	args = append(args, millis(ttl), millis(tokenTTL(ttl)))
+	for field, n := range c.Ints {
+		args = append(args, field, "i", n)
+	}
+	for field, f := range c.Floats {
+		args = append(args, field, "f", strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return incrScript.EvalSha(ctx, pipe, keys, args...)
+}
+
+// Append дописывает элементы в конец списка ровно один раз на token и оставляет
+// последние capacity (0 - все)
+func Append(ctx context.Context, pipe redis.Pipeliner, key, token string, capacity int, ttl time.Duration, items []string) *redis.Cmd {
+	keys := []string{key}
+	if token != "" {
+		keys = append(keys, TokenKey(key, token))
+	}
+	args := make([]interface{}, 0, 3+len(items))
+	args = append(args, capacity, millis(ttl), millis(tokenTTL(ttl)))
+	for _, item := range items {
+		args = append(args, item)
+	}
+	return appendScript.EvalSha(ctx, pipe, keys, args...)
+}
+
+// TopK прибавляет счётчики к ZSET ровно один раз на token и оставляет capacity самых частых (0 - все)
+func TopK(ctx context.Context, pipe redis.Pipeliner, key, token string, capacity int, ttl time.Duration, counts map[string]int64) *redis.Cmd {
+	keys := []string{key}
+	if token != "" {
+		keys = append(keys, TokenKey(key, token))
+	}
+	args := make([]interface{}, 0, 3+2*len(counts))
+	args = append(args, capacity, millis(ttl), millis(tokenTTL(ttl)))
+	for member, n := range counts {
+		args = append(args, member, n)
+	}
+	return topKScript.EvalSha(ctx, pipe, keys, args...)
+}
+
+// UpdateMax и UpdateMin оставляют в полях хеша наибольшее (наименьшее) из текущего и нового значения
+func UpdateMax(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration, values map[string]float64) *redis.Cmd {
+	return extremum(ctx, pipe, key, "max", ttl, values)
+}
+
+func UpdateMin(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration, values map[string]float64) *redis.Cmd {
+	return extremum(ctx, pipe, key, "min", ttl, values)
+}
+
+func extremum(ctx context.Context, pipe redis.Pipeliner, key, op string, ttl time.Duration, values map[string]float64) *redis.Cmd {
+	args := make([]interface{}, 0, 2+2*len(values))
+	args = append(args, op, millis(ttl))
+	for field, v := range values {
+		args = append(args, field, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return extremumScript.EvalSha(ctx, pipe, []string{key}, args...)
+}
+
+// IndexWindows добавляет ключи окон в индекс со score - началом окна в unix-секундах.
+// С ttl индекс истекает вместе с окнами и чистится от окон старше ttl
+func IndexWindows(ctx context.Context, pipe redis.Pipeliner, index string, ttl time.Duration, windows map[string]int64) *redis.Cmd {
+	expired := ""
+	if ttl > 0 {
+		expired = strconv.FormatInt(time.Now().Add(-ttl).Unix(), 10)
+	}
+	args := make([]interface{}, 0, 2+2*len(windows))
+	args = append(args, millis(ttl), expired)
+	for key, start := range windows {
+		args = append(args, start, key)
+	}
+	return indexScript.EvalSha(ctx, pipe, []string{index}, args...)
+}
+
+func millis(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return d.Milliseconds()
+}
+
+func tokenTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+	return TokenTTL
+}
@@ -0,0 +1,40 @@
+package resilience
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Policy - ограниченные повторы с экспоненциальной задержкой
+type Policy struct {
+	Attempts   int           // всего попыток, включая первую
+	Backoff    time.Duration // задержка перед второй попыткой, дальше удваивается
+	MaxBackoff time.Duration
+}
+
+// Retry вызывает fn, пока она не вернёт nil, не кончатся попытки или не отменится ctx.
+// Задержка берётся случайно из [d/2, d], чтобы реплики не повторяли запросы синхронно
+func Retry(ctx context.Context, p Policy, fn func(ctx context.Context) error, onRetry func(attempt int, err error)) error {
+	attempts := max(p.Attempts, 1)
+	d := p.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil || attempt >= attempts {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+
+		wait := d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if d *= 2; p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+	}
+}
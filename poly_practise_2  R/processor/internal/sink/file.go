@@ -0,0 +1,102 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"processor/config"
+	"shared/sinkio"
+	"time"
+)
+
+var csvHeader = []string{"start", "end", "aggregation", "group", "field", "op", "value"}
+
+// streamSink дописывает записи в поток построчно: JSONL или CSV
+type streamSink struct {
+	out    io.Writer
+	closer io.Closer // nil для stdout
+	format string
+	header bool // CSV: заголовок ещё не записан
+}
+
+// newFileSink - архив на дозапись; Write пишет flush одним вызовом, и его строки
+// не перемешиваются с чужими
+func newFileSink(cfg *config.SinkConfig) (*streamSink, error) {
+	f, header, err := sinkio.OpenAppend(cfg.Path, cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	return &streamSink{out: f, closer: f, format: cfg.Format, header: header}, nil
+}
+
+func newStdoutSink(cfg *config.SinkConfig) (*streamSink, error) {
+	if err := sinkio.CheckFormat(cfg.Format); err != nil {
+		return nil, err
+	}
+	return &streamSink{out: os.Stdout, format: cfg.Format, header: true}, nil
+}
+
+// Write собирает весь flush в буфер и пишет его одним вызовом
+func (s *streamSink) Write(_ context.Context, records []Record) error {
+	buf := bufio.NewWriterSize(s.out, 64*1024)
+	var err error
+	if s.format == FormatCSV {
+		err = s.writeCSV(buf, records)
+	} else {
+		err = s.writeJSONL(buf, records)
+	}
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func (s *streamSink) writeJSONL(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("encode record: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *streamSink) writeCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	if s.header {
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		row := []string{
+			r.Start.UTC().Format(time.RFC3339),
+			r.End.UTC().Format(time.RFC3339),
+			r.Aggregation,
+			r.Group,
+			r.Field,
+			r.Op,
+			formatValue(r.Value),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	s.header = false
+	return nil
+}
+
+func (s *streamSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,46 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"processor/config"
+)
+
+// kafkaSink пишет каждую запись отдельным JSON-сообщением; ключ - "<агрегация>|<группа>",
+// чтобы значения одной группы попадали в одну партицию и читались по порядку
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(cfg *config.SinkConfig, brokers []string) (*kafkaSink, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka sink requires topic")
+	}
+	if len(cfg.Brokers) > 0 {
+		brokers = cfg.Brokers
+	}
+	return &kafkaSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}, nil
+}
+
+func (s *kafkaSink) Write(ctx context.Context, records []Record) error {
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("encode record: %w", err)
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(r.Aggregation + "|" + r.Group), Value: value})
+	}
+	return s.writer.WriteMessages(ctx, msgs...)
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
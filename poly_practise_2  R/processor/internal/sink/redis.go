@@ -0,0 +1,199 @@
+package sink
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"math/rand"
+	"processor/config"
+	"processor/internal/redisclient"
+	"processor/internal/sketch"
+	"strconv"
+	"time"
+)
+
+// CountsAggregation - имя агрегации в ключах для счётчиков сообщений по ключу
+const CountsAggregation = "@count"
+
+// Суффиксы полей, в которых OpAvg хранит сумму и число значений
+const (
+	AvgSumSuffix   = "#sum"
+	AvgCountSuffix = "#count"
+)
+
+// redisSink раскладывает записи по хешам окон agg_window:<агрегация>:<start>:<end>:<instance>,
+// start и end - unix-секунды; для счётчиков сообщений агрегация - @count, поле - ключ сообщения,
+// для остальных поле - "<группа>|<функция>". Реплики пишут в свои ключи, читатель складывает их.
+// Слияние делают Lua-скрипты redisclient на стороне сервера: OpIncr прибавляется один раз на
+// токен flush, поэтому повтор после таймаута или из журнала не удваивает счётчики, а частичный
+// flush открытого окна при остановке и его дозапись после рестарта складываются; OpMax/OpMin
+// сравниваются с записанным значением; OpAvg прибавляет сумму и число значений к полям
+// "<поле>#sum" и "<поле>#count", среднее читатель считает один раз по всем репликам и flush;
+// OpSet - HSET, побеждает последний flush.
+// OpHLL и OpTopK пишутся в отдельные ключи "<хеш>:<поле>" (HyperLogLog и ZSET); PFMERGE
+// повтор не меняет, а счётчики top-K, как и OpIncr, прибавляются один раз на токен.
+// Каждый хеш попадает в индекс agg_window_index:<агрегация> (ZSET, score - начало окна),
+// по которому окна ищутся диапазоном без SCAN. С ttl ключи истекают, а индекс чистится
+// от окон старше ttl на каждой записи
+type redisSink struct {
+	rdb      redis.UniversalClient
+	instance string
+	ttl      time.Duration
+	loaded   bool // скрипты загружены; Write не вызывается конкурентно, его сериализует resilient
+}
+
+func newRedisSink(cfg *config.SinkConfig, redisCfg *config.RedisConfig, instance string) *redisSink {
+	return &redisSink{
+		rdb:      redisclient.New(redisCfg),
+		instance: instance,
+		ttl:      cfg.TTL,
+	}
+}
+
+// hashWrite - всё, что один flush пишет в хеш окна
+type hashWrite struct {
+	start    int64
+	aggr     string
+	token    string
+	counters redisclient.Counters
+	max      map[string]float64
+	min      map[string]float64
+	set      bool // есть OpSet, ttl хешу ставится отдельно
+}
+
+func (s *redisSink) Write(ctx context.Context, records []Record) error {
+	if !s.loaded {
+		if err := redisclient.LoadScripts(ctx, s.rdb); err != nil {
+			return err
+		}
+		s.loaded = true
+	}
+
+	pipe := s.rdb.Pipeline()
+	hashes := make(map[string]*hashWrite)
+	sketches := make(map[string]bool)
+	for _, r := range records {
+		key, field := s.key(r)
+		h, ok := hashes[key]
+		if !ok {
+			h = &hashWrite{start: r.Start.Unix(), aggr: aggregationName(r), token: r.Flush}
+			hashes[key] = h
+		}
+		switch r.Op {
+		case OpIncr:
+			switch v := r.Value.(type) {
+			case int64:
+				h.counters.AddInt(field, v)
+			case float64:
+				h.counters.AddFloat(field, v)
+			}
+		case OpMax, OpMin:
+			v, ok := r.Value.(float64)
+			if !ok {
+				continue
+			}
+			m := &h.max
+			if r.Op == OpMin {
+				m = &h.min
+			}
+			if *m == nil {
+				*m = make(map[string]float64)
+			}
+			(*m)[field] = v
+		case OpAvg:
+			v, ok := r.Value.(float64)
+			if !ok || r.Count == 0 {
+				continue
+			}
+			h.counters.AddFloat(field+AvgSumSuffix, v*float64(r.Count))
+			h.counters.AddInt(field+AvgCountSuffix, r.Count)
+		case OpHLL:
+			// регистры кладутся во временный ключ и сливаются PFMERGE: формат совпадает
+			// с HyperLogLog Redis, так что PFCOUNT по нескольким окнам даёт объединение.
+			// Хеш-тег {dst} кладёт временный ключ в слот dst, иначе в cluster PFMERGE получит CROSSSLOT
+			dst := key + ":" + field
+			tmp := "{" + dst + "}:tmp:" + strconv.FormatInt(rand.Int63(), 36)
+			pipe.Set(ctx, tmp, r.Sketch, time.Minute)
+			pipe.PFMerge(ctx, dst, tmp)
+			pipe.Del(ctx, tmp)
+			sketches[dst] = true
+		case OpTopK:
+			// счётчики добавляются в ZSET скриптом, который обрезает его до capacity самых
+			// частых; токен flush не даёт повтору сложить их второй раз
+			items, _ := r.Value.([]sketch.Item)
+			counts := make(map[string]int64, len(items))
+			for _, it := range items {
+				counts[it.Key] += it.Count
+			}
+			redisclient.TopK(ctx, pipe, key+":"+field, r.Flush, r.Capacity, s.ttl, counts)
+		default:
+			pipe.HSet(ctx, key, field, formatValue(r.Value))
+			h.set = true
+		}
+	}
+
+	indexes := make(map[string]map[string]int64)
+	for key, h := range hashes {
+		if len(h.counters.Ints)+len(h.counters.Floats) > 0 {
+			redisclient.IncrBy(ctx, pipe, key, h.token, s.ttl, h.counters)
+		}
+		if len(h.max) > 0 {
+			redisclient.UpdateMax(ctx, pipe, key, s.ttl, h.max)
+		}
+		if len(h.min) > 0 {
+			redisclient.UpdateMin(ctx, pipe, key, s.ttl, h.min)
+		}
+		if h.set && s.ttl > 0 {
+			pipe.Expire(ctx, key, s.ttl)
+		}
+
+		index := IndexKey(h.aggr)
+		if indexes[index] == nil {
+			indexes[index] = make(map[string]int64)
+		}
+		indexes[index][key] = h.start
+	}
+	for index, windows := range indexes {
+		redisclient.IndexWindows(ctx, pipe, index, s.ttl, windows)
+	}
+	if s.ttl > 0 {
+		for key := range sketches {
+			pipe.Expire(ctx, key, s.ttl)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	if redisclient.IsNoScript(err) {
+		// кеш скриптов потерян; повтор загрузит их заново, уже применённые счётчики токен пропустит
+		s.loaded = false
+	}
+	return err
+}
+
+func (s *redisSink) Close() error {
+	return s.rdb.Close()
+}
+
+func (s *redisSink) key(r Record) (key, field string) {
+	key = WindowKey(aggregationName(r), r.Start, r.End, s.instance)
+	if r.Aggregation == "" {
+		return key, r.Group
+	}
+	return key, r.Group + "|" + r.Field
+}
+
+func aggregationName(r Record) string {
+	if r.Aggregation == "" {
+		return CountsAggregation
+	}
+	return r.Aggregation
+}
+
+// WindowKey - хеш окна одной реплики
+func WindowKey(aggregation string, start, end time.Time, instance string) string {
+	return "agg_window:" + aggregation + ":" + strconv.FormatInt(start.Unix(), 10) + ":" +
+		strconv.FormatInt(end.Unix(), 10) + ":" + instance
+}
+
+// IndexKey - ZSET хешей окон агрегации по времени начала окна
+func IndexKey(aggregation string) string {
+	return "agg_window_index:" + aggregation
+}
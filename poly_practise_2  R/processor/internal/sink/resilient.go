@@ -0,0 +1,277 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"processor/config"
+	"processor/internal/resilience"
+	"processor/internal/sketch"
+	"processor/pkg/metrics"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// resilient оборачивает приёмник повторами и размыкателем. С журналом (wal) flush, который
+// не удалось записать, дописывается в локальный файл и считается принятым; после восстановления
+// приёмника журнал воспроизводится по порядку. Пока журнал не пуст, новые flush тоже
+// встают в его конец, иначе свежие данные обогнали бы старые
+type resilient struct {
+	name    string
+	inner   Sink
+	retry   resilience.Policy
+	breaker *resilience.Breaker
+	wal     *resilience.WAL // nil - без локального буфера, ошибка уходит наружу
+	timeout time.Duration
+	logger  *zap.Logger
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newResilient(cfg *config.SinkConfig, inner Sink, logger *zap.Logger) (*resilient, error) {
+	s := &resilient{
+		name:  cfg.Name,
+		inner: inner,
+		retry: resilience.Policy{
+			Attempts:   cfg.Retry.Attempts,
+			Backoff:    cfg.Retry.Backoff,
+			MaxBackoff: cfg.Retry.MaxBackoff,
+		},
+		timeout: cfg.Timeout,
+		logger:  logger.With(zap.String("sink", cfg.Name)),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.breaker = resilience.NewBreaker(cfg.Breaker.Failures, cfg.Breaker.Cooldown, func(st resilience.State) {
+		metrics.SinkBreakerState.WithLabelValues(cfg.Name).Set(float64(st))
+		s.logger.Warn("sink circuit breaker state changed", zap.Stringer("state", st))
+	})
+
+	if cfg.WAL != "" {
+		wal, err := resilience.OpenWAL(cfg.WAL)
+		if err != nil {
+			return nil, err
+		}
+		s.wal = wal
+		metrics.WALPending.WithLabelValues(cfg.Name).Set(float64(wal.Pending()))
+		if n := wal.Pending(); n > 0 {
+			s.logger.Info("Write-ahead log has undelivered flushes", zap.Int("pending", n))
+		}
+	}
+
+	go s.replayLoop(cfg.Breaker.Cooldown)
+	return s, nil
+}
+
+func (s *resilient) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal != nil && s.wal.Pending() > 0 {
+		s.replay(ctx)
+		if s.wal.Pending() > 0 {
+			return s.buffer(records)
+		}
+	}
+	if !s.breaker.Allow() {
+		if s.wal == nil {
+			return errBreakerOpen
+		}
+		return s.buffer(records)
+	}
+
+	err := resilience.Retry(ctx, s.retry, func(ctx context.Context) error {
+		return s.inner.Write(ctx, records)
+	}, func(attempt int, err error) {
+		metrics.SinkRetries.WithLabelValues(s.name).Inc()
+		s.logger.Warn("sink write failed, retrying", zap.Int("attempt", attempt), zap.Error(err))
+	})
+	if err == nil {
+		s.breaker.Success()
+		return nil
+	}
+	s.breaker.Failure()
+	if s.wal == nil {
+		return err
+	}
+	s.logger.Error("sink write failed, buffering to write-ahead log", zap.Int("records", len(records)), zap.Error(err))
+	return s.buffer(records)
+}
+
+func (s *resilient) buffer(records []Record) error {
+	line, err := encodeWAL(records)
+	if err != nil {
+		return err
+	}
+	if err := s.wal.Append(line); err != nil {
+		return err
+	}
+	metrics.WALBuffered.WithLabelValues(s.name).Inc()
+	metrics.WALPending.WithLabelValues(s.name).Set(float64(s.wal.Pending()))
+	return nil
+}
+
+// replay воспроизводит журнал, пока приёмник отвечает; вызывается под s.mu
+func (s *resilient) replay(ctx context.Context) {
+	if s.wal.Pending() == 0 || !s.breaker.Allow() {
+		return
+	}
+
+	started, pending := time.Now(), s.wal.Pending()
+	n, err := s.wal.Replay(func(line []byte) error {
+		records, err := decodeWAL(line)
+		if err != nil {
+			// битую строку не доставить никогда, она не должна держать остальной журнал
+			s.logger.Error("dropping undecodable write-ahead log entry", zap.Error(err))
+			metrics.MessagesFailed.WithLabelValues("wal_corrupted").Inc()
+			return nil
+		}
+		if err := s.inner.Write(ctx, records); err != nil {
+			return err
+		}
+		pending--
+		metrics.WALReplayed.WithLabelValues(s.name).Inc()
+		metrics.WALPending.WithLabelValues(s.name).Set(float64(pending))
+		return nil
+	})
+	metrics.WALPending.WithLabelValues(s.name).Set(float64(s.wal.Pending()))
+	if err != nil {
+		s.breaker.Failure()
+		s.logger.Warn("write-ahead log replay interrupted",
+			zap.Int("replayed", n), zap.Int("pending", s.wal.Pending()), zap.Error(err))
+		return
+	}
+	s.breaker.Success()
+	if n > 0 {
+		s.logger.Info("Write-ahead log replayed", zap.Int("replayed", n), zap.Duration("took", time.Since(started)))
+	}
+}
+
+// replayLoop догоняет журнал без новых flush: иначе после простоя данные ждали бы следующего окна
+func (s *resilient) replayLoop(interval time.Duration) {
+	defer close(s.done)
+	if s.wal == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+			s.mu.Lock()
+			s.replay(ctx)
+			s.mu.Unlock()
+			cancel()
+		}
+	}
+}
+
+// Close не ждёт доставки журнала: он остаётся на диске и воспроизводится после рестарта
+func (s *resilient) Close() error {
+	close(s.stop)
+	<-s.done
+	var errs []error
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close wal: %w", err))
+		}
+	}
+	if err := s.inner.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// walRecord - Record с явным типом значения: после JSON без него int64 превратился бы во float64,
+// а top-K - в []interface{}
+type walRecord struct {
+	Start       time.Time       `json:"start"`
+	End         time.Time       `json:"end"`
+	Aggregation string          `json:"aggregation,omitempty"`
+	Group       string          `json:"group"`
+	Field       string          `json:"field"`
+	Op          string          `json:"op"`
+	Kind        string          `json:"kind"`
+	Value       json.RawMessage `json:"value"`
+	Sketch      []byte          `json:"sketch,omitempty"`
+	Capacity    int             `json:"capacity,omitempty"`
+	Count       int64           `json:"count,omitempty"`
+	Flush       string          `json:"flush,omitempty"`
+}
+
+func encodeWAL(records []Record) ([]byte, error) {
+	out := make([]walRecord, len(records))
+	for i, r := range records {
+		var kind string
+		switch r.Value.(type) {
+		case int64:
+			kind = "int"
+		case uint64:
+			kind = "uint"
+		case float64:
+			kind = "float"
+		case []sketch.Item:
+			kind = "items"
+		}
+		value, err := json.Marshal(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("encode wal record: %w", err)
+		}
+		out[i] = walRecord{
+			Start: r.Start, End: r.End, Aggregation: r.Aggregation, Group: r.Group, Field: r.Field,
+			Op: r.Op, Kind: kind, Value: value, Sketch: r.Sketch, Capacity: r.Capacity, Count: r.Count, Flush: r.Flush,
+		}
+	}
+	return json.Marshal(out)
+}
+
+func decodeWAL(line []byte) ([]Record, error) {
+	var in []walRecord
+	if err := json.Unmarshal(line, &in); err != nil {
+		return nil, err
+	}
+	out := make([]Record, len(in))
+	for i, w := range in {
+		var (
+			value interface{}
+			err   error
+		)
+		switch w.Kind {
+		case "int":
+			var v int64
+			err = json.Unmarshal(w.Value, &v)
+			value = v
+		case "uint":
+			var v uint64
+			err = json.Unmarshal(w.Value, &v)
+			value = v
+		case "float":
+			var v float64
+			err = json.Unmarshal(w.Value, &v)
+			value = v
+		case "items":
+			var v []sketch.Item
+			err = json.Unmarshal(w.Value, &v)
+			value = v
+		default:
+			err = json.Unmarshal(w.Value, &value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[i] = Record{
+			Start: w.Start, End: w.End, Aggregation: w.Aggregation, Group: w.Group, Field: w.Field,
+			Op: w.Op, Value: value, Sketch: w.Sketch, Capacity: w.Capacity, Count: w.Count, Flush: w.Flush,
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,198 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"processor/config"
+	"processor/internal/redisclient"
+	"processor/pkg/metrics"
+	"shared/sinkio"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TypeRedis  = "redis"
+	TypeKafka  = "kafka"
+	TypeFile   = "file"
+	TypeStdout = "stdout"
+	TypeSQL    = "sql"
+
+	FormatJSONL = sinkio.FormatJSONL
+	FormatCSV   = sinkio.FormatCSV
+)
+
+// Op - как запись сливается с тем, что уже лежит в приёмнике после прошлых flush этого окна
+const (
+	OpIncr = "incr" // число прибавляется к предыдущему значению
+	OpSet  = "set"  // значение заменяет предыдущее
+	OpMax  = "max"  // остаётся большее из значений
+	OpMin  = "min"  // остаётся меньшее из значений
+	OpHLL  = "hll"  // регистры HyperLogLog объединяются, Value - оценка числа различных
+	OpTopK = "topk" // счётчики top-K складываются, Value - []sketch.Item
+	OpAvg  = "avg"  // Value - среднее flush по Count значениям; в redis складываются сумма и число
+)
+
+// Record - одно значение окна: счётчик сообщений по ключу (Aggregation пусто)
+// или функция декларативной агрегации по группе
+type Record struct {
+	Start       time.Time   `json:"start"`
+	End         time.Time   `json:"end"`
+	Aggregation string      `json:"aggregation,omitempty"`
+	Group       string      `json:"group"`
+	Field       string      `json:"field"`
+	Op          string      `json:"op"`
+	Value       interface{} `json:"value"`
+
+	Sketch   []byte `json:"-"` // OpHLL: регистры в формате HyperLogLog Redis
+	Capacity int    `json:"-"` // OpTopK: сколько самых частых элементов держать
+	Count    int64  `json:"-"` // OpAvg: по скольким значениям посчитано среднее
+	Flush    string `json:"-"` // токен flush: повтор записи с тем же токеном OpIncr не применяет
+}
+
+// Sink - приёмник результатов закрытых окон
+type Sink interface {
+	Write(ctx context.Context, records []Record) error
+	Close() error
+}
+
+// New; instance - имя реплики, попадает в ключи redis, чтобы реплики не перезаписывали друг друга
+func New(cfg *config.SinkConfig, redisCfg *config.RedisConfig, brokers []string, instance string) (Sink, error) {
+	switch cfg.Type {
+	case TypeRedis:
+		return newRedisSink(cfg, redisCfg, instance), nil
+	case TypeKafka:
+		return newKafkaSink(cfg, brokers)
+	case TypeFile:
+		return newFileSink(cfg)
+	case TypeStdout:
+		return newStdoutSink(cfg)
+	case TypeSQL:
+		return newSQLSink(cfg)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+type target struct {
+	name     string
+	sink     Sink
+	required bool
+	timeout  time.Duration
+}
+
+// Fanout пишет один и тот же набор записей во все приёмники параллельно. Ошибка приёмника
+// логируется и попадает в метрику; наружу возвращаются только ошибки приёмников с required
+type Fanout struct {
+	targets []target
+	logger  *zap.Logger
+}
+
+func NewFanout(cfgs []config.SinkConfig, redisCfg *config.RedisConfig, brokers []string, instance string,
+	logger *zap.Logger) (*Fanout, error) {
+	f := &Fanout{logger: logger}
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		s, err := New(cfg, redisCfg, brokers, instance)
+		if err == nil {
+			s, err = newResilient(cfg, s, logger)
+		}
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("sink %q: %w", cfg.Name, err)
+		}
+		f.targets = append(f.targets, target{name: cfg.Name, sink: s, required: cfg.Required, timeout: cfg.Timeout})
+	}
+	return f, nil
+}
+
+// Write помечает записи токеном flush до повторов и журнала, чтобы все попытки записи
+// одного flush несли один токен
+func (f *Fanout) Write(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	token := redisclient.NewToken()
+	for i := range records {
+		if records[i].Flush == "" {
+			records[i].Flush = token
+		}
+	}
+
+	errs := make([]error, len(f.targets))
+	var wg sync.WaitGroup
+	for i, t := range f.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.write(ctx, t, records)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (f *Fanout) write(ctx context.Context, t target, records []Record) error {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	err := t.sink.Write(ctx, records)
+	metrics.SinkWriteDuration.WithLabelValues(t.name).Observe(time.Since(started).Seconds())
+	if err != nil {
+		metrics.SinkWrites.WithLabelValues(t.name, "error").Inc()
+		f.logger.Error("sink write failed",
+			zap.String("sink", t.name),
+			zap.Int("records", len(records)),
+			zap.Bool("required", t.required),
+			zap.Error(err),
+		)
+		if t.required {
+			return fmt.Errorf("sink %q: %w", t.name, err)
+		}
+		return nil
+	}
+	metrics.SinkWrites.WithLabelValues(t.name, "ok").Inc()
+	metrics.SinkRecords.WithLabelValues(t.name).Add(float64(len(records)))
+	return nil
+}
+
+func (f *Fanout) Close() error {
+	var errs []error
+	for _, t := range f.targets {
+		if err := t.sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close sink %q: %w", t.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// formatValue приводит значение к строке для текстовых приёмников: числа и строки как есть,
+// составные значения (top-K, last по объекту) - JSON
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
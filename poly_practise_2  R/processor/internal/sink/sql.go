@@ -0,0 +1,45 @@
+package sink
+
+import (
+	"context"
+	"processor/config"
+	"shared/sinkio"
+)
+
+// sqlSink вставляет записи строками в таблицу через database/sql (sinkio.Table).
+// Ожидаемая схема:
+//
+//	CREATE TABLE aggregates (
+//	    window_start TIMESTAMP, window_end TIMESTAMP,
+//	    aggregation TEXT, grp TEXT, field TEXT, op TEXT, value TEXT
+//	);
+//
+// Слияние по op (сумма для incr, последнее значение для set) остаётся запросам
+type sqlSink struct {
+	table *sinkio.Table
+}
+
+func newSQLSink(cfg *config.SinkConfig) (*sqlSink, error) {
+	columns := []string{"window_start", "window_end", "aggregation", "grp", "field", "op", "value"}
+	table, err := sinkio.OpenTable(cfg.Driver, cfg.DSN, cfg.Table, cfg.Placeholder, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlSink{table: table}, nil
+}
+
+// Write вставляет весь flush в одной транзакции, чтобы окно не записалось наполовину
+func (s *sqlSink) Write(ctx context.Context, records []Record) error {
+	return s.table.Insert(ctx, func(insert func(args ...interface{}) error) error {
+		for _, r := range records {
+			if err := insert(r.Start.UTC(), r.End.UTC(), r.Aggregation, r.Group, r.Field, r.Op, formatValue(r.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlSink) Close() error {
+	return s.table.Close()
+}
@@ -0,0 +1,215 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Параметры и формат совпадают с плотным представлением HyperLogLog в Redis,
+// поэтому Bytes() можно положить в Redis и слить с другими ключами через PFMERGE
+const (
+	hllP         = 14
+	hllQ         = 64 - hllP
+	hllRegisters = 1 << hllP
+	hllBits      = 6
+	hllRegMax    = 1<<hllBits - 1
+	hllHdrSize   = 16
+	hllDenseSize = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllSeed      = 0xadc83b19
+	hllAlphaInf  = 0.721347520444481703680
+)
+
+// HLL - HyperLogLog на 16384 шестибитных регистра (~12 КБ, стандартная ошибка ~0.81%)
+type HLL struct {
+	regs []byte // упакованные регистры, как в Redis после заголовка
+}
+
+func NewHLL() *HLL {
+	return &HLL{regs: make([]byte, hllDenseSize-hllHdrSize)}
+}
+
+func (h *HLL) Add(item string) {
+	index, count := patLen([]byte(item))
+	if count > h.get(index) {
+		h.set(index, count)
+	}
+}
+
+func (h *HLL) Merge(other *HLL) {
+	for i := 0; i < hllRegisters; i++ {
+		if v := other.get(i); v > h.get(i) {
+			h.set(i, v)
+		}
+	}
+}
+
+// Count - оценка кардинальности тем же estimator'ом, что и PFCOUNT
+func (h *HLL) Count() uint64 {
+	var histo [64]int
+	for i := 0; i < hllRegisters; i++ {
+		histo[h.get(i)]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * tau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// Bytes возвращает строку в формате Redis (dense, кеш кардинальности помечен невалидным)
+func (h *HLL) Bytes() []byte {
+	out := make([]byte, hllDenseSize)
+	copy(out, "HYLL")
+	out[15] = 1 << 7
+	copy(out[hllHdrSize:], h.regs)
+	return out
+}
+
+// MarshalJSON кодирует HLL как base64 строки в формате Redis
+func (h *HLL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Bytes())
+}
+
+func (h *HLL) UnmarshalJSON(data []byte) error {
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	parsed, err := FromBytes(b)
+	if err != nil {
+		return err
+	}
+	h.regs = parsed.regs
+	return nil
+}
+
+// FromBytes разбирает HLL, ранее полученный через Bytes
+func FromBytes(b []byte) (*HLL, error) {
+	if len(b) != hllDenseSize || string(b[:4]) != "HYLL" || b[4] != 0 {
+		return nil, fmt.Errorf("not a dense HyperLogLog")
+	}
+	h := NewHLL()
+	copy(h.regs, b[hllHdrSize:])
+	return h, nil
+}
+
+func (h *HLL) get(reg int) uint8 {
+	byteIdx := reg * hllBits / 8
+	fb := uint(reg*hllBits) & 7
+	b0 := uint(h.regs[byteIdx])
+	var b1 uint
+	if byteIdx+1 < len(h.regs) {
+		b1 = uint(h.regs[byteIdx+1])
+	}
+	return uint8((b0>>fb | b1<<(8-fb)) & hllRegMax)
+}
+
+func (h *HLL) set(reg int, val uint8) {
+	byteIdx := reg * hllBits / 8
+	fb := uint(reg*hllBits) & 7
+	v := uint(val)
+	h.regs[byteIdx] &^= byte(hllRegMax << fb)
+	h.regs[byteIdx] |= byte(v << fb)
+	if byteIdx+1 < len(h.regs) {
+		h.regs[byteIdx+1] &^= byte(hllRegMax >> (8 - fb))
+		h.regs[byteIdx+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// patLen - номер регистра и длина серии нулей + 1, как hllPatLen в Redis
+func patLen(item []byte) (int, uint8) {
+	hash := murmur64A(item, hllSeed)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+func murmur64A(data []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+	h := seed ^ uint64(len(data))*m
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	switch len(data) {
+	case 7:
+		h ^= uint64(data[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(data[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(data[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(data[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(data[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package sketch
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func hllOf(from, to int) *HLL {
+	h := NewHLL()
+	for i := from; i < to; i++ {
+		h.Add("item-" + strconv.Itoa(i))
+	}
+	return h
+}
+
+func TestHLLCount(t *testing.T) {
+	tests := []struct {
+		n   int
+		tol float64 // допустимая относительная ошибка: три стандартных ошибки
+	}{
+		{0, 0},
+		{1, 0},
+		{100, 0.03},
+		{1000, 0.03},
+		{50000, 0.03},
+	}
+	for _, tt := range tests {
+		h := hllOf(0, tt.n)
+		h.Merge(hllOf(0, tt.n)) // повторы не меняют оценку
+		got := float64(h.Count())
+		if diff := math.Abs(got - float64(tt.n)); diff > tt.tol*float64(tt.n) {
+			t.Errorf("Count() of %d items = %.0f, error %.2f%% > %.0f%%", tt.n, got, 100*diff/float64(max(tt.n, 1)), 100*tt.tol)
+		}
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	a, b := hllOf(0, 6000), hllOf(4000, 10000) // пересечение 2000
+	a.Merge(b)
+	if got := float64(a.Count()); math.Abs(got-10000) > 0.03*10000 {
+		t.Errorf("Count() of union = %.0f, want about 10000", got)
+	}
+}
+
+// TestHLLBytes проверяет формат, который кладётся в Redis и сливается там через PFMERGE
+func TestHLLBytes(t *testing.T) {
+	h := hllOf(0, 5000)
+	b := h.Bytes()
+	if len(b) != hllDenseSize || string(b[:4]) != "HYLL" || b[4] != 0 {
+		t.Fatalf("Bytes() header = %q, len %d; want dense HYLL of %d bytes", b[:5], len(b), hllDenseSize)
+	}
+	if b[15]&(1<<7) == 0 {
+		t.Error("cardinality cache is not marked invalid: PFCOUNT would return a stale value")
+	}
+
+	parsed, err := FromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Bytes(), b) || parsed.Count() != h.Count() {
+		t.Errorf("FromBytes(Bytes()) count = %d, want %d", parsed.Count(), h.Count())
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored HLL
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Count() != h.Count() {
+		t.Errorf("JSON round trip count = %d, want %d", restored.Count(), h.Count())
+	}
+
+	for name, bad := range map[string][]byte{
+		"short":  b[:100],
+		"magic":  append([]byte("XYLL"), b[4:]...),
+		"sparse": append([]byte("HYLL\x01"), b[5:]...),
+	} {
+		if _, err := FromBytes(bad); err == nil {
+			t.Errorf("FromBytes(%s) returned no error", name)
+		}
+	}
+}
+
+func topOf(capacity int, counts map[string]int64) *TopK {
+	top := NewTopK(capacity)
+	for key, n := range counts {
+		top.Add(key, n)
+	}
+	return top
+}
+
+func keys(items []Item) string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.Key
+	}
+	return strings.Join(out, ",")
+}
+
+func TestTopK(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		adds     []string
+		k        int
+		want     []Item
+	}{
+		{
+			name:     "exact within capacity",
+			capacity: 10,
+			adds:     []string{"a", "b", "a", "c", "a", "b"},
+			k:        2,
+			want:     []Item{{"a", 3, 0}, {"b", 2, 0}},
+		},
+		{
+			name:     "k zero returns all",
+			capacity: 10,
+			adds:     []string{"a", "b", "b"},
+			want:     []Item{{"b", 2, 0}, {"a", 1, 0}},
+		},
+		{
+			name:     "eviction inherits minimum as error",
+			capacity: 2,
+			adds:     []string{"a", "a", "a", "b", "c"},
+			want:     []Item{{"a", 3, 0}, {"c", 2, 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top := NewTopK(tt.capacity)
+			for _, key := range tt.adds {
+				top.Add(key, 1)
+			}
+			got := top.Top(tt.k)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Top(%d) = %v, want %v", tt.k, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Top(%d)[%d] = %v, want %v", tt.k, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTopKMerge(t *testing.T) {
+	a := topOf(3, map[string]int64{"a": 5, "b": 2})
+	b := topOf(3, map[string]int64{"b": 4, "c": 1, "d": 3})
+	a.Merge(b)
+
+	// c вытеснен, d унаследовал его счётчик как погрешность
+	got := a.Top(0)
+	want := []Item{{"b", 6, 0}, {"a", 5, 0}, {"d", 4, 1}}
+	if len(got) != len(want) {
+		t.Fatalf("merged Top = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("merged Top[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTopK(2) // меньшая ёмкость оставляет самые частые
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(restored.Top(0)); got != "b,a" {
+		t.Errorf("restored Top = %s, want b,a", got)
+	}
+}
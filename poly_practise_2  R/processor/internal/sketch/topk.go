@@ -0,0 +1,125 @@
+package sketch
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sort"
+)
+
+// Item - элемент top-K; Err - верхняя граница переоценки Count
+type Item struct {
+	Key   string
+	Count int64
+	Err   int64
+}
+
+// TopK - Space-Saving: держит не больше capacity счётчиков, при переполнении
+// вытесняет минимальный и наследует его значение как погрешность
+type TopK struct {
+	capacity int
+	index    map[string]int // ключ -> позиция в куче
+	heap     itemHeap
+}
+
+func NewTopK(capacity int) *TopK {
+	t := &TopK{capacity: capacity, index: make(map[string]int, capacity)}
+	t.heap.index = t.index
+	return t
+}
+
+func (t *TopK) Add(key string, n int64) {
+	if i, ok := t.index[key]; ok {
+		t.heap.items[i].Count += n
+		heap.Fix(&t.heap, i)
+		return
+	}
+	if len(t.heap.items) < t.capacity {
+		heap.Push(&t.heap, Item{Key: key, Count: n})
+		return
+	}
+
+	min := t.heap.items[0]
+	delete(t.index, min.Key)
+	t.heap.items[0] = Item{Key: key, Count: min.Count + n, Err: min.Count}
+	t.index[key] = 0
+	heap.Fix(&t.heap, 0)
+}
+
+func (t *TopK) Capacity() int {
+	return t.capacity
+}
+
+// Merge складывает счётчики двух сводок; элементы, не попавшие в capacity, отбрасываются
+func (t *TopK) Merge(other *TopK) {
+	for _, it := range other.heap.items {
+		if i, ok := t.index[it.Key]; ok {
+			t.heap.items[i].Count += it.Count
+			t.heap.items[i].Err += it.Err
+			heap.Fix(&t.heap, i)
+			continue
+		}
+		t.Add(it.Key, it.Count)
+	}
+}
+
+// Top возвращает до k элементов по убыванию счётчика
+func (t *TopK) Top(k int) []Item {
+	out := make([]Item, len(t.heap.items))
+	copy(out, t.heap.items)
+	sort.Slice(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	if k > 0 && len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// MarshalJSON сохраняет все счётчики вместе с погрешностями
+func (t *TopK) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.heap.items)
+}
+
+// UnmarshalJSON восстанавливает счётчики в сводку, созданную NewTopK
+func (t *TopK) UnmarshalJSON(data []byte) error {
+	var items []Item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Count > items[j].Count })
+	t.index = make(map[string]int, t.capacity)
+	t.heap = itemHeap{index: t.index}
+	for _, it := range items {
+		if len(t.heap.items) >= t.capacity {
+			break
+		}
+		heap.Push(&t.heap, it)
+	}
+	return nil
+}
+
+// itemHeap - min-куча по Count с обратным индексом для heap.Fix
+type itemHeap struct {
+	items []Item
+	index map[string]int
+}
+
+func (h *itemHeap) Len() int           { return len(h.items) }
+func (h *itemHeap) Less(i, j int) bool { return h.items[i].Count < h.items[j].Count }
+
+func (h *itemHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].Key] = i
+	h.index[h.items[j].Key] = j
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	it := x.(Item)
+	h.index[it.Key] = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *itemHeap) Pop() interface{} {
+	it := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, it.Key)
+	return it
+}
@@ -0,0 +1,363 @@
+package window
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"processor/config"
+	"sort"
+	"time"
+)
+
+const (
+	TypeTumbling = "tumbling"
+	TypeHopping  = "hopping"
+	TypeSession  = "session"
+
+	TimeFromHeader = "header"
+	TimeFromKafka  = "kafka"
+)
+
+// Window - полуинтервал событийного времени [Start, End)
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// State - накопленное состояние окна; Merge нужен для слияния сессий
+type State interface {
+	Merge(other State)
+}
+
+// Result - закрытое окно и его состояние
+type Result struct {
+	Window
+	State State
+}
+
+type session struct {
+	Window
+	state State
+}
+
+// source - входная партиция: максимальное событийное время в ней и когда по часам
+// процесса пришло её последнее событие
+type source struct {
+	maxEventTime time.Time
+	seen         time.Time
+}
+
+// Windows раскладывает события по окнам событийного времени и закрывает окна по watermark.
+// Не потокобезопасен: вызывается из одного цикла агрегатора
+type Windows struct {
+	cfg      *config.WindowConfig
+	newState func() State
+	now      func() time.Time
+
+	open     map[Window]State      // tumbling, hopping
+	sessions map[string][]*session // session: ключ -> сессии по возрастанию Start
+
+	sources map[string]*source // входная партиция -> её событийное время
+}
+
+func New(cfg *config.WindowConfig, newState func() State) (*Windows, error) {
+	switch cfg.Type {
+	case TypeTumbling:
+		if cfg.Size <= 0 {
+			return nil, fmt.Errorf("tumbling window requires size")
+		}
+	case TypeHopping:
+		if cfg.Size <= 0 || cfg.Slide <= 0 || cfg.Slide > cfg.Size {
+			return nil, fmt.Errorf("hopping window requires size and 0 < slide <= size")
+		}
+	case TypeSession:
+		if cfg.Gap <= 0 {
+			return nil, fmt.Errorf("session window requires gap")
+		}
+	default:
+		return nil, fmt.Errorf("unknown window type %q", cfg.Type)
+	}
+	switch cfg.TimeSource {
+	case TimeFromHeader, TimeFromKafka:
+	default:
+		return nil, fmt.Errorf("unknown window time source %q", cfg.TimeSource)
+	}
+
+	return &Windows{
+		cfg:      cfg,
+		newState: newState,
+		now:      time.Now,
+		open:     make(map[Window]State),
+		sessions: make(map[string][]*session),
+		sources:  make(map[string]*source),
+	}, nil
+}
+
+// EventTime берёт время из заголовка (RFC3339); false - источник header, а заголовка нет
+// или он не разобран, и возвращено время сообщения Kafka
+func (w *Windows) EventTime(msg kafka.Message) (time.Time, bool) {
+	if w.cfg.TimeSource != TimeFromHeader {
+		return msg.Time, true
+	}
+	for _, h := range msg.Headers {
+		if h.Key != w.cfg.TimeHeader {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, string(h.Value)); err == nil {
+			return t, true
+		}
+		break
+	}
+	return msg.Time, false
+}
+
+// Watermark - минимум по партициям их максимального событийного времени минус допустимое
+// опоздание: партиция, отставшая от остальных, не теряет свои события как опоздавшие.
+// Партиции без событий дольше IdleTimeout не учитываются; если простаивают все, ждать
+// нечего и берётся максимум
+func (w *Windows) Watermark() time.Time {
+	now := w.now()
+	var active, idle time.Time
+	for _, src := range w.sources {
+		if w.cfg.IdleTimeout > 0 && now.Sub(src.seen) > w.cfg.IdleTimeout {
+			if src.maxEventTime.After(idle) {
+				idle = src.maxEventTime
+			}
+			continue
+		}
+		if active.IsZero() || src.maxEventTime.Before(active) {
+			active = src.maxEventTime
+		}
+	}
+	if active.IsZero() {
+		active = idle
+	}
+	if active.IsZero() {
+		return time.Time{}
+	}
+	return active.Add(-w.cfg.AllowedLateness)
+}
+
+// Add возвращает состояния окон, в которые попадает событие входной партиции src; пусто -
+// событие опоздало: все его окна уже закрыты watermark'ом
+func (w *Windows) Add(src, key string, t time.Time) []State {
+	t = t.UTC() // окна - ключи map, зона и монотонные часы не должны их различать
+	wm := w.Watermark()
+	s, ok := w.sources[src]
+	if !ok {
+		s = &source{}
+		w.sources[src] = s
+	}
+	s.seen = w.now()
+	if t.After(s.maxEventTime) {
+		s.maxEventTime = t
+	}
+
+	if w.cfg.Type == TypeSession {
+		if !wm.IsZero() && !t.Add(w.cfg.Gap).After(wm) {
+			return nil
+		}
+		return []State{w.addSession(key, t)}
+	}
+
+	var out []State
+	for _, win := range w.assign(t) {
+		if !wm.IsZero() && !win.End.After(wm) {
+			continue
+		}
+		st, ok := w.open[win]
+		if !ok {
+			st = w.newState()
+			w.open[win] = st
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+func (w *Windows) assign(t time.Time) []Window {
+	if w.cfg.Type == TypeTumbling {
+		start := t.Truncate(w.cfg.Size)
+		return []Window{{Start: start, End: start.Add(w.cfg.Size)}}
+	}
+
+	var out []Window
+	for start := t.Truncate(w.cfg.Slide); start.Add(w.cfg.Size).After(t); start = start.Add(-w.cfg.Slide) {
+		out = append(out, Window{Start: start, End: start.Add(w.cfg.Size)})
+	}
+	return out
+}
+
+// addSession открывает сессию [t, t+gap) и сливает её со всеми пересекающимися сессиями ключа
+func (w *Windows) addSession(key string, t time.Time) State {
+	cur := &session{Window: Window{Start: t, End: t.Add(w.cfg.Gap)}, state: w.newState()}
+
+	kept := w.sessions[key][:0]
+	for _, s := range w.sessions[key] {
+		if s.Start.After(cur.End) || cur.Start.After(s.End) {
+			kept = append(kept, s)
+			continue
+		}
+		if s.Start.Before(cur.Start) {
+			cur.Start = s.Start
+		}
+		if s.End.After(cur.End) {
+			cur.End = s.End
+		}
+		cur.state.Merge(s.state)
+	}
+	kept = append(kept, cur)
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Start.Before(kept[j].Start) })
+	w.sessions[key] = kept
+	return cur.state
+}
+
+// Closed забирает окна, конец которых не позже watermark
+func (w *Windows) Closed() []Result {
+	wm := w.Watermark()
+	if wm.IsZero() {
+		return nil
+	}
+	return w.drain(func(win Window) bool { return !win.End.After(wm) })
+}
+
+// Drain забирает все окна, в том числе открытые - для финального flush при остановке
+func (w *Windows) Drain() []Result {
+	return w.drain(func(Window) bool { return true })
+}
+
+// Open - число открытых окон (для сессий - открытых сессий)
+func (w *Windows) Open() int {
+	if w.cfg.Type != TypeSession {
+		return len(w.open)
+	}
+	n := 0
+	for _, ss := range w.sessions {
+		n += len(ss)
+	}
+	return n
+}
+
+// States - состояния всех открытых окон
+func (w *Windows) States() []State {
+	var out []State
+	for _, st := range w.open {
+		out = append(out, st)
+	}
+	for _, ss := range w.sessions {
+		for _, s := range ss {
+			out = append(out, s.state)
+		}
+	}
+	return out
+}
+
+func (w *Windows) drain(match func(Window) bool) []Result {
+	var out []Result
+	if w.cfg.Type != TypeSession {
+		for win, st := range w.open {
+			if match(win) {
+				out = append(out, Result{Window: win, State: st})
+				delete(w.open, win)
+			}
+		}
+		return out
+	}
+
+	for key, ss := range w.sessions {
+		kept := ss[:0]
+		for _, s := range ss {
+			if match(s.Window) {
+				out = append(out, Result{Window: s.Window, State: s.state})
+				continue
+			}
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(w.sessions, key)
+		} else {
+			w.sessions[key] = kept
+		}
+	}
+	return out
+}
+
+type snapshot struct {
+	EventTimes map[string]time.Time `json:"event_times"` // входная партиция -> максимальное событийное время
+	Windows    []snapshotWindow     `json:"windows"`
+}
+
+type snapshotWindow struct {
+	Start time.Time       `json:"start"`
+	End   time.Time       `json:"end"`
+	Key   string          `json:"key,omitempty"` // ключ сессии
+	State json.RawMessage `json:"state"`
+}
+
+// Snapshot сериализует открытые окна; состояние окна должно сериализоваться в JSON
+func (w *Windows) Snapshot() ([]byte, error) {
+	snap := snapshot{EventTimes: make(map[string]time.Time, len(w.sources))}
+	for name, src := range w.sources {
+		snap.EventTimes[name] = src.maxEventTime
+	}
+	add := func(win Window, key string, st State) error {
+		data, err := json.Marshal(st)
+		if err != nil {
+			return fmt.Errorf("encode window state: %w", err)
+		}
+		snap.Windows = append(snap.Windows, snapshotWindow{Start: win.Start, End: win.End, Key: key, State: data})
+		return nil
+	}
+
+	for win, st := range w.open {
+		if err := add(win, "", st); err != nil {
+			return nil, err
+		}
+	}
+	for key, ss := range w.sessions {
+		for _, s := range ss {
+			if err := add(s.Window, key, s.state); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(snap)
+}
+
+// Reset забывает открытые окна и событийное время партиций
+func (w *Windows) Reset() {
+	w.open = make(map[Window]State)
+	w.sessions = make(map[string][]*session)
+	w.sources = make(map[string]*source)
+}
+
+// Restore заменяет текущие окна окнами из снапшота
+func (w *Windows) Restore(data []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode windows snapshot: %w", err)
+	}
+
+	w.open = make(map[Window]State)
+	w.sessions = make(map[string][]*session)
+	w.sources = make(map[string]*source, len(snap.EventTimes))
+	for name, t := range snap.EventTimes {
+		w.sources[name] = &source{maxEventTime: t.UTC(), seen: w.now()}
+	}
+	for _, sw := range snap.Windows {
+		st := w.newState()
+		if err := json.Unmarshal(sw.State, st); err != nil {
+			return fmt.Errorf("decode window state: %w", err)
+		}
+		win := Window{Start: sw.Start.UTC(), End: sw.End.UTC()}
+		if w.cfg.Type == TypeSession {
+			w.sessions[sw.Key] = append(w.sessions[sw.Key], &session{Window: win, state: st})
+			continue
+		}
+		w.open[win] = st
+	}
+	for _, ss := range w.sessions {
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Start.Before(ss[j].Start) })
+	}
+	return nil
+}
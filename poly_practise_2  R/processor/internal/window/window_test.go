@@ -0,0 +1,204 @@
+package window
+
+import (
+	"processor/config"
+	"sort"
+	"testing"
+	"time"
+)
+
+// counter - состояние окна в тестах: число событий, сессии при слиянии складываются
+type counter struct{ n int }
+
+func (c *counter) Merge(other State) { c.n += other.(*counter).n }
+
+func newWindows(t *testing.T, cfg config.WindowConfig) *Windows {
+	t.Helper()
+	if cfg.TimeSource == "" {
+		cfg.TimeSource = TimeFromHeader
+	}
+	w, err := New(&cfg, func() State { return &counter{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func at(hms string) time.Time {
+	t, err := time.Parse(time.TimeOnly, hms)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2026, 10, 19, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// drained - окна и число событий в них по возрастанию Start
+func drained(w *Windows) ([]Window, []int) {
+	results := w.Drain()
+	sort.Slice(results, func(i, j int) bool { return results[i].Start.Before(results[j].Start) })
+	wins := make([]Window, len(results))
+	counts := make([]int, len(results))
+	for i, r := range results {
+		wins[i] = r.Window
+		counts[i] = r.State.(*counter).n
+	}
+	return wins, counts
+}
+
+func TestAssign(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.WindowConfig
+		at   string
+		want []Window
+	}{
+		{
+			name: "tumbling",
+			cfg:  config.WindowConfig{Type: TypeTumbling, Size: time.Minute},
+			at:   "12:00:30",
+			want: []Window{{at("12:00:00"), at("12:01:00")}},
+		},
+		{
+			name: "tumbling on boundary",
+			cfg:  config.WindowConfig{Type: TypeTumbling, Size: time.Minute},
+			at:   "12:01:00",
+			want: []Window{{at("12:01:00"), at("12:02:00")}},
+		},
+		{
+			name: "hopping",
+			cfg:  config.WindowConfig{Type: TypeHopping, Size: time.Minute, Slide: 20 * time.Second},
+			at:   "12:00:30",
+			want: []Window{
+				{at("11:59:40"), at("12:00:40")},
+				{at("12:00:00"), at("12:01:00")},
+				{at("12:00:20"), at("12:01:20")},
+			},
+		},
+		{
+			name: "hopping with slide equal to size",
+			cfg:  config.WindowConfig{Type: TypeHopping, Size: time.Minute, Slide: time.Minute},
+			at:   "12:00:30",
+			want: []Window{{at("12:00:00"), at("12:01:00")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindows(t, tt.cfg)
+			if got := w.Add("p0", "k", at(tt.at)); len(got) != len(tt.want) {
+				t.Fatalf("Add returned %d states, want %d", len(got), len(tt.want))
+			}
+			wins, _ := drained(w)
+			if len(wins) != len(tt.want) {
+				t.Fatalf("windows = %v, want %v", wins, tt.want)
+			}
+			for i := range wins {
+				if wins[i] != tt.want[i] {
+					t.Errorf("window %d = %v, want %v", i, wins[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	w := newWindows(t, config.WindowConfig{Type: TypeSession, Gap: 30 * time.Second})
+	for _, e := range []struct{ key, at string }{
+		{"a", "12:00:00"},
+		{"a", "12:00:20"}, // в пределах gap - та же сессия
+		{"b", "12:00:10"}, // у другого ключа свои сессии
+		{"a", "12:02:00"}, // после паузы - новая
+	} {
+		st := w.Add("p0", e.key, at(e.at))
+		if len(st) != 1 {
+			t.Fatalf("Add(%s, %s) returned %d states, want 1", e.key, e.at, len(st))
+		}
+		st[0].(*counter).n++
+	}
+	if got := w.Open(); got != 3 {
+		t.Fatalf("Open() = %d, want 3", got)
+	}
+
+	wins, counts := drained(w)
+	want := []Window{
+		{at("12:00:00"), at("12:00:50")},
+		{at("12:00:10"), at("12:00:40")},
+		{at("12:02:00"), at("12:02:30")},
+	}
+	wantCounts := []int{2, 1, 1}
+	for i := range want {
+		if wins[i] != want[i] || counts[i] != wantCounts[i] {
+			t.Errorf("session %d = %v with %d events, want %v with %d", i, wins[i], counts[i], want[i], wantCounts[i])
+		}
+	}
+}
+
+func TestLateness(t *testing.T) {
+	tumbling := config.WindowConfig{Type: TypeTumbling, Size: time.Minute, AllowedLateness: 10 * time.Second}
+	tests := []struct {
+		name   string
+		cfg    config.WindowConfig
+		late   string
+		states int // 0 - событие опоздало
+	}{
+		{"window closed by watermark", tumbling, "12:00:50", 0},
+		{"window still open", tumbling, "12:01:05", 1},
+		{"allowed lateness keeps window", config.WindowConfig{Type: TypeTumbling, Size: time.Minute, AllowedLateness: time.Minute}, "12:00:50", 1},
+		{"hopping skips closed windows", config.WindowConfig{Type: TypeHopping, Size: time.Minute, Slide: 30 * time.Second}, "12:01:10", 1},
+		{"hopping all windows closed", config.WindowConfig{Type: TypeHopping, Size: time.Minute, Slide: 30 * time.Second}, "12:00:50", 0},
+		{"session ended before watermark", config.WindowConfig{Type: TypeSession, Gap: 30 * time.Second}, "12:00:50", 0},
+		{"session reaches watermark", config.WindowConfig{Type: TypeSession, Gap: 30 * time.Second}, "12:01:10", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindows(t, tt.cfg)
+			w.Add("p0", "k", at("12:01:30"))
+			if got := w.Add("p0", "k", at(tt.late)); len(got) != tt.states {
+				t.Errorf("event at %s got %d states, want %d (watermark %s)", tt.late, len(got), tt.states, w.Watermark().Format(time.TimeOnly))
+			}
+		})
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	base := at("15:00:00") // часы процесса
+	tests := []struct {
+		name string
+		idle time.Duration
+		p1At time.Duration // когда по часам процесса пришло последнее событие p1
+		want string
+	}{
+		{"minimum over partitions", time.Minute, 0, "12:00:50"},
+		{"idle partition does not hold watermark", time.Minute, -2 * time.Minute, "12:04:50"},
+		{"idle timeout disabled", 0, -2 * time.Minute, "12:00:50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindows(t, config.WindowConfig{Type: TypeTumbling, Size: time.Minute, AllowedLateness: 10 * time.Second, IdleTimeout: tt.idle})
+			w.now = func() time.Time { return base.Add(tt.p1At) }
+			w.Add("p1", "k", at("12:01:00"))
+			w.now = func() time.Time { return base }
+			w.Add("p0", "k", at("12:05:00"))
+
+			if got := w.Watermark(); !got.Equal(at(tt.want)) {
+				t.Errorf("Watermark() = %s, want %s", got.Format(time.TimeOnly), tt.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkAllIdle(t *testing.T) {
+	w := newWindows(t, config.WindowConfig{Type: TypeTumbling, Size: time.Minute, IdleTimeout: time.Minute})
+	start := at("15:00:00")
+	w.now = func() time.Time { return start }
+	w.Add("p0", "k", at("12:01:00"))
+	w.Add("p1", "k", at("12:05:00"))
+	w.now = func() time.Time { return start.Add(time.Hour) }
+
+	if got := w.Watermark(); !got.Equal(at("12:05:00")) {
+		t.Errorf("Watermark() = %s, want the latest partition 12:05:00", got.Format(time.TimeOnly))
+	}
+	closed := w.Closed()
+	if len(closed) != 1 || !closed[0].Start.Equal(at("12:01:00")) {
+		t.Errorf("Closed() = %v, want only the window of 12:01:00", closed)
+	}
+}
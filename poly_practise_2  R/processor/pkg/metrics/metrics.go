@@ -47,6 +47,141 @@ var (
 		},
 		[]string{"stage"},
 	)
+
+	AssignedPartitions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_assigned_partitions",
+			Help: "Number of partitions assigned to this consumer group member",
+		},
+		[]string{"topic"},
+	)
+
+	DuplicatesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dedup_duplicates_total",
+			Help: "Total number of redelivered messages dropped by deduplication",
+		},
+		[]string{"topic"},
+	)
+
+	DecodeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "decode_errors_total",
+			Help: "Total number of messages with payloads that failed decoding or validation",
+		},
+		[]string{"topic", "reason"},
+	)
+
+	LateEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "window_late_events_total",
+			Help: "Total number of events that arrived after their windows were closed by the watermark",
+		},
+		[]string{"topic"},
+	)
+
+	FutureEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "window_future_events_total",
+			Help: "Total number of events whose event time was clamped because it was too far ahead of wall-clock time",
+		},
+		[]string{"topic"},
+	)
+
+	EventTimeFallbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "window_event_time_fallback_total",
+			Help: "Total number of messages windowed by Kafka time because they carried no event time",
+		},
+		[]string{"topic"},
+	)
+
+	Watermark = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "window_watermark_seconds",
+			Help: "Current event-time watermark as unix seconds",
+		},
+	)
+
+	OpenWindows = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "window_open",
+			Help: "Number of event-time windows not yet closed by the watermark",
+		},
+	)
+
+	SinkWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_writes_total",
+			Help: "Total number of window flushes written to each sink by result",
+		},
+		[]string{"sink", "result"},
+	)
+
+	SinkRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_records_total",
+			Help: "Total number of records successfully written to each sink",
+		},
+		[]string{"sink"},
+	)
+
+	SinkWriteDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sink_write_duration_seconds",
+			Help:    "Duration of one flush write to a sink",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sink"},
+	)
+
+	SinkRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_retries_total",
+			Help: "Total number of retried sink writes",
+		},
+		[]string{"sink"},
+	)
+
+	SinkBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sink_circuit_breaker_state",
+			Help: "Sink circuit breaker state: 0 closed, 1 open, 2 half-open",
+		},
+		[]string{"sink"},
+	)
+
+	WALBuffered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_wal_buffered_total",
+			Help: "Total number of flushes appended to the sink write-ahead log",
+		},
+		[]string{"sink"},
+	)
+
+	WALReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sink_wal_replayed_total",
+			Help: "Total number of flushes replayed from the sink write-ahead log",
+		},
+		[]string{"sink"},
+	)
+
+	WALPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sink_wal_pending",
+			Help: "Number of flushes in the sink write-ahead log not yet replayed",
+		},
+		[]string{"sink"},
+	)
+
+	RuleHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consumer_rule_hits_total",
+			Help: "Total number of messages matched by consumer filter rules",
+		},
+		[]string{"rule", "action"},
+	)
 )
 
 func Init() {
@@ -59,6 +194,23 @@ func Init() {
 	reg.MustRegister(InFlightMessages)
 	reg.MustRegister(KafkaConsumerLag)
 	reg.MustRegister(QueueSize)
+	reg.MustRegister(AssignedPartitions)
+	reg.MustRegister(RuleHits)
+	reg.MustRegister(DuplicatesDropped)
+	reg.MustRegister(DecodeErrors)
+	reg.MustRegister(LateEvents)
+	reg.MustRegister(EventTimeFallbacks)
+	reg.MustRegister(FutureEvents)
+	reg.MustRegister(Watermark)
+	reg.MustRegister(OpenWindows)
+	reg.MustRegister(SinkWrites)
+	reg.MustRegister(SinkRecords)
+	reg.MustRegister(SinkWriteDuration)
+	reg.MustRegister(SinkRetries)
+	reg.MustRegister(SinkBreakerState)
+	reg.MustRegister(WALBuffered)
+	reg.MustRegister(WALReplayed)
+	reg.MustRegister(WALPending)
 }
 
 func Handler() http.Handler {
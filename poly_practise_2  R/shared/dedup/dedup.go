@@ -0,0 +1,251 @@
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	// KeyMessageKey в конфиге означает, что идентификатором служит ключ сообщения
+	KeyMessageKey = "@key"
+
+	defaultKey         = "trace_id"
+	defaultTTL         = 10 * time.Minute
+	defaultMaxEntries  = 100000
+	defaultRedisPrefix = "dedup:"
+)
+
+// Config - отбрасывание повторно доставленных событий по идентификатору в окне TTL
+type Config struct {
+	Enabled     bool          `yaml:"enabled"`
+	Key         string        `yaml:"key" env-default:"trace_id"` // заголовок или "@key" для ключа сообщения
+	TTL         time.Duration `yaml:"ttl" env-default:"10m"`
+	MaxEntries  int           `yaml:"max-entries" env-default:"100000"`
+	Redis       bool          `yaml:"redis"` // идентификаторы в Redis, чтобы дедупликация работала между репликами и рестартами
+	RedisPrefix string        `yaml:"redis-prefix" env-default:"dedup:"`
+}
+
+// UsesRedis - дедупликация включена и хранит идентификаторы в Redis: только тогда сервису
+// нужно создавать клиент для New
+func (c *Config) UsesRedis() bool {
+	return c != nil && c.Enabled && c.Redis
+}
+
+type entry struct {
+	id      string
+	expires time.Time
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+type pendingID struct {
+	offset int64
+	id     string
+}
+
+// Deduper помнит увиденные идентификаторы в течение TTL. TTL у всех записей одинаковый,
+// поэтому порядок вставки совпадает с порядком истечения и вытеснять можно с головы очереди.
+// В Redis идентификатор пишется только после коммита оффсета его сообщения: иначе после
+// падения до коммита сообщения, прочитанные заново, отбрасывались бы как повторы
+type Deduper struct {
+	key         string
+	ttl         time.Duration
+	maxEntries  int
+	redisPrefix string
+	redis       redis.UniversalClient
+	log         *zap.Logger
+	now         func() time.Time
+
+	mu      sync.Mutex
+	seen    map[string]*list.Element
+	order   *list.List
+	pending map[partitionKey][]pendingID // ждут коммита, по возрастанию оффсета
+}
+
+// New возвращает nil, если дедупликация выключена. rdb (nil - только локальное состояние)
+// переходит во владение Deduper и закрывается в Close
+func New(cfg *Config, rdb redis.UniversalClient, log *zap.Logger) *Deduper {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	d := &Deduper{
+		key:         cfg.Key,
+		ttl:         cfg.TTL,
+		maxEntries:  cfg.MaxEntries,
+		redisPrefix: cfg.RedisPrefix,
+		log:         log,
+		now:         time.Now,
+		seen:        make(map[string]*list.Element),
+		order:       list.New(),
+		pending:     make(map[partitionKey][]pendingID),
+	}
+	if d.key == "" {
+		d.key = defaultKey
+	}
+	if d.ttl <= 0 {
+		d.ttl = defaultTTL
+	}
+	if d.maxEntries <= 0 {
+		d.maxEntries = defaultMaxEntries
+	}
+	if d.redisPrefix == "" {
+		d.redisPrefix = defaultRedisPrefix
+	}
+	if cfg.Redis {
+		d.redis = rdb
+	}
+	return d
+}
+
+func (d *Deduper) id(msg kafka.Message) string {
+	if d.key == KeyMessageKey {
+		return string(msg.Key)
+	}
+	for _, h := range msg.Headers {
+		if h.Key == d.key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Open выбирает пространство ключей Redis группы: <prefix><group>:<эпоха>:<id>. reset начинает
+// новую эпоху - сообщения, которые явный сброс оффсетов читает заново, не считаются повторами.
+// Вызывать до чтения, после сброса оффсетов
+func (d *Deduper) Open(ctx context.Context, group string, reset bool) error {
+	if d == nil || d.redis == nil {
+		return nil
+	}
+	epochKey := d.redisPrefix + group + ":epoch"
+
+	var (
+		epoch int64
+		err   error
+	)
+	if reset {
+		epoch, err = d.redis.Incr(ctx, epochKey).Result()
+	} else {
+		epoch, err = d.redis.Get(ctx, epochKey).Int64()
+		if err == redis.Nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("dedup epoch: %w", err)
+	}
+	d.redisPrefix = fmt.Sprintf("%s%s:%d:", d.redisPrefix, group, epoch)
+	d.log.Info("dedup keys scoped", zap.String("prefix", d.redisPrefix), zap.Bool("reset", reset))
+	return nil
+}
+
+// Duplicate сообщает, встречалось ли сообщение в окне TTL, и запоминает его локально; в Redis
+// оно попадёт после Commit. Сообщения без идентификатора не дедуплицируются
+func (d *Deduper) Duplicate(ctx context.Context, msg kafka.Message) bool {
+	id := d.id(msg)
+	if id == "" {
+		return false
+	}
+
+	if d.seenLocal(id) {
+		return true
+	}
+	if d.redis == nil {
+		return false
+	}
+
+	n, err := d.redis.Exists(ctx, d.redisPrefix+id).Result()
+	if err != nil {
+		d.log.Warn("dedup redis check failed, falling back to local state", zap.Error(err))
+	}
+	if n > 0 {
+		return true
+	}
+
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	d.mu.Lock()
+	d.pending[key] = append(d.pending[key], pendingID{offset: msg.Offset, id: id})
+	d.mu.Unlock()
+	return false
+}
+
+// Commit пишет в Redis идентификаторы сообщений, оффсеты которых закоммичены: offsets -
+// закоммиченные оффсеты, то есть следующие после последнего покрытого сообщения
+func (d *Deduper) Commit(ctx context.Context, offsets map[string]map[int]int64) {
+	if d == nil || d.redis == nil {
+		return
+	}
+
+	var ids []string
+	d.mu.Lock()
+	for topic, ps := range offsets {
+		for p, off := range ps {
+			key := partitionKey{topic: topic, partition: p}
+			pending := d.pending[key]
+			n := 0
+			for n < len(pending) && pending[n].offset < off {
+				ids = append(ids, pending[n].id)
+				n++
+			}
+			if n == len(pending) {
+				delete(d.pending, key)
+			} else {
+				d.pending[key] = pending[n:]
+			}
+		}
+	}
+	d.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	pipe := d.redis.Pipeline()
+	for _, id := range ids {
+		pipe.Set(ctx, d.redisPrefix+id, 1, d.ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		d.log.Warn("failed to store committed dedup ids", zap.Int("ids", len(ids)), zap.Error(err))
+	}
+}
+
+func (d *Deduper) seenLocal(id string) bool {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for front := d.order.Front(); front != nil && !now.Before(front.Value.(entry).expires); front = d.order.Front() {
+		d.evict(front)
+	}
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+
+	// место освобождается только под новый идентификатор: проверка известного ничего не вытесняет
+	for d.order.Len() >= d.maxEntries {
+		d.evict(d.order.Front())
+	}
+	d.seen[id] = d.order.PushBack(entry{id: id, expires: now.Add(d.ttl)})
+	return false
+}
+
+func (d *Deduper) evict(el *list.Element) {
+	d.order.Remove(el)
+	delete(d.seen, el.Value.(entry).id)
+}
+
+func (d *Deduper) Close() error {
+	if d == nil || d.redis == nil {
+		return nil
+	}
+	return d.redis.Close()
+}
@@ -0,0 +1,115 @@
+package dedup
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func message(key, traceID string) kafka.Message {
+	msg := kafka.Message{Key: []byte(key)}
+	if traceID != "" {
+		msg.Headers = []kafka.Header{{Key: "trace_id", Value: []byte(traceID)}}
+	}
+	return msg
+}
+
+func TestNewDisabled(t *testing.T) {
+	for _, cfg := range []*Config{nil, {Enabled: false}} {
+		d := New(cfg, nil, zap.NewNop())
+		if d != nil {
+			t.Fatalf("New(%+v) = %v, want nil", cfg, d)
+		}
+		// выключенный deduper безопасно коммитить и закрывать
+		d.Commit(context.Background(), map[string]map[int]int64{"t": {0: 1}})
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		msgs []kafka.Message
+		want []bool
+	}{
+		{
+			name: "trace id header",
+			msgs: []kafka.Message{message("u1", "a"), message("u2", "b"), message("u3", "a")},
+			want: []bool{false, false, true},
+		},
+		{
+			name: "message key",
+			key:  KeyMessageKey,
+			msgs: []kafka.Message{message("u1", "a"), message("u1", "b"), message("u2", "a")},
+			want: []bool{false, true, false},
+		},
+		{
+			name: "messages without id pass",
+			msgs: []kafka.Message{message("u1", ""), message("u1", "")},
+			want: []bool{false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(&Config{Enabled: true, Key: tt.key}, nil, zap.NewNop())
+			for i, msg := range tt.msgs {
+				if got := d.Duplicate(context.Background(), msg); got != tt.want[i] {
+					t.Errorf("message %d: Duplicate() = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  bool
+	}{
+		{"within ttl", 59 * time.Second, true},
+		{"at expiry", time.Minute, false},
+		{"after expiry", time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(&Config{Enabled: true, TTL: time.Minute}, nil, zap.NewNop())
+			d.now = func() time.Time { return start }
+			d.Duplicate(context.Background(), message("u1", "a"))
+
+			d.now = func() time.Time { return start.Add(tt.after) }
+			if got := d.Duplicate(context.Background(), message("u1", "a")); got != tt.want {
+				t.Errorf("Duplicate() after %s = %v, want %v", tt.after, got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+			// истёкший идентификатор запомнен заново
+			if got := d.Duplicate(context.Background(), message("u1", "a")); !got {
+				t.Error("id seen again after expiry is not remembered")
+			}
+		})
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	d := New(&Config{Enabled: true, MaxEntries: 2}, nil, zap.NewNop())
+	for _, id := range []string{"a", "b", "c"} {
+		d.Duplicate(context.Background(), message("u1", id))
+	}
+	if got := d.order.Len(); got != 2 {
+		t.Errorf("remembered %d ids, want MaxEntries = 2", got)
+	}
+	if d.Duplicate(context.Background(), message("u1", "a")) {
+		t.Error("oldest id is still remembered after overflow")
+	}
+	if !d.Duplicate(context.Background(), message("u1", "c")) {
+		t.Error("newest id is forgotten after overflow")
+	}
+}
@@ -0,0 +1,209 @@
+package envelope
+
+import (
+	"encoding/json"
+	"github.com/segmentio/kafka-go"
+	"sort"
+	"time"
+)
+
+const (
+	// ContentType и Version уходят в заголовки content_type и version, processor выбирает по ним декодер
+	ContentType = "application/vnd.collector.envelope+json"
+	Version     = 1
+
+	ItemsPayload   = "payload"   // сообщения целиком
+	ItemsReference = "reference" // только topic/partition/offset исходных сообщений
+
+	// HeaderTimestamp - событийное время сообщения, RFC3339: myproducer ставит его каждому
+	// событию, collector - выходному сообщению (время последнего события батча), processor
+	// строит по нему окна
+	HeaderTimestamp = "timestamp"
+)
+
+// Item - сообщение в состоянии collector вместе с тем, откуда оно пришло
+type Item struct {
+	Value     string    `json:"value"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Time      time.Time `json:"time"` // событийное время, см. EventTime
+}
+
+// Batch - то, что flusher отдаёт приёмникам: сообщения пользователей, накопленные за [Start, End)
+type Batch struct {
+	Start time.Time
+	End   time.Time
+	Users map[string][]Item
+}
+
+// Subset - батч только из указанных пользователей с тем же окном, для повтора
+func (b Batch) Subset(uids map[string]error) Batch {
+	out := Batch{Start: b.Start, End: b.End, Users: make(map[string][]Item, len(uids))}
+	for uid := range uids {
+		out.Users[uid] = b.Users[uid]
+	}
+	return out
+}
+
+// Items - число сообщений во всём батче
+func (b Batch) Items() int {
+	var n int
+	for _, items := range b.Users {
+		n += len(items)
+	}
+	return n
+}
+
+// Values - исходные значения сообщений, для приёмников без конверта
+func Values(items []Item) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.Value
+	}
+	return out
+}
+
+// Source - диапазон оффсетов партиции, из которого собраны сообщения пользователя
+type Source struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	FirstOffset int64  `json:"first_offset"`
+	LastOffset  int64  `json:"last_offset"`
+}
+
+// Ref - ссылка на исходное сообщение вместо его содержимого
+type Ref struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Envelope - выходное сообщение collector: батч одного пользователя за окно flush.
+// Window* - когда collector копил батч, Event* - событийное время первого и последнего события.
+// Items - события как есть (не-JSON значения - JSON-строкой), Refs - вместо Items в режиме reference
+type Envelope struct {
+	SchemaVersion int               `json:"schema_version"`
+	UserID        string            `json:"user_id"`
+	WindowStart   time.Time         `json:"window_start"`
+	WindowEnd     time.Time         `json:"window_end"`
+	EventStart    time.Time         `json:"event_start"`
+	EventEnd      time.Time         `json:"event_end"`
+	ItemCount     int               `json:"item_count"`
+	Sources       []Source          `json:"sources"`
+	Items         []json.RawMessage `json:"items,omitempty"`
+	Refs          []Ref             `json:"refs,omitempty"`
+}
+
+func New(userID string, start, end time.Time, items []Item, mode string) Envelope {
+	env := Envelope{
+		SchemaVersion: Version,
+		UserID:        userID,
+		WindowStart:   start.UTC(),
+		WindowEnd:     end.UTC(),
+		ItemCount:     len(items),
+		Sources:       sources(items),
+	}
+	env.EventStart, env.EventEnd = EventRange(items)
+	if mode == ItemsReference {
+		env.Refs = make([]Ref, len(items))
+		for i, it := range items {
+			env.Refs[i] = Ref{Topic: it.Topic, Partition: it.Partition, Offset: it.Offset}
+		}
+		return env
+	}
+	env.Items = make([]json.RawMessage, len(items))
+	for i, it := range items {
+		if json.Valid([]byte(it.Value)) {
+			env.Items[i] = json.RawMessage(it.Value)
+			continue
+		}
+		env.Items[i], _ = json.Marshal(it.Value) // строка кодируется всегда
+	}
+	return env
+}
+
+func sources(items []Item) []Source {
+	type tp struct {
+		topic     string
+		partition int
+	}
+	byPart := make(map[tp]*Source)
+	for _, it := range items {
+		k := tp{it.Topic, it.Partition}
+		s, ok := byPart[k]
+		if !ok {
+			byPart[k] = &Source{Topic: it.Topic, Partition: it.Partition, FirstOffset: it.Offset, LastOffset: it.Offset}
+			continue
+		}
+		s.FirstOffset = min(s.FirstOffset, it.Offset)
+		s.LastOffset = max(s.LastOffset, it.Offset)
+	}
+	out := make([]Source, 0, len(byPart))
+	for _, s := range byPart {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].Partition < out[j].Partition
+	})
+	return out
+}
+
+// EventTime - событийное время входного сообщения из заголовка timestamp; без заголовка
+// или с неразборчивым значением - время сообщения Kafka
+func EventTime(msg kafka.Message) time.Time {
+	for _, h := range msg.Headers {
+		if h.Key != HeaderTimestamp {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, string(h.Value)); err == nil {
+			return t.UTC()
+		}
+		break
+	}
+	return msg.Time.UTC()
+}
+
+// EventRange - событийное время первого и последнего события; нули, если времени нет ни у одного
+func EventRange(items []Item) (first, last time.Time) {
+	for _, it := range items {
+		if it.Time.IsZero() {
+			continue
+		}
+		if first.IsZero() || it.Time.Before(first) {
+			first = it.Time
+		}
+		if it.Time.After(last) {
+			last = it.Time
+		}
+	}
+	return first.UTC(), last.UTC()
+}
+
+// TimestampHeader - заголовок timestamp выходного сообщения: время последнего события батча,
+// чтобы окна processor считались по событиям, а не по времени отправки. false - времени нет
+func TimestampHeader(items []Item) (kafka.Header, bool) {
+	_, last := EventRange(items)
+	if last.IsZero() {
+		return kafka.Header{}, false
+	}
+	return kafka.Header{Key: HeaderTimestamp, Value: []byte(last.Format(time.RFC3339Nano))}, true
+}
+
+// TraceIDs - различные trace_id сообщений в порядке появления
+func TraceIDs(items []Item) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, it := range items {
+		if it.TraceID == "" || seen[it.TraceID] {
+			continue
+		}
+		seen[it.TraceID] = true
+		out = append(out, it.TraceID)
+	}
+	return out
+}
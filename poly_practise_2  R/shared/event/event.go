@@ -0,0 +1,199 @@
+package event
+
+import (
+	"time"
+)
+
+// Event - событие товара: myproducer его генерирует, processor декодирует. При изменении
+// схемы нужно поднять заголовок version и добавить декодер в processor
+type Event struct {
+	ItemID      int               `json:"item_id"`
+	Price       float64           `json:"price"`
+	Name        string            `json:"name"`
+	Category    string            `json:"category"`
+	Description string            `json:"description"`
+	Brand       string            `json:"brand"`
+	SKU         string            `json:"sku"`
+	Weight      float64           `json:"weight"`
+	Dimensions  Dimensions        `json:"dimensions"`
+	Tags        []string          `json:"tags"`
+	Attributes  map[string]string `json:"attributes"`
+	CreatedAt   string            `json:"created_at"`
+	UpdatedAt   string            `json:"updated_at"`
+	Inventory   Inventory         `json:"inventory"`
+	Pricing     Pricing           `json:"pricing"`
+	Metadata    Metadata          `json:"metadata"`
+}
+
+// FieldError - нарушение правила валидации одного поля
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type Dimensions struct {
+	Length float64 `json:"length"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type Inventory struct {
+	Quantity int    `json:"quantity"`
+	Location string `json:"location"`
+	Status   string `json:"status"`
+}
+
+type Pricing struct {
+	BasePrice    float64 `json:"base_price"`
+	SalePrice    float64 `json:"sale_price"`
+	Currency     string  `json:"currency"`
+	DiscountRate float64 `json:"discount_rate"`
+}
+
+type Metadata struct {
+	Source      string `json:"source"`
+	Version     string `json:"version"`
+	Environment string `json:"environment"`
+	BatchID     string `json:"batch_id"`
+}
+
+// Validate проверяет обязательные поля и диапазоны; возвращает все нарушения сразу
+func (e *Event) Validate() []FieldError {
+	var errs []FieldError
+	required := func(field, v string) {
+		if v == "" {
+			errs = append(errs, FieldError{Field: field, Reason: "required"})
+		}
+	}
+	nonNegative := func(field string, v float64) {
+		if v < 0 {
+			errs = append(errs, FieldError{Field: field, Reason: "must be >= 0"})
+		}
+	}
+	timestamp := func(field, v string) {
+		if v == "" {
+			return
+		}
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			errs = append(errs, FieldError{Field: field, Reason: "must be RFC3339"})
+		}
+	}
+
+	required("name", e.Name)
+	required("sku", e.SKU)
+	required("category", e.Category)
+	required("brand", e.Brand)
+	required("pricing.currency", e.Pricing.Currency)
+	if e.ItemID < 0 {
+		errs = append(errs, FieldError{Field: "item_id", Reason: "must be >= 0"})
+	}
+	nonNegative("price", e.Price)
+	nonNegative("weight", e.Weight)
+	nonNegative("pricing.base_price", e.Pricing.BasePrice)
+	nonNegative("pricing.sale_price", e.Pricing.SalePrice)
+	if e.Pricing.SalePrice > e.Pricing.BasePrice {
+		errs = append(errs, FieldError{Field: "pricing.sale_price", Reason: "must not exceed base_price"})
+	}
+	if e.Pricing.DiscountRate < 0 || e.Pricing.DiscountRate > 1 {
+		errs = append(errs, FieldError{Field: "pricing.discount_rate", Reason: "must be in [0, 1]"})
+	}
+	if e.Inventory.Quantity < 0 {
+		errs = append(errs, FieldError{Field: "inventory.quantity", Reason: "must be >= 0"})
+	}
+	timestamp("created_at", e.CreatedAt)
+	timestamp("updated_at", e.UpdatedAt)
+	return errs
+}
+
+// EventTime - время изменения товара: updated_at, без него - created_at; нулевое, если
+// нет обоих или они не разобраны
+func (e *Event) EventTime() time.Time {
+	for _, v := range []string{e.UpdatedAt, e.CreatedAt} {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Field отдаёт поле по пути из конфига агрегаций без reflection; неизвестный путь - nil
+func (e *Event) Field(path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+	if len(path) == 1 {
+		switch path[0] {
+		case "item_id":
+			return e.ItemID
+		case "price":
+			return e.Price
+		case "name":
+			return e.Name
+		case "category":
+			return e.Category
+		case "description":
+			return e.Description
+		case "brand":
+			return e.Brand
+		case "sku":
+			return e.SKU
+		case "weight":
+			return e.Weight
+		case "created_at":
+			return e.CreatedAt
+		case "updated_at":
+			return e.UpdatedAt
+		}
+		return nil
+	}
+	if len(path) != 2 {
+		return nil
+	}
+	switch path[0] {
+	case "dimensions":
+		switch path[1] {
+		case "length":
+			return e.Dimensions.Length
+		case "width":
+			return e.Dimensions.Width
+		case "height":
+			return e.Dimensions.Height
+		}
+	case "attributes":
+		if v, ok := e.Attributes[path[1]]; ok {
+			return v
+		}
+	case "inventory":
+		switch path[1] {
+		case "quantity":
+			return e.Inventory.Quantity
+		case "location":
+			return e.Inventory.Location
+		case "status":
+			return e.Inventory.Status
+		}
+	case "pricing":
+		switch path[1] {
+		case "base_price":
+			return e.Pricing.BasePrice
+		case "sale_price":
+			return e.Pricing.SalePrice
+		case "currency":
+			return e.Pricing.Currency
+		case "discount_rate":
+			return e.Pricing.DiscountRate
+		}
+	case "metadata":
+		switch path[1] {
+		case "source":
+			return e.Metadata.Source
+		case "version":
+			return e.Metadata.Version
+		case "environment":
+			return e.Metadata.Environment
+		case "batch_id":
+			return e.Metadata.BatchID
+		}
+	}
+	return nil
+}
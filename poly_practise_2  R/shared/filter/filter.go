@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"math/rand"
+	"path"
+)
+
+const (
+	ActionDrop   = "drop"
+	ActionSample = "sample"
+	ActionTag    = "tag"
+	ActionRoute  = "route"
+
+	// заголовки, которые выставляет route: по ним collector выбирает выходной топик,
+	// а processor - агрегации с lanes
+	LaneHeader  = "lane"
+	TopicHeader = "output_topic"
+)
+
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule - правило фильтрации: заголовки и ключ сравниваются по glob-шаблонам (path.Match)
+type Rule struct {
+	Name    string            `yaml:"name"`
+	Headers map[string]string `yaml:"headers"` // environment, source, version, product_type ...
+	Key     string            `yaml:"key"`
+	Action  string            `yaml:"action"` // drop | sample | tag | route
+	Rate    float64           `yaml:"rate"`   // sample: доля сообщений, которые проходят дальше
+	Tags    map[string]string `yaml:"tags"`   // tag: заголовки, которые добавляются к сообщению
+	Lane    string            `yaml:"lane"`   // route: имя полосы обработки
+	Topic   string            `yaml:"topic"`  // route: выходной топик
+}
+
+// Filter применяет правила из конфига по порядку: drop и неудачный sample отбрасывают
+// сообщение, tag дописывает заголовки, первый сработавший route завершает разбор
+type Filter struct {
+	rules []Rule
+	hits  *prometheus.CounterVec // rule, action; регистрирует сервис
+}
+
+func New(cfg *Config, hits *prometheus.CounterVec) (*Filter, error) {
+	if cfg == nil {
+		return &Filter{hits: hits}, nil
+	}
+	for i, r := range cfg.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule #%d: name is required", i)
+		}
+		switch r.Action {
+		case ActionDrop, ActionTag:
+		case ActionSample:
+			if r.Rate < 0 || r.Rate > 1 {
+				return nil, fmt.Errorf("rule %q: sample rate must be in [0, 1]", r.Name)
+			}
+		case ActionRoute:
+			if r.Lane == "" && r.Topic == "" {
+				return nil, fmt.Errorf("rule %q: route needs lane or topic", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q", r.Name, r.Action)
+		}
+		for h, pattern := range r.Headers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %q: header %q: %w", r.Name, h, err)
+			}
+		}
+		if _, err := path.Match(r.Key, ""); err != nil {
+			return nil, fmt.Errorf("rule %q: key: %w", r.Name, err)
+		}
+	}
+	return &Filter{rules: cfg.Rules, hits: hits}, nil
+}
+
+// Apply возвращает false, если сообщение нужно отбросить; заголовки меняются на месте
+func (f *Filter) Apply(msg *kafka.Message) bool {
+	for _, r := range f.rules {
+		if !matches(r, msg) {
+			continue
+		}
+		f.hits.WithLabelValues(r.Name, r.Action).Inc()
+
+		switch r.Action {
+		case ActionDrop:
+			return false
+		case ActionSample:
+			if rand.Float64() >= r.Rate {
+				return false
+			}
+		case ActionTag:
+			for k, v := range r.Tags {
+				setHeader(msg, k, v)
+			}
+		case ActionRoute:
+			if r.Lane != "" {
+				setHeader(msg, LaneHeader, r.Lane)
+			}
+			if r.Topic != "" {
+				setHeader(msg, TopicHeader, r.Topic)
+			}
+			return true
+		}
+	}
+	return true
+}
+
+func matches(r Rule, msg *kafka.Message) bool {
+	if r.Key != "" {
+		if ok, _ := path.Match(r.Key, string(msg.Key)); !ok {
+			return false
+		}
+	}
+	for h, pattern := range r.Headers {
+		if ok, _ := path.Match(pattern, header(msg, h)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func header(msg *kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func setHeader(msg *kafka.Message, key, value string) {
+	for i, h := range msg.Headers {
+		if h.Key == key {
+			msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"strings"
+	"testing"
+)
+
+func newFilter(t *testing.T, rules ...Rule) *Filter {
+	t.Helper()
+	hits := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "filter_hits_total"}, []string{"rule", "action"})
+	f, err := New(&Config{Rules: rules}, hits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func message(key string, headers ...string) *kafka.Message {
+	msg := &kafka.Message{Key: []byte(key)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: headers[i], Value: []byte(headers[i+1])})
+	}
+	return msg
+}
+
+func TestApply(t *testing.T) {
+	rules := []Rule{
+		{Name: "drop test", Headers: map[string]string{"environment": "test"}, Action: ActionDrop},
+		{Name: "tag mobile", Headers: map[string]string{"source": "mobile-*"}, Action: ActionTag, Tags: map[string]string{"channel": "mobile"}},
+		{Name: "vip users", Key: "vip-*", Action: ActionRoute, Lane: "vip", Topic: "out.vip"},
+		{Name: "v2 lane", Headers: map[string]string{"version": "2", "source": "?*"}, Action: ActionRoute, Lane: "v2"}, // "*" подошёл бы и к отсутствующему заголовку
+		{Name: "drop after route", Action: ActionDrop},
+	}
+	tests := []struct {
+		name    string
+		msg     *kafka.Message
+		keep    bool
+		headers map[string]string // ожидаемые заголовки после Apply
+	}{
+		{"dropped by header", message("u1", "environment", "test"), false, nil},
+		{"header glob", message("vip-1", "source", "mobile-ios"), true, map[string]string{"channel": "mobile", LaneHeader: "vip", TopicHeader: "out.vip"}},
+		{"all headers must match", message("u1", "version", "2"), false, nil},
+		{"route stops rules", message("u1", "version", "2", "source", "web"), true, map[string]string{LaneHeader: "v2", TopicHeader: ""}},
+		{"route overwrites header", message("vip-2", LaneHeader, "old"), true, map[string]string{LaneHeader: "vip"}},
+		{"no rule matched before catch-all", message("u1", "environment", "prod"), false, nil},
+	}
+	f := newFilter(t, rules...)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Apply(tt.msg); got != tt.keep {
+				t.Fatalf("Apply() = %v, want %v", got, tt.keep)
+			}
+			for k, want := range tt.headers {
+				if got := header(tt.msg, k); got != want {
+					t.Errorf("header %q = %q, want %q", k, got, want)
+				}
+			}
+			n := 0
+			for _, h := range tt.msg.Headers {
+				if h.Key == LaneHeader {
+					n++
+				}
+			}
+			if n > 1 {
+				t.Errorf("lane header set %d times", n)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want int
+	}{
+		{0, 0},
+		{1, 100},
+	}
+	for _, tt := range tests {
+		f := newFilter(t, Rule{Name: "sample", Action: ActionSample, Rate: tt.rate})
+		kept := 0
+		for i := 0; i < 100; i++ {
+			if f.Apply(message("u1")) {
+				kept++
+			}
+		}
+		if kept != tt.want {
+			t.Errorf("rate %v kept %d of 100, want %d", tt.rate, kept, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{"no name", Rule{Action: ActionDrop}, "name is required"},
+		{"unknown action", Rule{Name: "r", Action: "keep"}, "unknown action"},
+		{"bad rate", Rule{Name: "r", Action: ActionSample, Rate: 1.5}, "sample rate"},
+		{"empty route", Rule{Name: "r", Action: ActionRoute}, "lane or topic"},
+		{"bad header pattern", Rule{Name: "r", Action: ActionDrop, Headers: map[string]string{"source": "["}}, "header"},
+		{"bad key pattern", Rule{Name: "r", Action: ActionDrop, Key: "["}, "key"},
+		{"valid", Rule{Name: "r", Action: ActionRoute, Lane: "vip"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(&Config{Rules: []Rule{tt.rule}}, nil)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("New() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("New() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
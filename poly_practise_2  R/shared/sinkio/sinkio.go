@@ -0,0 +1,110 @@
+package sinkio
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Общая часть file/stdout и sql приёмников collector и processor: открытие файла архива,
+// проверка формата и вставка строк одной транзакцией. Что писать в строку, решает сервис
+
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+func CheckFormat(format string) error {
+	switch format {
+	case FormatJSONL, FormatCSV:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// OpenAppend открывает файл только на дозапись, архив переживает рестарты.
+// header - файл пуст и CSV-заголовок ещё не записан
+func OpenAppend(path, format string) (f *os.File, header bool, err error) {
+	if path == "" {
+		return nil, false, fmt.Errorf("file sink requires path")
+	}
+	if err := CheckFormat(format); err != nil {
+		return nil, false, err
+	}
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, fmt.Errorf("open %s: %w", path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, false, fmt.Errorf("stat %s: %w", path, err)
+	}
+	return f, st.Size() == 0, nil
+}
+
+// Table - таблица sql-приёмника. Драйвер подключается в сборке бинарника
+// (import _ "github.com/lib/pq" и т.п.), в конфиге - только его имя
+type Table struct {
+	db     *sql.DB
+	insert string
+}
+
+// OpenTable; placeholder "$" - нумерованные параметры (postgres), иначе "?"
+func OpenTable(driver, dsn, table, placeholder string, columns []string) (*Table, error) {
+	if driver == "" || dsn == "" {
+		return nil, fmt.Errorf("sql sink requires driver and dsn")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", driver, err)
+	}
+	params := make([]string, len(columns))
+	for i := range params {
+		if placeholder == "$" {
+			params[i] = "$" + strconv.Itoa(i+1)
+		} else {
+			params[i] = "?"
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(columns, ", "), strings.Join(params, ", "))
+	return &Table{db: db, insert: insert}, nil
+}
+
+// Insert вставляет строки, которые rows передаёт в insert, одной транзакцией:
+// ошибка любой строки откатывает все
+func (t *Table) Insert(ctx context.Context, rows func(insert func(args ...interface{}) error) error) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, t.insert)
+	if err != nil {
+		return fmt.Errorf("prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	err = rows(func(args ...interface{}) error {
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("insert: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (t *Table) Close() error {
+	return t.db.Close()
+}
@@ -0,0 +1,76 @@
+package startpos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Committed = "committed"
+	Earliest  = "earliest"
+	Latest    = "latest"
+	Offset    = "offset"
+	Timestamp = "timestamp"
+)
+
+// Config задаёт позицию, с которой группа начинает читать партиции без закоммиченного оффсета
+type Config struct {
+	From    string                   `yaml:"from" env-default:"committed"`
+	Offsets map[string]map[int]int64 `yaml:"offsets"` // для from: offset, topic -> partition -> offset
+	Time    time.Time                `yaml:"time"`    // для from: timestamp
+	Reset   bool                     `yaml:"reset"`   // переписать закоммиченные оффсеты группы до вступления в неё
+}
+
+func (s *Config) Validate() error {
+	switch s.From {
+	case "", Committed, Earliest, Latest:
+	case Offset:
+		if len(s.Offsets) == 0 {
+			return fmt.Errorf("start from %q requires offsets", s.From)
+		}
+	case Timestamp:
+		if s.Time.IsZero() {
+			return fmt.Errorf("start from %q requires time", s.From)
+		}
+	default:
+		return fmt.Errorf("unknown start position %q", s.From)
+	}
+	if s.Reset && (s.From == "" || s.From == Committed) {
+		return fmt.Errorf("reset requires an explicit start position")
+	}
+	return nil
+}
+
+// ParseOffsets разбирает строку вида "topic:partition=offset,topic:partition=offset"
+func ParseOffsets(s string) (map[string]map[int]int64, error) {
+	out := make(map[string]map[int]int64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tp, off, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad offset %q: want topic:partition=offset", item)
+		}
+		i := strings.LastIndex(tp, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad offset %q: want topic:partition=offset", item)
+		}
+		partition, err := strconv.Atoi(tp[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad partition in %q: %w", item, err)
+		}
+		offset, err := strconv.ParseInt(off, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad offset in %q: %w", item, err)
+		}
+		if out[tp[:i]] == nil {
+			out[tp[:i]] = make(map[int]int64)
+		}
+		out[tp[:i]][partition] = offset
+	}
+	return out, nil
+}
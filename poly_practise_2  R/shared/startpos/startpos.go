@@ -0,0 +1,303 @@
+package startpos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const lookupTimeout = 10 * time.Second
+
+// Starter решает, откуда читать назначенные партиции. Решение принимается один раз на группу,
+// а не на процесс: позиция из конфига применяется только к партициям без закоммиченного
+// оффсета и сразу коммитится, поэтому партиция, переехавшая на другую реплику при ребалансе,
+// продолжает с оффсета прежнего владельца
+type Starter struct {
+	client *kafka.Client
+	cfg    *Config
+	log    *zap.Logger
+
+	mu       sync.Mutex
+	restore  map[string]map[int]int64
+	restored chan bool
+}
+
+func New(client *kafka.Client, cfg *Config, logger *zap.Logger) *Starter {
+	return &Starter{client: client, cfg: cfg, log: logger}
+}
+
+// Restore задаёт оффсеты снапшота состояния процесса. Они применяются только в первом
+// поколении после старта: позже назначенные партиции пришли от другой реплики, и их
+// закоммиченный оффсет уже учитывает всё, что она посчитала. Снапшот не делится по
+// партициям, поэтому применяется целиком, если первому поколению назначены все его
+// партиции; иначе часть его событий посчитает другая реплика, и все партиции читаются
+// с закоммиченных оффсетов. Решение приходит в канал один раз, в том числе при Skip
+func (s *Starter) Restore(offsets map[string]map[int]int64) <-chan bool {
+	restored := make(chan bool, 1)
+	s.mu.Lock()
+	s.restore = offsets
+	s.restored = restored
+	s.mu.Unlock()
+	return restored
+}
+
+// Skip отменяет снапшот, который ещё не применён: консьюмер остановился до первого поколения
+func (s *Starter) Skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restored != nil {
+		s.restored <- false
+		s.restore, s.restored = nil, nil
+	}
+}
+
+// Apply возвращает назначения поколения с оффсетами, откуда читать. kafka-go подставляет
+// отрицательный StartOffset партициям, для которых группа ещё ничего не коммитила
+func (s *Starter) Apply(ctx context.Context, gen *kafka.Generation) map[string][]kafka.PartitionAssignment {
+	s.mu.Lock()
+	restore, restored := s.restore, s.restored
+	s.restore, s.restored = nil, nil
+	s.mu.Unlock()
+
+	if restored != nil {
+		if missing := unassigned(gen.Assignments, restore); len(missing) > 0 {
+			s.log.Warn("checkpoint partitions are not assigned to this replica, state is not restored",
+				zap.Any("unassigned", missing))
+			restore = nil
+		}
+		restored <- restore != nil
+	}
+
+	assignments := make(map[string][]kafka.PartitionAssignment, len(gen.Assignments))
+	fresh := make(map[string][]int)
+	for topic, as := range gen.Assignments {
+		as = append([]kafka.PartitionAssignment(nil), as...)
+		for i, a := range as {
+			if off, ok := restore[topic][a.ID]; ok {
+				as[i].Offset = off
+				continue
+			}
+			if a.Offset < 0 {
+				fresh[topic] = append(fresh[topic], a.ID)
+			}
+		}
+		assignments[topic] = as
+	}
+	if len(restore) > 0 {
+		s.log.Info("offsets restored from checkpoint", zap.Any("offsets", restore))
+	}
+
+	if s.cfg == nil || s.cfg.From == "" || s.cfg.From == Committed || len(fresh) == 0 {
+		return assignments
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	positions, err := s.resolve(lookupCtx, fresh)
+	if err != nil {
+		s.log.Error("failed to resolve start position, using group start offset", zap.String("from", s.cfg.From), zap.Error(err))
+		return assignments
+	}
+	// позиция коммитится сразу: следующий владелец партиции увидит её как закоммиченную
+	// и не станет выбирать стартовую позицию заново
+	if err := gen.CommitOffsets(positions); err != nil {
+		s.log.Error("failed to commit start position", zap.String("from", s.cfg.From), zap.Error(err))
+	}
+	for topic, as := range assignments {
+		for i, a := range as {
+			if off, ok := positions[topic][a.ID]; ok {
+				as[i].Offset = off
+			}
+		}
+	}
+	s.log.Info("start position applied to uncommitted partitions", zap.String("from", s.cfg.From), zap.Any("offsets", positions))
+	return assignments
+}
+
+// unassigned - партиции снапшота, которых нет в назначениях поколения
+func unassigned(assignments map[string][]kafka.PartitionAssignment, offsets map[string]map[int]int64) map[string][]int {
+	missing := make(map[string][]int)
+	for topic, ps := range offsets {
+		owned := make(map[int]bool, len(assignments[topic]))
+		for _, a := range assignments[topic] {
+			owned[a.ID] = true
+		}
+		for p := range ps {
+			if !owned[p] {
+				missing[topic] = append(missing[topic], p)
+			}
+		}
+	}
+	return missing
+}
+
+// Reset переписывает закоммиченные оффсеты группы на позицию из конфига. Вызывается до
+// вступления в группу: брокер принимает коммит вне поколения только от пустой группы, поэтому
+// с reset запускается одна реплика, пока остальные остановлены, - для реплики, зашедшей
+// в активную группу, сброс вернёт ошибку
+func (s *Starter) Reset(ctx context.Context, group string, topics []string) error {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	meta, err := s.client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return fmt.Errorf("topic metadata: %w", err)
+	}
+	partitions := make(map[string][]int, len(meta.Topics))
+	for _, t := range meta.Topics {
+		if t.Error != nil {
+			return fmt.Errorf("topic %s metadata: %w", t.Name, t.Error)
+		}
+		for _, p := range t.Partitions {
+			partitions[t.Name] = append(partitions[t.Name], p.ID)
+		}
+	}
+
+	positions, err := s.resolve(ctx, partitions)
+	if err != nil {
+		return err
+	}
+	req := &kafka.OffsetCommitRequest{
+		GroupID:      group,
+		GenerationID: -1,
+		Topics:       make(map[string][]kafka.OffsetCommit, len(positions)),
+	}
+	for topic, ps := range positions {
+		for p, off := range ps {
+			req.Topics[topic] = append(req.Topics[topic], kafka.OffsetCommit{Partition: p, Offset: off})
+		}
+	}
+	resp, err := s.client.OffsetCommit(ctx, req)
+	if err != nil {
+		return fmt.Errorf("commit offsets: %w", err)
+	}
+	var errs []error
+	for topic, ps := range resp.Topics {
+		for _, p := range ps {
+			if p.Error != nil {
+				errs = append(errs, fmt.Errorf("%s/%d: %w", topic, p.Partition, p.Error))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("commit offsets (group must have no active members): %w", err)
+	}
+	s.log.Info("committed offsets reset", zap.String("group", group), zap.String("from", s.cfg.From), zap.Any("offsets", positions))
+	return nil
+}
+
+func (s *Starter) resolve(ctx context.Context, partitions map[string][]int) (map[string]map[int]int64, error) {
+	switch s.cfg.From {
+	case Earliest:
+		return s.listOffsets(ctx, partitions, kafka.FirstOffsetOf)
+	case Latest:
+		return s.listOffsets(ctx, partitions, kafka.LastOffsetOf)
+	case Offset:
+		out := make(map[string]map[int]int64)
+		for topic, ps := range partitions {
+			for _, p := range ps {
+				if off, ok := s.cfg.Offsets[topic][p]; ok {
+					if out[topic] == nil {
+						out[topic] = make(map[int]int64)
+					}
+					out[topic][p] = off
+				}
+			}
+		}
+		return out, nil
+	case Timestamp:
+		return s.offsetsForTime(ctx, partitions, s.cfg.Time)
+	}
+	return nil, fmt.Errorf("unknown start position %q", s.cfg.From)
+}
+
+func (s *Starter) listOffsets(ctx context.Context, partitions map[string][]int,
+	request func(partition int) kafka.OffsetRequest) (map[string]map[int]int64, error) {
+	req := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest, len(partitions))}
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			req.Topics[topic] = append(req.Topics[topic], request(p))
+		}
+	}
+
+	resp, err := s.client.ListOffsets(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]map[int]int64, len(resp.Topics))
+	for topic, ps := range resp.Topics {
+		out[topic] = make(map[int]int64, len(ps))
+		for _, p := range ps {
+			if p.Error != nil {
+				return nil, fmt.Errorf("list offsets %s/%d: %w", topic, p.Partition, p.Error)
+			}
+			if p.FirstOffset >= 0 {
+				out[topic][p.Partition] = p.FirstOffset
+			} else {
+				out[topic][p.Partition] = p.LastOffset
+			}
+		}
+	}
+	return out, nil
+}
+
+// offsetsForTime ищет первый оффсет с временем >= at через offset-for-time брокера;
+// если таких сообщений ещё нет, партиция читается с конца
+func (s *Starter) offsetsForTime(ctx context.Context, partitions map[string][]int, at time.Time) (map[string]map[int]int64, error) {
+	req := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest, len(partitions))}
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			req.Topics[topic] = append(req.Topics[topic], kafka.TimeOffsetOf(p, at))
+		}
+	}
+
+	resp, err := s.client.ListOffsets(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]map[int]int64)
+	missing := make(map[string][]int)
+	for topic, ps := range resp.Topics {
+		for _, p := range ps {
+			if p.Error != nil {
+				return nil, fmt.Errorf("list offsets %s/%d: %w", topic, p.Partition, p.Error)
+			}
+			found := false
+			for off := range p.Offsets {
+				if off >= 0 {
+					if out[topic] == nil {
+						out[topic] = make(map[int]int64)
+					}
+					out[topic][p.Partition] = off
+					found = true
+				}
+			}
+			if !found {
+				missing[topic] = append(missing[topic], p.Partition)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		latest, err := s.listOffsets(ctx, missing, kafka.LastOffsetOf)
+		if err != nil {
+			return nil, err
+		}
+		for topic, ps := range latest {
+			if out[topic] == nil {
+				out[topic] = make(map[int]int64)
+			}
+			for p, off := range ps {
+				out[topic][p] = off
+			}
+		}
+	}
+	return out, nil
+}
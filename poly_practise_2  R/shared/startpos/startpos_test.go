@@ -0,0 +1,137 @@
+package startpos
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{"default", Config{}, ""},
+		{"earliest with reset", Config{From: Earliest, Reset: true}, ""},
+		{"offset without offsets", Config{From: Offset}, "requires offsets"},
+		{"timestamp without time", Config{From: Timestamp}, "requires time"},
+		{"timestamp", Config{From: Timestamp, Time: time.Now()}, ""},
+		{"unknown", Config{From: "middle"}, "unknown start position"},
+		{"reset to committed", Config{From: Committed, Reset: true}, "explicit start position"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Validate() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseOffsets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]map[int]int64
+		wantErr bool
+	}{
+		{"", map[string]map[int]int64{}, false},
+		{"orders:0=10, orders:1=20", map[string]map[int]int64{"orders": {0: 10, 1: 20}}, false},
+		{"ns:orders:2=5", map[string]map[int]int64{"ns:orders": {2: 5}}, false}, // партиция - после последнего ':'
+		{"orders=10", nil, true},
+		{":0=10", nil, true},
+		{"orders:x=10", nil, true},
+		{"orders:0=ten", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseOffsets(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseOffsets(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseOffsets(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveOffsets(t *testing.T) {
+	s := New(nil, &Config{From: Offset, Offsets: map[string]map[int]int64{"orders": {0: 10, 2: 30}}}, zap.NewNop())
+	got, err := s.resolve(context.Background(), map[string][]int{"orders": {0, 1}, "clicks": {0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// партиции без заданного оффсета остаются на стартовом оффсете группы
+	if want := map[string]map[int]int64{"orders": {0: 10}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolve() = %v, want %v", got, want)
+	}
+
+	s.cfg.From = "middle"
+	if _, err := s.resolve(context.Background(), map[string][]int{"orders": {0}}); err == nil {
+		t.Error("resolve() of unknown position returned no error")
+	}
+}
+
+func TestApplyRestore(t *testing.T) {
+	assigned := map[string][]kafka.PartitionAssignment{"orders": {{ID: 0, Offset: 5}, {ID: 1, Offset: -1}}}
+	tests := []struct {
+		name    string
+		restore map[string]map[int]int64
+		skip    bool
+		applied bool
+		want    map[int]int64 // оффсеты назначений первого поколения
+	}{
+		{"assigned partitions", map[string]map[int]int64{"orders": {0: 3, 1: 7}}, false, true, map[int]int64{0: 3, 1: 7}},
+		{"subset of assignment", map[string]map[int]int64{"orders": {0: 3}}, false, true, map[int]int64{0: 3, 1: -1}},
+		{"partition of another replica", map[string]map[int]int64{"orders": {0: 3, 2: 9}}, false, false, map[int]int64{0: 5, 1: -1}},
+		{"other topic", map[string]map[int]int64{"clicks": {0: 3}}, false, false, map[int]int64{0: 5, 1: -1}},
+		{"skipped before first generation", map[string]map[int]int64{"orders": {0: 3}}, true, false, map[int]int64{0: 5, 1: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, &Config{From: Committed}, zap.NewNop())
+			applied := s.Restore(tt.restore)
+			if tt.skip {
+				s.Skip()
+			}
+			for gen := 0; gen < 2; gen++ { // снапшот применяется только в первом поколении
+				as := s.Apply(context.Background(), &kafka.Generation{Assignments: assigned})
+				got := make(map[int]int64)
+				for _, a := range as["orders"] {
+					got[a.ID] = a.Offset
+				}
+				want := tt.want
+				if gen > 0 {
+					want = map[int]int64{0: 5, 1: -1}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("generation %d offsets = %v, want %v", gen, got, want)
+				}
+			}
+			select {
+			case ok := <-applied:
+				if ok != tt.applied {
+					t.Errorf("restore applied = %v, want %v", ok, tt.applied)
+				}
+			default:
+				t.Fatal("no restore decision")
+			}
+			select {
+			case <-applied:
+				t.Error("restore decided twice")
+			default:
+			}
+			if assigned["orders"][0].Offset != 5 {
+				t.Error("Apply changed assignments of the generation")
+			}
+		})
+	}
+}